@@ -0,0 +1,272 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Meta 磁盘缓存条目的元数据，与数据文件一同保存
+type Meta struct {
+	URL     string      `json:"url"`
+	Header  http.Header `json:"header"`
+	Size    int64       `json:"size"`
+	Stored  time.Time   `json:"stored"`
+	Expires time.Time   `json:"expires"`
+}
+
+type diskItem struct {
+	name string
+	meta *Meta
+}
+
+// DiskCache 按总字节数淘汰的 LRU 磁盘缓存
+// 每个条目对应目录下的 <hash>.data 与 <hash>.meta 两个文件
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+// OpenDiskCache 打开缓存目录并加载已有条目
+func OpenDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// MaxBytes 返回缓存容量
+func (c *DiskCache) MaxBytes() int64 {
+	return c.maxBytes
+}
+
+func (c *DiskCache) load() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	type loaded struct {
+		name string
+		meta *Meta
+	}
+	var items []loaded
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".meta")
+		if !ok {
+			// 清理上次进程遗留的临时文件
+			if strings.HasPrefix(e.Name(), "tmp-") {
+				os.Remove(filepath.Join(c.dir, e.Name()))
+			}
+			continue
+		}
+		meta, err := readMeta(filepath.Join(c.dir, e.Name()))
+		if err != nil || time.Now().After(meta.Expires) {
+			c.removeFiles(name)
+			continue
+		}
+		if fi, err := os.Stat(c.dataPath(name)); err != nil || fi.Size() != meta.Size {
+			c.removeFiles(name)
+			continue
+		}
+		items = append(items, loaded{name: name, meta: meta})
+	}
+
+	// 以写入时间近似访问顺序，最新的放在最前
+	sort.Slice(items, func(a, b int) bool {
+		return items[a].meta.Stored.Before(items[b].meta.Stored)
+	})
+	for _, it := range items {
+		c.items[it.name] = c.ll.PushFront(&diskItem{name: it.name, meta: it.meta})
+		c.size += it.meta.Size
+	}
+	c.evictLocked()
+	return nil
+}
+
+// Open 打开未过期的缓存条目，调用者负责关闭返回的文件
+func (c *DiskCache) Open(key string) (*os.File, *Meta, bool) {
+	name := hashKey(key)
+
+	c.mu.Lock()
+	el, ok := c.items[name]
+	if !ok {
+		c.mu.Unlock()
+		return nil, nil, false
+	}
+	item := el.Value.(*diskItem)
+	if time.Now().After(item.meta.Expires) {
+		c.removeElementLocked(el)
+		c.mu.Unlock()
+		return nil, nil, false
+	}
+	c.ll.MoveToFront(el)
+	c.mu.Unlock()
+
+	f, err := os.Open(c.dataPath(name))
+	if err != nil {
+		return nil, nil, false
+	}
+	return f, item.meta, true
+}
+
+// Create 开始写入一个新条目，需调用 Commit 或 Abort 结束
+func (c *DiskCache) Create(key string) (*DiskWriter, error) {
+	f, err := os.CreateTemp(c.dir, "tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &DiskWriter{cache: c, key: key, file: f}, nil
+}
+
+func (c *DiskCache) commit(key string, tmpPath string, meta *Meta) error {
+	if meta.Size > c.maxBytes {
+		os.Remove(tmpPath)
+		return errors.New("object larger than cache")
+	}
+	name := hashKey(key)
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[name]; ok {
+		c.removeElementLocked(el)
+	}
+	if err := os.Rename(tmpPath, c.dataPath(name)); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.WriteFile(c.metaPath(name), metaBytes, 0o644); err != nil {
+		c.removeFiles(name)
+		return err
+	}
+
+	c.items[name] = c.ll.PushFront(&diskItem{name: name, meta: meta})
+	c.size += meta.Size
+	c.evictLocked()
+	return nil
+}
+
+func (c *DiskCache) evictLocked() {
+	for c.size > c.maxBytes {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.removeElementLocked(oldest)
+	}
+}
+
+func (c *DiskCache) removeElementLocked(el *list.Element) {
+	item := el.Value.(*diskItem)
+	c.ll.Remove(el)
+	delete(c.items, item.name)
+	c.size -= item.meta.Size
+	c.removeFiles(item.name)
+}
+
+func (c *DiskCache) removeFiles(name string) {
+	os.Remove(c.dataPath(name))
+	os.Remove(c.metaPath(name))
+}
+
+func (c *DiskCache) dataPath(name string) string {
+	return filepath.Join(c.dir, name+".data")
+}
+
+func (c *DiskCache) metaPath(name string) string {
+	return filepath.Join(c.dir, name+".meta")
+}
+
+func readMeta(path string) (*Meta, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var meta Meta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// DiskWriter 写入中的缓存条目
+type DiskWriter struct {
+	cache *DiskCache
+	key   string
+	file  *os.File
+	size  int64
+	err   error
+}
+
+// Write 写入数据，出错后忽略后续写入并在 Commit 时报告
+func (w *DiskWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return len(p), nil
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	if err == nil && w.size > w.cache.maxBytes {
+		err = errors.New("object larger than cache")
+	}
+	if err != nil {
+		w.err = err
+	}
+	return len(p), nil
+}
+
+// Size 返回已写入的字节数
+func (w *DiskWriter) Size() int64 {
+	return w.size
+}
+
+// Commit 完成写入并加入缓存
+func (w *DiskWriter) Commit(meta *Meta) error {
+	closeErr := w.file.Close()
+	if w.err != nil || closeErr != nil {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("write cache object: %w", errors.Join(w.err, closeErr))
+	}
+	meta.Size = w.size
+	return w.cache.commit(w.key, w.file.Name(), meta)
+}
+
+// Abort 放弃写入
+func (w *DiskWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func putDisk(t *testing.T, c *DiskCache, key, body string, stored time.Time, ttl time.Duration) {
+	t.Helper()
+	w, err := c.Create(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(body))
+	meta := &Meta{URL: key, Header: http.Header{"Content-Type": {"video/mp2t"}}, Stored: stored, Expires: stored.Add(ttl)}
+	if err := w.Commit(meta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readDisk(c *DiskCache, key string) (string, bool) {
+	f, _, ok := c.Open(key)
+	if !ok {
+		return "", false
+	}
+	defer f.Close()
+	b, _ := io.ReadAll(f)
+	return string(b), true
+}
+
+func TestDiskCacheEvictsBySize(t *testing.T) {
+	c, err := OpenDiskCache(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	putDisk(t, c, "a", "aaaa", now, time.Hour)
+	putDisk(t, c, "b", "bbbb", now, time.Hour)
+	// 访问 a 使 b 成为最久未使用的条目
+	if _, ok := readDisk(c, "a"); !ok {
+		t.Fatal("a missing")
+	}
+	putDisk(t, c, "c", "cccc", now, time.Hour)
+
+	if _, ok := readDisk(c, "b"); ok {
+		t.Error("b should be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if body, ok := readDisk(c, key); !ok || body != strings.Repeat(key, 4) {
+			t.Errorf("%s = %q, %v", key, body, ok)
+		}
+	}
+	if c.size != 8 {
+		t.Errorf("size = %d, want 8", c.size)
+	}
+
+	// 超过总容量的对象不会被缓存
+	w, _ := c.Create("big")
+	w.Write([]byte(strings.Repeat("x", 11)))
+	if err := w.Commit(&Meta{Expires: now.Add(time.Hour)}); err == nil {
+		t.Error("oversized commit succeeded")
+	}
+	if c.size != 8 {
+		t.Errorf("size after oversized commit = %d, want 8", c.size)
+	}
+}
+
+func TestDiskCacheExpiry(t *testing.T) {
+	c, err := OpenDiskCache(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putDisk(t, c, "old", "x", time.Now().Add(-2*time.Second), time.Second)
+	if _, ok := readDisk(c, "old"); ok {
+		t.Error("expired entry served")
+	}
+	if _, err := os.Stat(c.dataPath(hashKey("old"))); !os.IsNotExist(err) {
+		t.Errorf("expired data file still present: %v", err)
+	}
+}
+
+func TestDiskCacheAbort(t *testing.T) {
+	dir := t.TempDir()
+	c, err := OpenDiskCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, _ := c.Create("a")
+	w.Write([]byte("partial"))
+	w.Abort()
+	if _, ok := readDisk(c, "a"); ok {
+		t.Error("aborted entry served")
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("leftover files: %v", files)
+	}
+}
+
+func TestDiskCacheReload(t *testing.T) {
+	dir := t.TempDir()
+	c, err := OpenDiskCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	putDisk(t, c, "fresh", "abc", now, time.Hour)
+	putDisk(t, c, "stale", "def", now.Add(-time.Hour), time.Minute)
+	putDisk(t, c, "truncated", "ghi", now, time.Hour)
+	os.WriteFile(c.dataPath(hashKey("truncated")), []byte("g"), 0o644)
+	os.WriteFile(filepath.Join(dir, "tmp-123"), []byte("junk"), 0o644)
+
+	c, err = OpenDiskCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, ok := readDisk(c, "fresh"); !ok || body != "abc" {
+		t.Errorf("fresh = %q, %v", body, ok)
+	}
+	for _, key := range []string{"stale", "truncated"} {
+		if _, ok := readDisk(c, key); ok {
+			t.Errorf("%s loaded", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tmp-123")); !os.IsNotExist(err) {
+		t.Error("temp file not cleaned up")
+	}
+	if c.size != 3 {
+		t.Errorf("size = %d, want 3", c.size)
+	}
+
+	// 重新加载时按容量淘汰最早写入的条目
+	putDisk(t, c, "newer", "jkl", now.Add(time.Second), time.Hour)
+	c, err = OpenDiskCache(dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readDisk(c, "fresh"); ok {
+		t.Error("older entry kept over capacity")
+	}
+	if _, ok := readDisk(c, "newer"); !ok {
+		t.Error("newer entry evicted")
+	}
+}
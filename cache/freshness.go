@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storable 判断响应能否存入所有用户共享的缓存
+// 带有 no-store/private 或 Vary: * 的响应因请求而异，不能复用给其他用户
+func Storable(h http.Header) bool {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(strings.ToLower(directive)), "=")
+		if name == "no-store" || name == "private" {
+			return false
+		}
+	}
+	for _, vary := range h.Values("Vary") {
+		for _, field := range strings.Split(vary, ",") {
+			if strings.TrimSpace(field) == "*" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Freshness 根据上游响应的缓存头计算可缓存时长
+// 响应不可共享缓存或带有 no-cache 时返回 false；未声明有效期时使用 fallback
+func Freshness(h http.Header, now time.Time, fallback time.Duration) (time.Duration, bool) {
+	if !Storable(h) {
+		return 0, false
+	}
+	var maxAge, sMaxAge = -1, -1
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(strings.ToLower(directive)), "=")
+		switch name {
+		case "no-cache":
+			return 0, false
+		case "max-age":
+			maxAge = parseSeconds(value)
+		case "s-maxage":
+			sMaxAge = parseSeconds(value)
+		}
+	}
+	if strings.Contains(strings.ToLower(h.Get("Pragma")), "no-cache") && h.Get("Cache-Control") == "" {
+		return 0, false
+	}
+
+	var ttl time.Duration
+	switch {
+	case sMaxAge >= 0:
+		ttl = time.Duration(sMaxAge) * time.Second
+	case maxAge >= 0:
+		ttl = time.Duration(maxAge) * time.Second
+	case h.Get("Expires") != "":
+		expires, err := http.ParseTime(h.Get("Expires"))
+		if err != nil {
+			// 无法解析的 Expires 视为已过期
+			return 0, false
+		}
+		ttl = expires.Sub(now)
+	default:
+		return fallback, fallback > 0
+	}
+
+	// 减去上游缓存已持有的时间
+	if age, err := strconv.Atoi(strings.TrimSpace(h.Get("Age"))); err == nil && age > 0 {
+		ttl -= time.Duration(age) * time.Second
+	}
+	return ttl, ttl > 0
+}
+
+func parseSeconds(value string) int {
+	n, err := strconv.Atoi(strings.Trim(value, `"`))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFreshness(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		header  http.Header
+		wantTTL time.Duration
+		wantOK  bool
+	}{
+		{"fallback", http.Header{}, time.Minute, true},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=30"}}, 30 * time.Second, true},
+		{"s-maxage wins", http.Header{"Cache-Control": {"max-age=30, s-maxage=60"}}, time.Minute, true},
+		{"age subtracted", http.Header{"Cache-Control": {"max-age=30"}, "Age": {"10"}}, 20 * time.Second, true},
+		{"age exceeds", http.Header{"Cache-Control": {"max-age=30"}, "Age": {"40"}}, -10 * time.Second, false},
+		{"expires", http.Header{"Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour, true},
+		{"bad expires", http.Header{"Expires": {"0"}}, 0, false},
+		{"max-age zero", http.Header{"Cache-Control": {"max-age=0"}}, 0, false},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache"}}, 0, false},
+		{"no-store", http.Header{"Cache-Control": {"max-age=60, no-store"}}, 0, false},
+		{"private", http.Header{"Cache-Control": {"Private"}}, 0, false},
+		{"pragma", http.Header{"Pragma": {"no-cache"}}, 0, false},
+		{"pragma with cache-control", http.Header{"Pragma": {"no-cache"}, "Cache-Control": {"max-age=5"}}, 5 * time.Second, true},
+		{"vary star", http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Encoding, *"}}, 0, false},
+		{"vary", http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Encoding"}}, time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl, ok := Freshness(tt.header, now, time.Minute)
+			if ok != tt.wantOK || (ok && ttl != tt.wantTTL) {
+				t.Errorf("Freshness() = %v, %v, want %v, %v", ttl, ok, tt.wantTTL, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestStorable(t *testing.T) {
+	tests := []struct {
+		header http.Header
+		want   bool
+	}{
+		{http.Header{}, true},
+		{http.Header{"Cache-Control": {"no-cache"}}, true},
+		{http.Header{"Cache-Control": {"no-store"}}, false},
+		{http.Header{"Cache-Control": {`private="Set-Cookie"`}}, false},
+		{http.Header{"Vary": {"Origin", "*"}}, false},
+		{http.Header{"Vary": {"Origin"}}, true},
+	}
+	for _, tt := range tests {
+		if got := Storable(tt.header); got != tt.want {
+			t.Errorf("Storable(%v) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Entry 缓存的完整响应
+type Entry struct {
+	Header http.Header
+	Body   []byte
+	Stored time.Time
+}
+
+type memoryItem struct {
+	key    string
+	entry  *Entry
+	expiry time.Time
+}
+
+// MemoryCache 按总字节数淘汰的 LRU 内存缓存，条目在 TTL 后过期
+type MemoryCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	ttl      time.Duration
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+// NewMemoryCache 创建内存缓存
+// maxBytes: 缓存体总大小上限
+// ttl: 条目存活时间
+func NewMemoryCache(maxBytes int64, ttl time.Duration) *MemoryCache {
+	return &MemoryCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// MaxBytes 返回缓存容量
+func (c *MemoryCache) MaxBytes() int64 {
+	return c.maxBytes
+}
+
+// Get 获取未过期的条目
+func (c *MemoryCache) Get(key string) (*Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := el.Value.(*memoryItem)
+	if time.Now().After(item.expiry) {
+		c.removeElement(el)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return item.entry, true
+}
+
+// Contains 判断条目是否存在且未过期，不影响 LRU 顺序
+func (c *MemoryCache) Contains(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	return ok && time.Now().Before(el.Value.(*memoryItem).expiry)
+}
+
+// Set 写入条目，超过容量时淘汰最久未使用的条目
+func (c *MemoryCache) Set(key string, entry *Entry) {
+	size := int64(len(entry.Body))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+	el := c.ll.PushFront(&memoryItem{
+		key:    key,
+		entry:  entry,
+		expiry: time.Now().Add(c.ttl),
+	})
+	c.items[key] = el
+	c.size += size
+
+	for c.size > c.maxBytes {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.removeElement(oldest)
+	}
+}
+
+func (c *MemoryCache) removeElement(el *list.Element) {
+	item := el.Value.(*memoryItem)
+	c.ll.Remove(el)
+	delete(c.items, item.key)
+	c.size -= int64(len(item.entry.Body))
+}
@@ -1,16 +1,174 @@
 package config
 
-import "github.com/zjyl1994/donggua-proxy/utils"
+import (
+	"time"
+
+	"github.com/zjyl1994/donggua-proxy/utils"
+)
 
 var (
 	ListenAddr     = utils.GetEnv("LISTEN_ADDR", ":8080")
 	AccessPassword = utils.GetEnv("PROXY_PASSWORD", "")
 
+	// Listeners 多个监听，逗号分隔，如 "unix:///run/dgproxy.sock,h2c://127.0.0.1:8081,tcp://127.0.0.1:9090?handler=admin"
+	// 配置后忽略 ListenAddr
+	Listeners = utils.GetEnv("LISTENERS", "")
+
+	// ReadyCheckDNSHost 就绪检查时解析的域名 (为空时不检查解析)
+	ReadyCheckDNSHost = utils.GetEnv("READY_CHECK_DNS_HOST", "")
+	// ReadyCheckTMDB 就绪检查时探测 TMDB API 是否可达
+	ReadyCheckTMDB = utils.GetEnvBool("READY_CHECK_TMDB", false)
+	// ReadyCheckSubscriptions 就绪检查时探测的订阅地址，逗号分隔，需返回 200
+	ReadyCheckSubscriptions = utils.GetEnv("READY_CHECK_SUBSCRIPTIONS", "")
+	// ReadyCheckTimeout 一次就绪检查的超时时间
+	ReadyCheckTimeout = utils.GetEnvDuration("READY_CHECK_TIMEOUT", 5*time.Second)
+	// ReadyCheckCacheTTL 就绪检查结果的缓存时间，避免探测请求被放大到上游
+	ReadyCheckCacheTTL = utils.GetEnvDuration("READY_CHECK_CACHE_TTL", 10*time.Second)
+
+	// DrainTimeout 退出或重启时等待进行中的请求 (分片、MP4 流) 完成的最长时间
+	DrainTimeout = utils.GetEnvDuration("DRAIN_TIMEOUT", 60*time.Second)
+	// DrainDelay 开始排空后仍继续接受请求的时间，期间 /health 返回 503，便于负载均衡摘除实例
+	DrainDelay = utils.GetEnvDuration("DRAIN_DELAY", 0)
+	// HandoffTimeout SIGUSR2 交接时等待新进程就绪的最长时间，超时或新进程退出时放弃交接
+	HandoffTimeout = utils.GetEnvDuration("HANDOFF_TIMEOUT", 30*time.Second)
+
+	// TLSCerts 证书与私钥文件，如 "a.crt:a.key,b.crt:b.key"，配置后直接提供 HTTPS 并按 SNI 选择证书
+	TLSCerts = utils.GetEnv("TLS_CERTS", "")
+	// TLSReloadInterval 检查证书文件变化的间隔 (0 为不检查)
+	TLSReloadInterval = utils.GetEnvDuration("TLS_RELOAD_INTERVAL", 30*time.Second)
+	// HTTPRedirectAddr 将 HTTP 跳转到 HTTPS 的监听地址，如 ":80" (为空时关闭)
+	HTTPRedirectAddr = utils.GetEnv("HTTP_REDIRECT_ADDR", "")
+
+	// HTTP3 在 TLS 之外同时提供 HTTP/3 (QUIC)，需要配置 TLSCerts
+	HTTP3 = utils.GetEnvBool("HTTP3", false)
+	// HTTP3Addr HTTP/3 的 UDP 监听地址 (为空时与 LISTEN_ADDR 相同)
+	HTTP3Addr = utils.GetEnv("HTTP3_ADDR", "")
+	// HTTP3AltSvcPort Alt-Svc 中通告的 UDP 端口 (0 为监听端口)
+	HTTP3AltSvcPort = utils.GetEnvInt("HTTP3_ALT_SVC_PORT", 0)
+
+	// WriteTimeout TMDB、订阅转换等接口写出完整响应的最长时间
+	WriteTimeout = utils.GetEnvDuration("WRITE_TIMEOUT", 60*time.Second)
+	// StreamIdleTimeout 通用代理透传媒体时没有数据流动的最长时间，数据持续流动时不受 WriteTimeout 限制
+	StreamIdleTimeout = utils.GetEnvDuration("STREAM_IDLE_TIMEOUT", 30*time.Second)
+
 	TrustProxy        = utils.GetEnvBool("TRUST_PROXY", false)
 	TrustedProxyCIDRs = utils.GetEnv("TRUSTED_PROXY_CIDRS", "")
 
+	// DNSMinTTL/DNSMaxTTL 解析结果缓存时间的上下限 (按记录 TTL 缓存)
+	DNSMinTTL = utils.GetEnvDuration("DNS_MIN_TTL", 10*time.Second)
+	DNSMaxTTL = utils.GetEnvDuration("DNS_MAX_TTL", 10*time.Minute)
+	// DNSNegativeTTL NXDOMAIN/SERVFAIL 等失败结果的最长缓存时间
+	DNSNegativeTTL = utils.GetEnvDuration("DNS_NEGATIVE_TTL", 30*time.Second)
+	// DNSCacheSize 最多缓存的域名数
+	DNSCacheSize = utils.GetEnvInt("DNS_CACHE_SIZE", 4096)
+	// DNSUpstreams DNS 上游，逗号分隔，支持 udp://、tcp://、tls://、https://，服务器须为 IP 地址 (为空时使用 /etc/resolv.conf 中的 nameserver)
+	DNSUpstreams = utils.GetEnv("DNS_UPSTREAMS", "")
+	// DNSDomainUpstreams 按域名指定上游，如 "tmdb.org,themoviedb.org=tls://1.1.1.1;cdn.com=8.8.8.8"
+	DNSDomainUpstreams = utils.GetEnv("DNS_DOMAIN_UPSTREAMS", "")
+	// DNSHosts 静态解析表，如 "a.com=1.2.3.4,2001:db8::1;b.com=5.6.7.8"
+	DNSHosts = utils.GetEnv("DNS_HOSTS", "")
+
+	// DialIPPreference 连接目标时的地址族偏好: auto (IPv6 优先交替)、prefer-ipv4、ipv4、ipv6
+	DialIPPreference = utils.GetEnv("DIAL_IP_PREFERENCE", "auto")
+	// DialFallbackDelay 上一个地址未连上时发起下一个连接前的等待时间
+	DialFallbackDelay = utils.GetEnvDuration("DIAL_FALLBACK_DELAY", 250*time.Millisecond)
+	// DialTimeout 单个地址的连接超时
+	DialTimeout = utils.GetEnvDuration("DIAL_TIMEOUT", 10*time.Second)
+	// DialFailurePenalty 连接失败的地址在该时间内排到最后
+	DialFailurePenalty = utils.GetEnvDuration("DIAL_FAILURE_PENALTY", 5*time.Minute)
+
+	// SSRF 策略名单，均为逗号分隔。内置的 IANA 特殊用途地址段 (私有、回环、CGNAT 等) 始终拒绝，
+	// 除非目标主机在 SSRFAllowHosts 或地址在 SSRFAllowCIDRs 中
+	SSRFAllowHosts = utils.GetEnv("SSRF_ALLOW_HOSTS", "")
+	SSRFDenyHosts  = utils.GetEnv("SSRF_DENY_HOSTS", "")
+	SSRFAllowCIDRs = utils.GetEnv("SSRF_ALLOW_CIDRS", "")
+	SSRFDenyCIDRs  = utils.GetEnv("SSRF_DENY_CIDRS", "")
+	SSRFAllowPorts = utils.GetEnv("SSRF_ALLOW_PORTS", "")
+	SSRFDenyPorts  = utils.GetEnv("SSRF_DENY_PORTS", "")
+
+	// ProxyHostAllowlist 通用代理只允许访问白名单中的主机
+	ProxyHostAllowlist = utils.GetEnvBool("PROXY_HOST_ALLOWLIST", false)
+	// ProxyAllowedHosts 白名单主机，逗号分隔，"*.example.com" 同时匹配子域名
+	ProxyAllowedHosts = utils.GetEnv("PROXY_ALLOWED_HOSTS", "")
+	// ProxySubscriptionHosts 可信的订阅主机，逗号分隔，经 /sub/moon2donggua 转换时其中的站点接口自动加入白名单
+	ProxySubscriptionHosts = utils.GetEnv("PROXY_SUBSCRIPTION_HOSTS", "")
+	// ProxyAllowlistTTL 自动加入白名单的主机 (订阅站点接口、播放列表引用) 的有效期
+	ProxyAllowlistTTL = utils.GetEnvDuration("PROXY_ALLOWLIST_TTL", 24*time.Hour)
+
+	// ProxyMaxRequestBodyMB 通用代理转发的请求体上限 (MB)，0 表示不限制
+	ProxyMaxRequestBodyMB = utils.GetEnvInt("PROXY_MAX_REQUEST_BODY_MB", 10)
+	// ProxyMutatingHosts 允许接收 POST/PUT/PATCH/DELETE 的主机，逗号分隔，为空时不限制
+	ProxyMutatingHosts = utils.GetEnv("PROXY_MUTATING_HOSTS", "")
+	// ProxyForwardHeaders 额外转发给上游的客户端请求头，逗号分隔
+	ProxyForwardHeaders = utils.GetEnv("PROXY_FORWARD_HEADERS", "")
+
+	// HeaderProfilesFile 按站点配置上游请求头的 JSON 文件
+	HeaderProfilesFile = utils.GetEnv("HEADER_PROFILES_FILE", "")
+	// ProfileSigningKey 子地址中请求头配置签名的密钥，为空时每次启动随机生成
+	ProfileSigningKey = utils.GetEnv("PROFILE_SIGNING_KEY", "")
+
 	// RateLimit 每秒请求数限制 (默认 50)
 	RateLimit = utils.GetEnvInt("RATE_LIMIT", 50)
 	// BurstLimit 突发请求数限制 (默认 100)
 	BurstLimit = utils.GetEnvInt("BURST_LIMIT", 100)
+	// RateLimitMaxDelay 代理请求超出限流时最多排队等待的时间 (默认 0，即直接拒绝)
+	RateLimitMaxDelay = utils.GetEnvDuration("RATE_LIMIT_MAX_DELAY", 0)
+	// RateLimitRedisURL 多实例共享限流状态的 Redis 地址 (为空时使用进程内存)
+	RateLimitRedisURL = utils.GetEnv("RATE_LIMIT_REDIS_URL", "")
+
+	// UpstreamRetries 幂等上游请求 (GET/HEAD) 失败后的最大重试次数 (0 为不重试)
+	UpstreamRetries = utils.GetEnvInt("UPSTREAM_RETRIES", 2)
+	// UpstreamRetryStatus 触发重试的上游状态码，逗号分隔
+	UpstreamRetryStatus = utils.GetEnv("UPSTREAM_RETRY_STATUS", "502,503,504")
+	// UpstreamRetryBackoff 首次重试的退避时间，之后每次翻倍并加入随机抖动
+	UpstreamRetryBackoff = utils.GetEnvDuration("UPSTREAM_RETRY_BACKOFF", 200*time.Millisecond)
+	// UpstreamRetryBudgetPercent 重试次数占请求总数的上限 (百分比)
+	UpstreamRetryBudgetPercent = utils.GetEnvInt("UPSTREAM_RETRY_BUDGET_PERCENT", 20)
+
+	// CompressResponses 按客户端 Accept-Encoding 压缩播放列表、TMDB JSON 与订阅转换响应
+	CompressResponses = utils.GetEnvBool("COMPRESS_RESPONSES", false)
+
+	// 各类上游响应的最大大小 (MB) 与最长传输时间，0 表示不限制
+	// 播放列表需要整体缓冲，应保留大小限制
+	LimitPlaylistMB       = utils.GetEnvInt("LIMIT_PLAYLIST_MB", 4)
+	LimitPlaylistDuration = utils.GetEnvDuration("LIMIT_PLAYLIST_DURATION", 15*time.Second)
+	LimitSegmentMB        = utils.GetEnvInt("LIMIT_SEGMENT_MB", 0)
+	LimitSegmentDuration  = utils.GetEnvDuration("LIMIT_SEGMENT_DURATION", 0)
+	LimitTMDBJSONMB       = utils.GetEnvInt("LIMIT_TMDB_JSON_MB", 4)
+	LimitTMDBJSONDuration = utils.GetEnvDuration("LIMIT_TMDB_JSON_DURATION", 30*time.Second)
+	LimitImageMB          = utils.GetEnvInt("LIMIT_IMAGE_MB", 20)
+	LimitImageDuration    = utils.GetEnvDuration("LIMIT_IMAGE_DURATION", 60*time.Second)
+	LimitGenericMB        = utils.GetEnvInt("LIMIT_GENERIC_MB", 0)
+	LimitGenericDuration  = utils.GetEnvDuration("LIMIT_GENERIC_DURATION", 0)
+
+	// PrefetchSegments 播放分片时预取的后续分片数量 (默认 0，即关闭预取)
+	PrefetchSegments = utils.GetEnvInt("PREFETCH_SEGMENTS", 0)
+	// PrefetchConcurrency 每个播放列表同时预取的分片数
+	PrefetchConcurrency = utils.GetEnvInt("PREFETCH_CONCURRENCY", 2)
+	// PrefetchCacheMB 预取缓存总大小 (MB)
+	PrefetchCacheMB = utils.GetEnvInt("PREFETCH_CACHE_MB", 256)
+	// PrefetchTTL 预取分片在缓存中的存活时间
+	PrefetchTTL = utils.GetEnvDuration("PREFETCH_TTL", 2*time.Minute)
+
+	// PlaylistVODTTL 点播播放列表在共享缓存中的存活时间 (直播列表按目标时长自动计算)
+	PlaylistVODTTL = utils.GetEnvDuration("PLAYLIST_VOD_TTL", time.Minute)
+	// HLSDVRWindow 直播列表的回看窗口长度 (默认 0，即与上游一致)
+	HLSDVRWindow = utils.GetEnvDuration("HLS_DVR_WINDOW", 0)
+
+	// HLSKeyMode HLS 密钥处理模式: proxy (默认)、cache (预取并缓存密钥)、decrypt (代理解密 AES-128 分片)
+	HLSKeyMode = utils.GetEnv("HLS_KEY_MODE", "proxy")
+	// HLSKeyTTL 密钥缓存时间
+	HLSKeyTTL = utils.GetEnvDuration("HLS_KEY_TTL", 5*time.Minute)
+
+	// SegmentUnwrap 去掉伪装成图片 (PNG/GIF/JPEG 文件头) 的 TS 分片前缀
+	SegmentUnwrap = utils.GetEnvBool("SEGMENT_UNWRAP", false)
+
+	// SegmentCacheDir 共享分片磁盘缓存目录 (为空时关闭)
+	SegmentCacheDir = utils.GetEnv("SEGMENT_CACHE_DIR", "")
+	// SegmentCacheMB 分片磁盘缓存总大小 (MB)
+	SegmentCacheMB = utils.GetEnvInt("SEGMENT_CACHE_MB", 2048)
+	// SegmentCacheTTL 上游未声明缓存时间时的默认缓存时长
+	SegmentCacheTTL = utils.GetEnvDuration("SEGMENT_CACHE_TTL", time.Hour)
+	// SegmentCacheStripParams 计算缓存键时去掉的查询参数，逗号分隔，"*" 表示去掉全部
+	SegmentCacheStripParams = utils.GetEnv("SEGMENT_CACHE_STRIP_PARAMS", "")
 )
@@ -2,4 +2,17 @@ module github.com/zjyl1994/donggua-proxy
 
 go 1.24.5
 
-require golang.org/x/time v0.14.0
+require (
+	github.com/andybalholm/brotli v1.2.6
+	github.com/quic-go/quic-go v0.59.1
+	golang.org/x/net v0.47.0
+	golang.org/x/sync v0.18.0
+	golang.org/x/time v0.14.0
+)
+
+require (
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/crypto v0.44.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
+	golang.org/x/text v0.31.0 // indirect
+)
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/zjyl1994/donggua-proxy/utils"
+)
+
+var startTime = time.Now()
+
+// MetricsHandler 以 Prometheus 文本格式输出运行指标，只应挂载在内部管理监听上
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics := []struct {
+		name, help, kind string
+		value            float64
+	}{
+		{"dgproxy_uptime_seconds", "Seconds since the process started.", "gauge", time.Since(startTime).Seconds()},
+		{"dgproxy_dns_cache_entries", "Number of hosts in the DNS cache.", "gauge", float64(utils.Resolver.Len())},
+		{"go_goroutines", "Number of goroutines that currently exist.", "gauge", float64(runtime.NumGoroutine())},
+		{"go_memstats_heap_alloc_bytes", "Number of heap bytes allocated and still in use.", "gauge", float64(mem.HeapAlloc)},
+		{"go_memstats_sys_bytes", "Number of bytes obtained from system.", "gauge", float64(mem.Sys)},
+		{"go_gc_cycles_total", "Number of completed GC cycles.", "counter", float64(mem.NumGC)},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zjyl1994/donggua-proxy/config"
+	"github.com/zjyl1994/donggua-proxy/utils"
+)
+
+const (
+	// maxDynamicHosts 自动加入白名单的主机数上限
+	maxDynamicHosts = 10000
+	// maxSiteAPIScan 扫描站点接口 JSON 中地址的最大字节数
+	maxSiteAPIScan = 4 * 1024 * 1024
+)
+
+// targetAllowlist 为 nil 表示不限制通用代理的目标主机
+var targetAllowlist = newHostAllowlist(config.ProxyHostAllowlist, config.ProxyAllowedHosts, config.ProxySubscriptionHosts, config.ProxyAllowlistTTL)
+
+// hostAllowlist 通用代理的目标主机白名单
+// 除配置的主机外，可信订阅转换得到的站点接口、站点接口 JSON 中出现的媒体地址、
+// 以及代理返回过的播放列表中引用的主机都会在 ttl 内被自动允许
+type hostAllowlist struct {
+	patterns []string
+	// subscriptions 可信的订阅主机，其中的站点接口会加入白名单
+	subscriptions []string
+	ttl           time.Duration
+
+	mu       sync.Mutex
+	dynamic  map[string]time.Time
+	siteAPIs map[string]time.Time
+}
+
+func newHostAllowlist(enabled bool, patterns, subscriptions string, ttl time.Duration) *hostAllowlist {
+	if !enabled {
+		return nil
+	}
+	a := &hostAllowlist{
+		ttl:      ttl,
+		dynamic:  make(map[string]time.Time),
+		siteAPIs: make(map[string]time.Time),
+	}
+	for _, p := range utils.SplitList(patterns) {
+		a.patterns = append(a.patterns, strings.ToLower(p))
+	}
+	for _, p := range utils.SplitList(subscriptions) {
+		a.subscriptions = append(a.subscriptions, strings.ToLower(p))
+	}
+	return a
+}
+
+// trustsSubscription 判断订阅中的站点接口能否加入白名单：
+// 订阅主机由运维配置，或请求携带了访问密码
+func (a *hostAllowlist) trustsSubscription(r *http.Request, subURL *url.URL) bool {
+	if a == nil {
+		return false
+	}
+	if hasAccessPassword(r) {
+		return true
+	}
+	host := strings.ToLower(subURL.Hostname())
+	for _, pattern := range a.subscriptions {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed 判断目标主机是否允许访问
+func (a *hostAllowlist) allowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range a.patterns {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if expires, ok := a.siteAPIs[host]; ok && now.Before(expires) {
+		return true
+	}
+	expires, ok := a.dynamic[host]
+	return ok && now.Before(expires)
+}
+
+// allowURLs 允许地址中的主机，用于播放列表与站点接口 JSON 中引用的地址
+func (a *hostAllowlist) allowURLs(rawURLs []string) {
+	if a == nil || len(rawURLs) == 0 {
+		return
+	}
+	expires := time.Now().Add(a.ttl)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, raw := range rawURLs {
+		u, err := url.Parse(raw)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		a.dynamic[strings.ToLower(u.Hostname())] = expires
+	}
+	a.evictLocked(a.dynamic)
+}
+
+// addSiteAPIs 记录订阅转换得到的站点接口地址
+func (a *hostAllowlist) addSiteAPIs(apiURLs []string) {
+	if a == nil {
+		return
+	}
+	expires := time.Now().Add(a.ttl)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, raw := range apiURLs {
+		u, err := url.Parse(strings.TrimSpace(raw))
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		a.siteAPIs[strings.ToLower(u.Hostname())] = expires
+	}
+	a.evictLocked(a.siteAPIs)
+}
+
+// isSiteAPI 判断主机是否为订阅中的站点接口
+func (a *hostAllowlist) isSiteAPI(host string) bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	expires, ok := a.siteAPIs[strings.ToLower(host)]
+	return ok && time.Now().Before(expires)
+}
+
+// evictLocked 超出上限时先清理过期主机，仍超出则淘汰最早过期的主机
+func (a *hostAllowlist) evictLocked(hosts map[string]time.Time) {
+	if len(hosts) <= maxDynamicHosts {
+		return
+	}
+	now := time.Now()
+	for host, expires := range hosts {
+		if now.After(expires) {
+			delete(hosts, host)
+		}
+	}
+	for len(hosts) > maxDynamicHosts {
+		var oldest string
+		var oldestExpires time.Time
+		for host, expires := range hosts {
+			if oldest == "" || expires.Before(oldestExpires) {
+				oldest, oldestExpires = host, expires
+			}
+		}
+		delete(hosts, oldest)
+	}
+}
+
+// jsonURLPattern 匹配 JSON 中的 http(s) 地址，兼容 "\/" 转义的斜杠
+// 不跨越 "#" 与 "$"，以便拆开 "第1集$地址#第2集$地址" 形式的播放列表
+var jsonURLPattern = regexp.MustCompile(`https?:(?:\\/|/){2}(?:\\/|[^"\s<>#$\\])+`)
+
+// urlCollector 在转发站点接口响应的同时收集其中引用的媒体地址
+type urlCollector struct {
+	buf bytes.Buffer
+}
+
+func (c *urlCollector) Write(p []byte) (int, error) {
+	if room := maxSiteAPIScan - c.buf.Len(); room > 0 {
+		c.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+// urls 返回收集到的播放列表与媒体分片地址，站点接口 JSON 中的其他地址 (图片、网页等) 不会加入白名单
+func (c *urlCollector) urls() []string {
+	matches := jsonURLPattern.FindAll(c.buf.Bytes(), -1)
+	urls := make([]string, 0, len(matches))
+	for _, m := range matches {
+		raw := strings.ReplaceAll(string(m), `\/`, "/")
+		u, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		ext := strings.ToLower(path.Ext(u.Path))
+		if ext == ".m3u8" || segmentExtensions[ext] {
+			urls = append(urls, raw)
+		}
+	}
+	return urls
+}
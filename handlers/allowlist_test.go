@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zjyl1994/donggua-proxy/config"
+)
+
+func TestTrustsSubscription(t *testing.T) {
+	a := newHostAllowlist(true, "", "*.sub.example", time.Hour)
+	saved := config.AccessPassword
+	defer func() { config.AccessPassword = saved }()
+
+	tests := []struct {
+		name     string
+		password string
+		auth     string
+		sub      string
+		want     bool
+	}{
+		{name: "configured host", sub: "https://cfg.sub.example/moon.json", want: true},
+		{name: "unknown host", sub: "https://attacker.example/moon.json"},
+		{name: "password", password: "pw", auth: "Bearer pw", sub: "https://attacker.example/moon.json", want: true},
+		{name: "wrong password", password: "pw", auth: "Bearer nope", sub: "https://attacker.example/moon.json"},
+		{name: "no password configured", auth: "Bearer ", sub: "https://attacker.example/moon.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.AccessPassword = tt.password
+			r := httptest.NewRequest("GET", "/sub/moon2donggua", nil)
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			sub, _ := url.Parse(tt.sub)
+			if got := a.trustsSubscription(r, sub); got != tt.want {
+				t.Fatalf("trustsSubscription() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	var disabled *hostAllowlist
+	if disabled.trustsSubscription(httptest.NewRequest("GET", "/", nil), &url.URL{Host: "cfg.sub.example"}) {
+		t.Fatal("a disabled allowlist should not trust subscriptions")
+	}
+}
+
+func TestURLCollector(t *testing.T) {
+	body := `{"list":[{"vod_pic":"https:\/\/img.example\/a.jpg","vod_play_url":"第1集$https:\/\/v1.example\/a\/index.m3u8#第2集$https://v2.example/b.mp4?t=1",` +
+		`"vod_content":"see https://evil.example/ and http://evil.example/x.php","vod_play_from":"https://cdn.example/seg.TS"}]}`
+	var c urlCollector
+	c.Write([]byte(body))
+	want := []string{"https://v1.example/a/index.m3u8", "https://v2.example/b.mp4?t=1", "https://cdn.example/seg.TS"}
+	if got := c.urls(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("urls() = %q, want %q", got, want)
+	}
+}
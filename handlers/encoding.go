@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/zjyl1994/donggua-proxy/config"
+)
+
+// minCompressSize 已知长度小于该值的响应不压缩
+const minCompressSize = 1024
+
+// unsupportedEncodingError 上游使用了无法解压的 Content-Encoding
+type unsupportedEncodingError struct {
+	encoding string
+}
+
+func (e *unsupportedEncodingError) Error() string {
+	return fmt.Sprintf("unsupported content encoding %q", e.encoding)
+}
+
+// decodeResponseBody 按 Content-Encoding 解压上游响应
+// 响应侧会过滤 Content-Encoding 头，未解压的内容会被当作明文交给播放器或改写器
+// 部分响应 (206) 只包含压缩数据的一段，无法解压，保持原样；
+// 没有响应体的响应 (HEAD、204、304、长度为 0) 只去掉与压缩内容对应的头。
+// 无法解压的编码返回 *unsupportedEncodingError，响应保持原样
+func decodeResponseBody(resp *http.Response) error {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" || resp.StatusCode == http.StatusPartialContent {
+		return nil
+	}
+	if bodyless(resp) {
+		stripEncodingHeaders(resp.Header)
+		return nil
+	}
+
+	var (
+		body io.Reader
+		err  error
+	)
+	switch encoding {
+	case "gzip", "x-gzip":
+		body, err = gzip.NewReader(resp.Body)
+	case "deflate":
+		body, err = newDeflateReader(resp.Body)
+	case "br":
+		body = brotli.NewReader(resp.Body)
+	default:
+		return &unsupportedEncodingError{encoding: encoding}
+	}
+	if err != nil {
+		return fmt.Errorf("decode %s body: %w", encoding, err)
+	}
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, resp.Body}
+	stripEncodingHeaders(resp.Header)
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// bodyless 判断响应是否没有响应体
+func bodyless(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return true
+	}
+	return resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified || resp.ContentLength == 0
+}
+
+// stripEncodingHeaders 去掉只对压缩后的内容有效的头
+func stripEncodingHeaders(h http.Header) {
+	for _, name := range []string{"Content-Encoding", "Content-Length", "Content-Range", "Accept-Ranges"} {
+		h.Del(name)
+	}
+}
+
+// newDeflateReader 兼容 zlib 包装与裸 deflate 两种常见实现
+func newDeflateReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	// zlib 头：CMF 低 4 位为 8，且 (CMF<<8 | FLG) 是 31 的倍数
+	if head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// negotiateEncoding 按客户端 Accept-Encoding 选择压缩方式，优先 br
+func negotiateEncoding(acceptEncoding string) string {
+	q := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				weight = f
+			}
+		}
+		q[name] = weight
+	}
+	for _, enc := range []string{"br", "gzip"} {
+		weight, ok := q[enc]
+		if !ok {
+			weight, ok = q["*"]
+		}
+		if ok && weight > 0 {
+			return enc
+		}
+	}
+	return ""
+}
+
+// compressWriter 压缩写入客户端的响应体
+type compressWriter struct {
+	io.Writer
+	closer io.Closer
+}
+
+// Close 写出压缩流的剩余数据，未压缩时为空操作
+func (c *compressWriter) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
+
+// newCompressWriter 在开启 COMPRESS_RESPONSES 且客户端支持时压缩响应
+// 必须在 WriteHeader 之前调用，写完后调用 Close
+func newCompressWriter(w http.ResponseWriter, r *http.Request) *compressWriter {
+	if !config.CompressResponses {
+		return &compressWriter{Writer: w}
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	if r.Method == http.MethodHead || w.Header().Get("Content-Encoding") != "" {
+		return &compressWriter{Writer: w}
+	}
+	if n, err := strconv.Atoi(w.Header().Get("Content-Length")); err == nil && n < minCompressSize {
+		return &compressWriter{Writer: w}
+	}
+
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	var enc io.WriteCloser
+	switch encoding {
+	case "br":
+		enc = brotli.NewWriterLevel(w, 4)
+	case "gzip":
+		enc, _ = gzip.NewWriterLevel(w, 5)
+	default:
+		return &compressWriter{Writer: w}
+	}
+
+	h := w.Header()
+	h.Set("Content-Encoding", encoding)
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	weakenETag(h)
+	return &compressWriter{Writer: enc, closer: enc}
+}
+
+// weakenETag 内容与上游字节不同时，将强校验 ETag 降级为弱校验
+func weakenETag(h http.Header) {
+	if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		h.Set("ETag", "W/"+etag)
+	}
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	}
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDecodeResponseBody(t *testing.T) {
+	plain := []byte("#EXTM3U\n#EXTINF:4,\nseg0.ts\n")
+	tests := []struct {
+		name     string
+		method   string
+		status   int
+		encoding string
+		body     []byte
+		// length 为 -2 时使用 body 的长度
+		length   int64
+		want     []byte
+		wantErr  bool
+		stripped bool
+	}{
+		{name: "gzip", status: 200, encoding: "gzip", body: compress(t, "gzip", plain), length: -2, want: plain, stripped: true},
+		{name: "deflate zlib", status: 200, encoding: "deflate", body: compress(t, "zlib", plain), length: -2, want: plain, stripped: true},
+		{name: "deflate raw", status: 200, encoding: "deflate", body: compress(t, "raw-deflate", plain), length: -1, want: plain, stripped: true},
+		{name: "brotli", status: 200, encoding: "br", body: compress(t, "br", plain), length: -1, want: plain, stripped: true},
+		{name: "identity", status: 200, encoding: "identity", body: plain, length: -2, want: plain},
+		{name: "head", method: http.MethodHead, status: 200, encoding: "gzip", length: 120, want: []byte{}, stripped: true},
+		{name: "not modified", status: 304, encoding: "gzip", length: -1, want: []byte{}, stripped: true},
+		{name: "no content", status: 204, encoding: "gzip", length: -1, want: []byte{}, stripped: true},
+		{name: "empty body", status: 200, encoding: "gzip", length: 0, want: []byte{}, stripped: true},
+		{name: "partial content", status: 206, encoding: "gzip", body: []byte("abc"), length: 3, want: []byte("abc")},
+		{name: "unsupported", status: 200, encoding: "zstd", body: []byte("abc"), length: 3, want: []byte("abc"), wantErr: true},
+		{name: "corrupt gzip", status: 200, encoding: "gzip", body: []byte("not gzip"), length: 8, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req, _ := http.NewRequest(method, "https://a/x", nil)
+			length := tt.length
+			if length == -2 {
+				length = int64(len(tt.body))
+			}
+			resp := &http.Response{
+				StatusCode:    tt.status,
+				Header:        http.Header{"Content-Encoding": {tt.encoding}, "Content-Length": {"1"}},
+				Body:          io.NopCloser(bytes.NewReader(tt.body)),
+				ContentLength: length,
+				Request:       req,
+			}
+			err := decodeResponseBody(resp)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeResponseBody() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				var encErr *unsupportedEncodingError
+				if tt.name == "unsupported" && !errors.As(err, &encErr) {
+					t.Fatalf("error = %v, want *unsupportedEncodingError", err)
+				}
+				if tt.want == nil {
+					return
+				}
+			}
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("body = %q, want %q", got, tt.want)
+			}
+			if stripped := resp.Header.Get("Content-Encoding") == ""; stripped != tt.stripped {
+				t.Fatalf("Content-Encoding stripped = %v, want %v", stripped, tt.stripped)
+			}
+		})
+	}
+}
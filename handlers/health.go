@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zjyl1994/donggua-proxy/config"
+	"github.com/zjyl1994/donggua-proxy/utils"
+	"golang.org/x/sync/singleflight"
+)
+
+// draining 进入排空流程后为 true，健康检查返回 503
+var draining atomic.Bool
+
+// StartDraining 标记进程正在排空，之后 /health 与 /readyz 返回 503
+func StartDraining() {
+	draining.Store(true)
+}
+
+// HealthHandler 兼容旧的健康检查，进程存活且未在排空时返回 200
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Draining"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// LivenessHandler 存活检查，只要进程能处理请求就返回 200 (排空期间也是)
+func LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// ReadinessHandler 就绪检查，返回各项检查的状态与耗时，任一项失败或正在排空时返回 503
+// 结果中含上游主机与错误信息，只挂载在管理接口上
+func ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	report, status := readinessStatus()
+	writeReadiness(w, status, report)
+}
+
+// PublicReadinessHandler 公开监听上的就绪检查，只返回状态码与总体状态
+func PublicReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	report, status := readinessStatus()
+	writeReadiness(w, status, struct {
+		Status string `json:"status"`
+	}{report.Status})
+}
+
+// readinessStatus 返回检查结果与对应的状态码
+func readinessStatus() (readinessReport, int) {
+	report := readiness.report()
+	if draining.Load() {
+		report.Status = "draining"
+	}
+	if report.Status != "ok" {
+		return report, http.StatusServiceUnavailable
+	}
+	return report, http.StatusOK
+}
+
+func writeReadiness(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+var readiness = newReadinessChecker(config.ReadyCheckCacheTTL, config.ReadyCheckTimeout, readinessChecks())
+
+// readinessChecks 按配置生成就绪检查项
+func readinessChecks() []healthCheck {
+	var checks []healthCheck
+	if host := config.ReadyCheckDNSHost; host != "" {
+		checks = append(checks, healthCheck{"dns", func(ctx context.Context) error {
+			_, err := utils.Resolver.LookupIP(ctx, host)
+			return err
+		}})
+	}
+	if config.ReadyCheckTMDB {
+		checks = append(checks, healthCheck{"tmdb", func(ctx context.Context) error {
+			return probeURL(ctx, "https://api.themoviedb.org/3/", false)
+		}})
+	}
+	// 订阅地址可能带有令牌，检查名与错误信息中只出现主机名
+	for i, source := range utils.SplitList(config.ReadyCheckSubscriptions) {
+		name := fmt.Sprintf("subscription %d", i+1)
+		if u, err := url.Parse(source); err == nil {
+			name += " (" + u.Hostname() + ")"
+		}
+		checks = append(checks, healthCheck{name, func(ctx context.Context) error {
+			return probeURL(ctx, source, true)
+		}})
+	}
+	return checks
+}
+
+// probeURL 请求地址，requireOK 为 false 时任何 HTTP 响应都视为可达 (如未带 api_key 的 TMDB 返回 401)
+func probeURL(ctx context.Context, target string, requireOK bool) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
+	resp, err := utils.DefaultClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if requireOK && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// healthCheck 一项就绪检查
+type healthCheck struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+type checkResult struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type readinessReport struct {
+	Status    string        `json:"status"`
+	Checks    []checkResult `json:"checks"`
+	CheckedAt time.Time     `json:"checked_at"`
+}
+
+// readinessChecker 并发执行全部检查并缓存结果 ttl，
+// 同一时间的多个探测请求共享一次检查，避免探测被放大到上游
+type readinessChecker struct {
+	ttl     time.Duration
+	timeout time.Duration
+	checks  []healthCheck
+
+	group singleflight.Group
+	mu    sync.Mutex
+	last  *readinessReport
+}
+
+func newReadinessChecker(ttl, timeout time.Duration, checks []healthCheck) *readinessChecker {
+	return &readinessChecker{ttl: ttl, timeout: timeout, checks: checks}
+}
+
+// report 返回缓存的检查结果，过期时重新检查
+func (c *readinessChecker) report() readinessReport {
+	c.mu.Lock()
+	last := c.last
+	c.mu.Unlock()
+	if last != nil && time.Since(last.CheckedAt) < c.ttl {
+		return *last
+	}
+	v, _, _ := c.group.Do("readiness", func() (interface{}, error) {
+		report := c.run()
+		c.mu.Lock()
+		c.last = report
+		c.mu.Unlock()
+		return report, nil
+	})
+	return *v.(*readinessReport)
+}
+
+func (c *readinessChecker) run() *readinessReport {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	results := make([]checkResult, len(c.checks))
+	var wg sync.WaitGroup
+	for i, check := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := check.run(ctx)
+			results[i] = checkResult{
+				Name:      check.name,
+				Status:    "ok",
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				results[i].Status = "fail"
+				results[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	report := &readinessReport{Status: "ok", Checks: results, CheckedAt: time.Now()}
+	for _, r := range results {
+		if r.Status != "ok" {
+			report.Status = "fail"
+		}
+	}
+	return report
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadinessHandlers(t *testing.T) {
+	saved := readiness
+	defer func() {
+		readiness = saved
+		draining.Store(false)
+	}()
+
+	failing := healthCheck{"subscription 1 (sub.internal.example)", func(context.Context) error {
+		return errors.New("dial tcp 10.0.0.5:443: connection refused")
+	}}
+	passing := healthCheck{"dns", func(context.Context) error { return nil }}
+	tests := []struct {
+		name     string
+		checks   []healthCheck
+		draining bool
+		code     int
+		public   string
+	}{
+		{name: "ok", checks: []healthCheck{passing}, code: http.StatusOK, public: `{"status":"ok"}`},
+		{name: "fail", checks: []healthCheck{passing, failing}, code: http.StatusServiceUnavailable, public: `{"status":"fail"}`},
+		{name: "draining", checks: []healthCheck{passing}, draining: true, code: http.StatusServiceUnavailable, public: `{"status":"draining"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readiness = newReadinessChecker(time.Minute, time.Second, tt.checks)
+			draining.Store(tt.draining)
+
+			rec := httptest.NewRecorder()
+			PublicReadinessHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+			if rec.Code != tt.code || strings.TrimSpace(rec.Body.String()) != tt.public {
+				t.Fatalf("public /readyz = %d %s, want %d %s", rec.Code, rec.Body, tt.code, tt.public)
+			}
+
+			rec = httptest.NewRecorder()
+			ReadinessHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+			if rec.Code != tt.code || !strings.Contains(rec.Body.String(), `"checks":[`) {
+				t.Fatalf("admin /readyz = %d %s", rec.Code, rec.Body)
+			}
+		})
+	}
+
+	// 上游主机与错误信息只出现在管理接口上
+	readiness = newReadinessChecker(time.Minute, time.Second, []healthCheck{failing})
+	rec := httptest.NewRecorder()
+	PublicReadinessHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if body := rec.Body.String(); strings.Contains(body, "sub.internal.example") || strings.Contains(body, "10.0.0.5") {
+		t.Fatalf("public /readyz leaks check details: %s", body)
+	}
+	rec = httptest.NewRecorder()
+	ReadinessHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "connection refused") {
+		t.Fatalf("admin /readyz should include check errors: %s", body)
+	}
+}
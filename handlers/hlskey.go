@@ -0,0 +1,438 @@
+package handlers
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zjyl1994/donggua-proxy/config"
+	"github.com/zjyl1994/donggua-proxy/hls"
+	"github.com/zjyl1994/donggua-proxy/utils"
+	"golang.org/x/sync/singleflight"
+)
+
+// HLS 密钥处理模式
+const (
+	// keyModeProxy 密钥地址与其他地址一样经由通用代理访问
+	keyModeProxy = "proxy"
+	// keyModeCache 改写播放列表时预先拉取密钥并缓存，播放器请求密钥时直接返回
+	keyModeCache = "cache"
+	// keyModeDecrypt 由代理解密 AES-128 分片，播放列表中去掉 EXT-X-KEY
+	keyModeDecrypt = "decrypt"
+)
+
+var hlsKeys = newKeyStore(strings.ToLower(config.HLSKeyMode), config.HLSKeyTTL)
+
+type keyEntry struct {
+	key     []byte
+	expires time.Time
+}
+
+// keyStore 缓存播放列表引用的 AES-128 密钥
+type keyStore struct {
+	mode string
+	ttl  time.Duration
+
+	group singleflight.Group
+
+	mu    sync.Mutex
+	keys  map[string]keyEntry
+	known map[string]time.Time
+}
+
+func newKeyStore(mode string, ttl time.Duration) *keyStore {
+	switch mode {
+	case keyModeCache, keyModeDecrypt:
+	default:
+		mode = keyModeProxy
+	}
+	k := &keyStore{
+		mode:  mode,
+		ttl:   ttl,
+		keys:  make(map[string]keyEntry),
+		known: make(map[string]time.Time),
+	}
+	if mode != keyModeProxy {
+		go k.cleanupLoop()
+	}
+	return k
+}
+
+// register 记录播放列表引用的密钥并在后台预先拉取
+func (k *keyStore) register(keyURLs []string, profile *headerProfile) {
+	if k.mode != keyModeCache {
+		return
+	}
+	for _, keyURL := range keyURLs {
+		k.mu.Lock()
+		k.known[keyURL] = time.Now()
+		_, cached := k.keys[keyURL]
+		k.mu.Unlock()
+		if !cached {
+			go func() {
+				if _, err := k.get(context.Background(), keyURL, profile); err != nil {
+					log.Printf("[WARN] prefetch key %s: %v", keyURL, err)
+				}
+			}()
+		}
+	}
+}
+
+// isKnown 判断地址是否为已登记的密钥
+func (k *keyStore) isKnown(keyURL string) bool {
+	if k.mode != keyModeCache {
+		return false
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	_, ok := k.known[keyURL]
+	return ok
+}
+
+// get 返回缓存的密钥，未缓存时合并并发请求向上游拉取
+func (k *keyStore) get(ctx context.Context, keyURL string, profile *headerProfile) ([]byte, error) {
+	k.mu.Lock()
+	entry, ok := k.keys[keyURL]
+	k.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.key, nil
+	}
+
+	fetchCtx := context.WithoutCancel(ctx)
+	ch := k.group.DoChan(keyURL, func() (interface{}, error) {
+		key, err := fetchKey(fetchCtx, keyURL, profile)
+		if err != nil {
+			return nil, err
+		}
+		k.mu.Lock()
+		k.keys[keyURL] = keyEntry{key: key, expires: time.Now().Add(k.ttl)}
+		k.mu.Unlock()
+		return key, nil
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]byte), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// serve 使用缓存的密钥响应请求
+func (k *keyStore) serve(w http.ResponseWriter, r *http.Request, keyURL string, profile *headerProfile) {
+	key, err := k.get(r.Context(), keyURL, profile)
+	if err != nil {
+		utils.LogError(r, fmt.Errorf("fetch key failed: %w", err))
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(key)
+	}
+}
+
+// cleanupLoop 清理过期密钥与长时间未被播放列表引用的记录
+func (k *keyStore) cleanupLoop() {
+	for {
+		time.Sleep(1 * time.Minute)
+		now := time.Now()
+		k.mu.Lock()
+		for keyURL, entry := range k.keys {
+			if now.After(entry.expires) {
+				delete(k.keys, keyURL)
+			}
+		}
+		for keyURL, seen := range k.known {
+			if now.Sub(seen) > time.Hour {
+				delete(k.known, keyURL)
+			}
+		}
+		k.mu.Unlock()
+	}
+}
+
+func fetchKey(ctx context.Context, keyURL string, profile *headerProfile) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	target, err := url.Parse(keyURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.ValidateTargetURL(target); err != nil {
+		return nil, err
+	}
+	req, err := newUpstreamRequest(ctx, http.MethodGet, target, nil, profile)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := utils.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned %d", resp.StatusCode)
+	}
+	key, err := io.ReadAll(io.LimitReader(resp.Body, aes.BlockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid AES-128 key length %d", len(key))
+	}
+	return key, nil
+}
+
+// encryptedItem 播放列表中需要由代理解密的分片或初始化段
+type encryptedItem struct {
+	uriLine  *hls.Line
+	mapLine  *hls.Line
+	absolute string
+	keyURL   string
+	iv       []byte
+}
+
+// planDecryption 找出可以由代理解密的分片
+// 只要存在无法处理的加密方式 (如 SAMPLE-AES) 就返回 false，整个列表保持原样
+func planDecryption(media *hls.Media, baseURL *url.URL) ([]encryptedItem, bool) {
+	var items []encryptedItem
+	seenMaps := make(map[*hls.Line]bool)
+	for _, seg := range media.Segments {
+		if seg.Key == nil {
+			continue
+		}
+		method, _ := seg.Key.Attrs.Get("METHOD")
+		if !strings.EqualFold(method, "AES-128") {
+			return nil, false
+		}
+		if format, ok := seg.Key.Attrs.Get("KEYFORMAT"); ok && format != "identity" {
+			return nil, false
+		}
+		keyURI, _ := seg.Key.Attrs.Get("URI")
+		keyURL, ok := resolvePlaylistURI(keyURI, baseURL)
+		if !ok {
+			return nil, false
+		}
+
+		explicitIV, hasIV, err := parseIV(seg.Key)
+		if err != nil {
+			return nil, false
+		}
+
+		// 初始化段必须使用 EXT-X-KEY 中显式声明的 IV
+		if seg.Map != nil && !seenMaps[seg.Map] {
+			if !hasIV {
+				return nil, false
+			}
+			mapURI, _ := seg.Map.Attrs.Get("URI")
+			absolute, ok := resolvePlaylistURI(mapURI, baseURL)
+			if !ok {
+				return nil, false
+			}
+			if _, ranged := seg.Map.Attrs.Get("BYTERANGE"); ranged {
+				return nil, false
+			}
+			seenMaps[seg.Map] = true
+			items = append(items, encryptedItem{mapLine: seg.Map, absolute: absolute, keyURL: keyURL, iv: explicitIV})
+		}
+
+		for _, l := range seg.Lines {
+			// 带 BYTERANGE 的分片无法单独解密
+			if l.Type == hls.LineTag && (l.Tag == "EXT-X-BYTERANGE" || l.Tag == "EXT-X-PART") {
+				return nil, false
+			}
+		}
+		absolute, ok := resolvePlaylistURI(seg.URI(), baseURL)
+		if !ok {
+			return nil, false
+		}
+		iv := explicitIV
+		if !hasIV {
+			iv = sequenceIV(seg.Seq)
+		}
+		uriLine := seg.Lines[len(seg.Lines)-1]
+		items = append(items, encryptedItem{uriLine: uriLine, absolute: absolute, keyURL: keyURL, iv: iv})
+	}
+	return items, true
+}
+
+// applyDecryption 将加密分片改写为代理解密地址，并去掉播放列表中的 EXT-X-KEY
+func applyDecryption(playlist *hls.Playlist, items []encryptedItem, proxyOrigin string, profile *headerProfile) {
+	for _, item := range items {
+		params := profile.params(item.absolute, item.keyURL)
+		if params == nil {
+			params = url.Values{}
+		}
+		iv := hex.EncodeToString(item.iv)
+		params.Set("key", item.keyURL)
+		params.Set("iv", iv)
+		params.Set(keySigParam, signDecryption(item.absolute, item.keyURL, iv))
+		decryptURL := proxyURL(proxyOrigin, item.absolute, params)
+		if item.mapLine != nil {
+			item.mapLine.Attrs.Set("URI", decryptURL)
+		} else {
+			item.uriLine.URI = decryptURL
+		}
+	}
+	lines := playlist.Lines[:0]
+	for _, l := range playlist.Lines {
+		if l.Type == hls.LineTag && l.Tag == "EXT-X-KEY" {
+			continue
+		}
+		lines = append(lines, l)
+	}
+	playlist.Lines = lines
+}
+
+// parseIV 解析 EXT-X-KEY 的 IV 属性
+func parseIV(key *hls.Line) ([]byte, bool, error) {
+	ivStr, ok := key.Attrs.Get("IV")
+	if !ok {
+		return nil, false, nil
+	}
+	ivStr = strings.TrimPrefix(strings.TrimPrefix(ivStr, "0x"), "0X")
+	iv, err := hex.DecodeString(ivStr)
+	if err != nil || len(iv) != aes.BlockSize {
+		return nil, false, fmt.Errorf("invalid IV %q", ivStr)
+	}
+	return iv, true, nil
+}
+
+// sequenceIV 未声明 IV 时使用媒体序号的 128 位大端表示
+func sequenceIV(seq int64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(seq))
+	return iv
+}
+
+// keySigParam 解密地址中 key 与 iv 参数的签名
+const keySigParam = "key_sig"
+
+// errDecryptSignature 解密参数不是由代理改写播放列表时生成的
+var errDecryptSignature = errors.New("invalid decryption signature")
+
+// signDecryption 计算分片地址、密钥地址与 IV 的签名，防止借解密地址让代理请求任意密钥地址
+func signDecryption(target, keyURL, iv string) string {
+	mac := hmac.New(sha256.New, profileKey)
+	for _, part := range []string{"decrypt", target, keyURL, iv} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// parseDecryptParams 解析并校验解密地址中的 key 与 iv 参数
+func parseDecryptParams(query url.Values) (keyURL string, iv []byte, ok bool, err error) {
+	keyURL = query.Get("key")
+	if keyURL == "" {
+		return "", nil, false, nil
+	}
+	ivHex := query.Get("iv")
+	iv, err = hex.DecodeString(ivHex)
+	if err != nil || len(iv) != aes.BlockSize {
+		return "", nil, false, errors.New("invalid iv parameter")
+	}
+	expected := signDecryption(strings.TrimSpace(query.Get("url")), keyURL, ivHex)
+	if !hmac.Equal([]byte(query.Get(keySigParam)), []byte(expected)) {
+		return "", nil, false, errDecryptSignature
+	}
+	return keyURL, iv, true, nil
+}
+
+// cbcDecryptReader 流式解密 AES-128-CBC 数据并去掉 PKCS#7 填充
+type cbcDecryptReader struct {
+	src  io.Reader
+	mode cipher.BlockMode
+	// buf 已读取但未解密的密文；out 已解密但未返回的明文
+	buf []byte
+	out []byte
+	// held 暂存最后一个明文块，直到确认不是结尾
+	held []byte
+	eof  bool
+}
+
+func newCBCDecryptReader(src io.Reader, key, iv []byte) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &cbcDecryptReader{src: src, mode: cipher.NewCBCDecrypter(block, iv)}, nil
+}
+
+func (c *cbcDecryptReader) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if err := c.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+func (c *cbcDecryptReader) fill() error {
+	chunk := make([]byte, 32*1024)
+	n, err := io.ReadAtLeast(c.src, chunk, aes.BlockSize)
+	c.buf = append(c.buf, chunk[:n]...)
+	atEOF := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !atEOF {
+		return err
+	}
+
+	blocks := len(c.buf) / aes.BlockSize * aes.BlockSize
+	if blocks > 0 {
+		plain := make([]byte, blocks)
+		c.mode.CryptBlocks(plain, c.buf[:blocks])
+		c.buf = c.buf[blocks:]
+		// 上一次暂存的块现在可以输出，本次的最后一块继续暂存
+		c.out = append(c.held, plain[:blocks-aes.BlockSize]...)
+		c.held = plain[blocks-aes.BlockSize:]
+	}
+
+	if atEOF {
+		c.eof = true
+		if len(c.buf) != 0 {
+			return errors.New("ciphertext is not a multiple of the block size")
+		}
+		if len(c.held) == 0 {
+			return nil
+		}
+		// 填充的每个字节都必须等于填充长度，只检查最后一个字节会把损坏的数据当作明文输出
+		pad := int(c.held[len(c.held)-1])
+		if pad == 0 || pad > aes.BlockSize {
+			return errors.New("invalid PKCS#7 padding")
+		}
+		for _, b := range c.held[aes.BlockSize-pad:] {
+			if int(b) != pad {
+				return errors.New("invalid PKCS#7 padding")
+			}
+		}
+		c.out = append(c.out, c.held[:aes.BlockSize-pad]...)
+		c.held = nil
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/zjyl1994/donggua-proxy/hls"
+)
+
+func TestPlanDecryption(t *testing.T) {
+	const ivHex = "000102030405060708090a0b0c0d0e0f"
+	tests := []struct {
+		name  string
+		lines []string
+		ok    bool
+		// want 每项为 "分片地址 密钥地址 IV"
+		want []string
+	}{
+		{
+			name:  "unencrypted",
+			lines: []string{"#EXTINF:4,", "a.ts"},
+			ok:    true,
+		},
+		{
+			name:  "sequence iv",
+			lines: []string{"#EXT-X-MEDIA-SEQUENCE:7", `#EXT-X-KEY:METHOD=AES-128,URI="k.bin"`, "#EXTINF:4,", "a.ts", "#EXTINF:4,", "b.ts"},
+			ok:    true,
+			want: []string{
+				"https://cdn.example/v/a.ts https://cdn.example/v/k.bin 00000000000000000000000000000007",
+				"https://cdn.example/v/b.ts https://cdn.example/v/k.bin 00000000000000000000000000000008",
+			},
+		},
+		{
+			name:  "explicit iv and method none",
+			lines: []string{`#EXT-X-KEY:METHOD=AES-128,URI="/k",IV=0x` + ivHex, "#EXTINF:4,", "a.ts", "#EXT-X-KEY:METHOD=NONE", "#EXTINF:4,", "b.ts"},
+			ok:    true,
+			want:  []string{"https://cdn.example/v/a.ts https://cdn.example/k " + ivHex},
+		},
+		{
+			name:  "init segment with iv",
+			lines: []string{`#EXT-X-KEY:METHOD=AES-128,URI="k",IV=0x` + ivHex, `#EXT-X-MAP:URI="init.mp4"`, "#EXTINF:4,", "a.m4s"},
+			ok:    true,
+			want: []string{
+				"https://cdn.example/v/init.mp4 https://cdn.example/v/k " + ivHex,
+				"https://cdn.example/v/a.m4s https://cdn.example/v/k " + ivHex,
+			},
+		},
+		{
+			name:  "init segment without iv",
+			lines: []string{`#EXT-X-KEY:METHOD=AES-128,URI="k"`, `#EXT-X-MAP:URI="init.mp4"`, "#EXTINF:4,", "a.m4s"},
+		},
+		{
+			name:  "sample aes",
+			lines: []string{`#EXT-X-KEY:METHOD=SAMPLE-AES,URI="k"`, "#EXTINF:4,", "a.ts"},
+		},
+		{
+			name:  "key format",
+			lines: []string{`#EXT-X-KEY:METHOD=AES-128,URI="k",KEYFORMAT="com.apple.streamingkeydelivery"`, "#EXTINF:4,", "a.ts"},
+		},
+		{
+			name:  "non-http key",
+			lines: []string{`#EXT-X-KEY:METHOD=AES-128,URI="skd://k"`, "#EXTINF:4,", "a.ts"},
+		},
+		{
+			name:  "invalid iv",
+			lines: []string{`#EXT-X-KEY:METHOD=AES-128,URI="k",IV=0x1234`, "#EXTINF:4,", "a.ts"},
+		},
+		{
+			name:  "byte range",
+			lines: []string{`#EXT-X-KEY:METHOD=AES-128,URI="k"`, "#EXTINF:4,", "#EXT-X-BYTERANGE:1000@0", "a.ts"},
+		},
+	}
+	base, _ := url.Parse("https://cdn.example/v/index.m3u8")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n" + strings.Join(tt.lines, "\n") + "\n"
+			playlist, err := hls.Parse(strings.NewReader(input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			media, err := playlist.Media()
+			if err != nil {
+				t.Fatal(err)
+			}
+			items, ok := planDecryption(media, base)
+			if ok != tt.ok {
+				t.Fatalf("planDecryption() ok = %v, want %v", ok, tt.ok)
+			}
+			var got []string
+			for _, item := range items {
+				got = append(got, item.absolute+" "+item.keyURL+" "+hex.EncodeToString(item.iv))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Fatalf("items =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestParseDecryptParams(t *testing.T) {
+	const (
+		target = "https://cdn.example/a.ts"
+		key    = "https://keys.example/k"
+		iv     = "000102030405060708090a0b0c0d0e0f"
+	)
+	signed := func(target, key, iv string) url.Values {
+		return url.Values{"url": {target}, "key": {key}, "iv": {iv}, keySigParam: {signDecryption(target, key, iv)}}
+	}
+	tests := []struct {
+		name    string
+		query   url.Values
+		ok      bool
+		wantErr string
+	}{
+		{name: "not a decryption url", query: url.Values{"url": {target}}},
+		{name: "signed", query: signed(target, key, iv), ok: true},
+		{name: "short iv", query: signed(target, key, "0001"), wantErr: "invalid iv"},
+		{name: "bad iv", query: signed(target, key, "zz"), wantErr: "invalid iv"},
+		{name: "unsigned", query: url.Values{"url": {target}, "key": {key}, "iv": {iv}}, wantErr: "invalid decryption signature"},
+		{name: "key swapped", query: func() url.Values {
+			q := signed(target, key, iv)
+			q.Set("key", "https://attacker.example/k")
+			return q
+		}(), wantErr: "invalid decryption signature"},
+		{name: "target swapped", query: func() url.Values {
+			q := signed(target, key, iv)
+			q.Set("url", "https://cdn.example/b.ts")
+			return q
+		}(), wantErr: "invalid decryption signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, ok, err := parseDecryptParams(tt.query)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v (err %v)", ok, tt.ok, err)
+			}
+			if (err == nil) != (tt.wantErr == "") || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProxyDecryptKeyAllowlist(t *testing.T) {
+	savedMode, savedAllowlist := hlsKeys.mode, targetAllowlist
+	defer func() { hlsKeys.mode, targetAllowlist = savedMode, savedAllowlist }()
+	hlsKeys.mode = keyModeDecrypt
+	targetAllowlist = newHostAllowlist(true, "cdn.example", "", time.Hour)
+
+	const target = "https://cdn.example/a.ts"
+	const iv = "000102030405060708090a0b0c0d0e0f"
+	for name, key := range map[string]string{
+		"key host not allowed": "https://attacker.example/k",
+		"private key host":     "http://127.0.0.1/k",
+	} {
+		t.Run(name, func(t *testing.T) {
+			q := url.Values{"url": {target}, "key": {key}, "iv": {iv}, keySigParam: {signDecryption(target, key, iv)}}
+			rec := httptest.NewRecorder()
+			ProxyHandler(rec, httptest.NewRequest(http.MethodGet, "/?"+q.Encode(), nil))
+			if rec.Code != http.StatusForbidden {
+				t.Fatalf("status = %d, want 403", rec.Code)
+			}
+		})
+	}
+
+	// 未签名的解密参数同样拒绝，即使密钥主机在白名单中
+	q := url.Values{"url": {target}, "key": {"https://cdn.example/k"}, "iv": {iv}}
+	rec := httptest.NewRecorder()
+	ProxyHandler(rec, httptest.NewRequest(http.MethodGet, "/?"+q.Encode(), nil))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("unsigned: status = %d, want 403", rec.Code)
+	}
+}
+
+// encryptCBC 使用 PKCS#7 填充加密，供解密测试使用
+func encryptCBC(plain, key, iv []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	pad := aes.BlockSize - len(plain)%aes.BlockSize
+	data := append(append([]byte(nil), plain...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	return data
+}
+
+func TestCBCDecryptReader(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := sequenceIV(42)
+	for _, size := range []int{0, 1, 15, 16, 17, 32*1024 - 1, 32 * 1024, 100000} {
+		plain := make([]byte, size)
+		for i := range plain {
+			plain[i] = byte(i * 7)
+		}
+		ciphertext := encryptCBC(plain, key, iv)
+		// 逐字节读取上游，覆盖块边界跨越多次读取的情况
+		r, err := newCBCDecryptReader(iotest.OneByteReader(bytes.NewReader(ciphertext)), key, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("size %d: decrypted data differs", size)
+		}
+	}
+
+	// 截断的密文与错误的填充
+	// 只取第一个密文块，即得到未经 encryptCBC 填充、以指定字节结尾的明文块
+	ciphertext := encryptCBC([]byte("hello"), key, iv)
+	corrupted := append(bytes.Repeat([]byte{'a'}, 13), 1, 3, 3)
+	for name, data := range map[string][]byte{
+		"truncated":         ciphertext[:len(ciphertext)-1],
+		"bad padding":       encryptCBC(bytes.Repeat([]byte{0}, 16), key, iv)[:16],
+		"oversized padding": encryptCBC(bytes.Repeat([]byte{17}, 16), key, iv)[:16],
+		"corrupted padding": encryptCBC(corrupted, key, iv)[:16],
+	} {
+		r, _ := newCBCDecryptReader(bytes.NewReader(data), key, iv)
+		if _, err := io.ReadAll(r); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
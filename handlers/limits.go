@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/zjyl1994/donggua-proxy/config"
+)
+
+// contentClass 按内容类型区分的传输限制类别
+type contentClass string
+
+const (
+	classPlaylist contentClass = "playlist"
+	classSegment  contentClass = "segment"
+	classTMDBJSON contentClass = "tmdb-json"
+	classImage    contentClass = "image"
+	classGeneric  contentClass = "generic"
+)
+
+// transferLimit 单次上游响应的最大大小与最长传输时间，0 表示不限制
+type transferLimit struct {
+	maxBytes    int64
+	maxDuration time.Duration
+}
+
+var transferLimits = map[contentClass]transferLimit{
+	classPlaylist: {int64(config.LimitPlaylistMB) << 20, config.LimitPlaylistDuration},
+	classSegment:  {int64(config.LimitSegmentMB) << 20, config.LimitSegmentDuration},
+	classTMDBJSON: {int64(config.LimitTMDBJSONMB) << 20, config.LimitTMDBJSONDuration},
+	classImage:    {int64(config.LimitImageMB) << 20, config.LimitImageDuration},
+	classGeneric:  {int64(config.LimitGenericMB) << 20, config.LimitGenericDuration},
+}
+
+// 超出限制的原因，用于日志区分
+const (
+	limitReasonDeclaredSize = "declared-size"
+	limitReasonSize         = "size"
+	limitReasonDuration     = "duration"
+)
+
+// transferLimitError 上游响应超出所属类别的限制
+type transferLimitError struct {
+	class  contentClass
+	reason string
+	limit  transferLimit
+	read   int64
+}
+
+func (e *transferLimitError) Error() string {
+	switch e.reason {
+	case limitReasonDeclaredSize:
+		return fmt.Sprintf("transfer limit exceeded (%s, %s): Content-Length %d > %d bytes", e.class, e.reason, e.read, e.limit.maxBytes)
+	case limitReasonSize:
+		return fmt.Sprintf("transfer limit exceeded (%s, %s): body larger than %d bytes", e.class, e.reason, e.limit.maxBytes)
+	default:
+		return fmt.Sprintf("transfer limit exceeded (%s, %s): not finished within %s, %d bytes read", e.class, e.reason, e.limit.maxDuration, e.read)
+	}
+}
+
+// segmentExtensions 按扩展名识别的媒体分片与音视频文件
+var segmentExtensions = map[string]bool{
+	".ts": true, ".m4s": true, ".mp4": true, ".m4v": true, ".m4a": true, ".aac": true,
+	".mp3": true, ".fmp4": true, ".cmfv": true, ".cmfa": true, ".mkv": true, ".flv": true, ".webm": true,
+}
+
+// classifyProxyResponse 判断通用代理响应的限制类别
+func classifyProxyResponse(target *url.URL, contentType string, isM3u8 bool) contentClass {
+	switch {
+	case isM3u8:
+		return classPlaylist
+	case strings.HasPrefix(contentType, "video/"), strings.HasPrefix(contentType, "audio/"),
+		segmentExtensions[strings.ToLower(path.Ext(target.Path))]:
+		return classSegment
+	case strings.HasPrefix(contentType, "image/"):
+		return classImage
+	}
+	return classGeneric
+}
+
+// limitResponse 按类别限制响应体
+// 上游声明的 Content-Length 已超出限制或已超时的直接返回错误；
+// 否则替换 resp.Body，读取超出大小或 start 起超过最长时间时返回 *transferLimitError。
+// cancel 用于超时时中止上游请求，需与请求的 Context 对应
+func limitResponse(resp *http.Response, class contentClass, start time.Time, cancel context.CancelFunc) error {
+	limit := transferLimits[class]
+	if limit.maxBytes > 0 && resp.ContentLength > limit.maxBytes {
+		return &transferLimitError{class: class, reason: limitReasonDeclaredSize, limit: limit, read: resp.ContentLength}
+	}
+	if limit.maxBytes <= 0 && limit.maxDuration <= 0 {
+		return nil
+	}
+	body := &limitedBody{ReadCloser: resp.Body, class: class, limit: limit}
+	if limit.maxDuration > 0 {
+		remaining := limit.maxDuration - time.Since(start)
+		if remaining <= 0 {
+			return &transferLimitError{class: class, reason: limitReasonDuration, limit: limit}
+		}
+		body.timer = time.AfterFunc(remaining, func() {
+			body.timedOut.Store(true)
+			cancel()
+		})
+	}
+	resp.Body = body
+	return nil
+}
+
+// abortOnTransferLimit 响应头已发出后超出限制时中断连接，
+// 使客户端能察觉响应不完整，而不是当作正常结束
+func abortOnTransferLimit(err error) {
+	var limitErr *transferLimitError
+	if errors.As(err, &limitErr) {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// limitedBody 统计已读字节数，超出限制时返回 *transferLimitError
+type limitedBody struct {
+	io.ReadCloser
+	class    contentClass
+	limit    transferLimit
+	read     int64
+	timer    *time.Timer
+	timedOut atomic.Bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.limit.maxBytes > 0 && b.read >= b.limit.maxBytes {
+		// 多读一个字节判断是否正好读完
+		p = p[:min(len(p), 1)]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.limit.maxBytes > 0 && b.read > b.limit.maxBytes {
+		excess := int(b.read - b.limit.maxBytes)
+		b.read = b.limit.maxBytes
+		return n - excess, &transferLimitError{class: b.class, reason: limitReasonSize, limit: b.limit, read: b.read}
+	}
+	if err != nil && err != io.EOF && b.timedOut.Load() {
+		return n, &transferLimitError{class: b.class, reason: limitReasonDuration, limit: b.limit, read: b.read}
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestLimitedBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		maxBytes int64
+		oneByte  bool
+		// wantRead 出错前交给调用方的字节数
+		wantRead   int
+		wantReason string
+	}{
+		{name: "unlimited", size: 100, wantRead: 100},
+		{name: "below limit", size: 99, maxBytes: 100, wantRead: 99},
+		{name: "exactly at limit", size: 100, maxBytes: 100, wantRead: 100},
+		{name: "exactly at limit byte by byte", size: 100, maxBytes: 100, oneByte: true, wantRead: 100},
+		{name: "one byte over", size: 101, maxBytes: 100, wantRead: 100, wantReason: limitReasonSize},
+		{name: "far over", size: 100000, maxBytes: 100, wantRead: 100, wantReason: limitReasonSize},
+		{name: "over byte by byte", size: 150, maxBytes: 100, oneByte: true, wantRead: 100, wantReason: limitReasonSize},
+		{name: "empty", size: 0, maxBytes: 100, wantRead: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r io.Reader = bytes.NewReader(make([]byte, tt.size))
+			if tt.oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			body := &limitedBody{ReadCloser: io.NopCloser(r), class: classSegment, limit: transferLimit{maxBytes: tt.maxBytes}}
+			n, err := io.Copy(io.Discard, body)
+			if int(n) != tt.wantRead {
+				t.Fatalf("read %d bytes, want %d", n, tt.wantRead)
+			}
+			var limitErr *transferLimitError
+			switch {
+			case tt.wantReason == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantReason != "" && !errors.As(err, &limitErr):
+				t.Fatalf("error = %v, want *transferLimitError", err)
+			case tt.wantReason != "" && (limitErr.reason != tt.wantReason || limitErr.read != tt.maxBytes):
+				t.Fatalf("error = %+v, want reason %s after %d bytes", limitErr, tt.wantReason, tt.maxBytes)
+			}
+		})
+	}
+}
+
+func TestLimitResponse(t *testing.T) {
+	saved := transferLimits[classImage]
+	defer func() { transferLimits[classImage] = saved }()
+
+	t.Run("declared size", func(t *testing.T) {
+		transferLimits[classImage] = transferLimit{maxBytes: 10}
+		resp := &http.Response{Body: io.NopCloser(strings.NewReader("")), ContentLength: 11}
+		err := limitResponse(resp, classImage, time.Now(), func() {})
+		var limitErr *transferLimitError
+		if !errors.As(err, &limitErr) || limitErr.reason != limitReasonDeclaredSize {
+			t.Fatalf("limitResponse() = %v, want a declared-size error", err)
+		}
+	})
+
+	t.Run("already expired", func(t *testing.T) {
+		transferLimits[classImage] = transferLimit{maxDuration: time.Second}
+		resp := &http.Response{Body: io.NopCloser(strings.NewReader("")), ContentLength: -1}
+		err := limitResponse(resp, classImage, time.Now().Add(-2*time.Second), func() {})
+		var limitErr *transferLimitError
+		if !errors.As(err, &limitErr) || limitErr.reason != limitReasonDuration {
+			t.Fatalf("limitResponse() = %v, want a duration error", err)
+		}
+	})
+
+	t.Run("duration", func(t *testing.T) {
+		transferLimits[classImage] = transferLimit{maxDuration: 20 * time.Millisecond}
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		// 模拟上游请求被取消后读取出错
+		context.AfterFunc(ctx, func() { pw.CloseWithError(context.Canceled) })
+		resp := &http.Response{Body: pr, ContentLength: -1}
+		if err := limitResponse(resp, classImage, time.Now(), cancel); err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		go pw.Write([]byte("partial"))
+		_, err := io.Copy(io.Discard, resp.Body)
+		var limitErr *transferLimitError
+		if !errors.As(err, &limitErr) || limitErr.reason != limitReasonDuration || limitErr.read != int64(len("partial")) {
+			t.Fatalf("read error = %v, want a duration error after 7 bytes", err)
+		}
+	})
+
+	t.Run("unlimited class", func(t *testing.T) {
+		transferLimits[classImage] = transferLimit{}
+		body := io.NopCloser(strings.NewReader("x"))
+		resp := &http.Response{Body: body, ContentLength: 1}
+		if err := limitResponse(resp, classImage, time.Now(), func() {}); err != nil || resp.Body != body {
+			t.Fatalf("limitResponse() = %v, body replaced %v", err, resp.Body != body)
+		}
+	})
+}
@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zjyl1994/donggua-proxy/config"
+	"github.com/zjyl1994/donggua-proxy/hls"
+	"golang.org/x/sync/singleflight"
+)
+
+var playlistCache = newPlaylistFetcher(config.PlaylistVODTTL, config.HLSDVRWindow)
+
+// playlistSnapshot 一次上游播放列表请求的完整结果，由多个观众共享
+type playlistSnapshot struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// response 将快照转换为新的 http.Response，供 ProxyHandler 按普通响应处理
+func (s *playlistSnapshot) response() *http.Response {
+	return &http.Response{
+		StatusCode:    s.status,
+		Header:        s.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(s.body)),
+		ContentLength: int64(len(s.body)),
+	}
+}
+
+// playlistFetcher 合并多个观众对同一播放列表的刷新请求，并按直播/点播设置缓存时间
+type playlistFetcher struct {
+	vodTTL    time.Duration
+	dvrWindow time.Duration
+
+	group singleflight.Group
+
+	mu        sync.Mutex
+	snapshots map[string]*playlistSnapshot
+	known     map[string]time.Time
+	windows   map[string]*dvrWindow
+	sequences map[string]*sequenceState
+}
+
+// sequenceState 记录播放列表上次的媒体序号
+// 部分直播源会错误地带上 EXT-X-ENDLIST，序号前进过的列表之后一律按直播处理
+type sequenceState struct {
+	seq     int64
+	live    bool
+	updated time.Time
+}
+
+func newPlaylistFetcher(vodTTL, window time.Duration) *playlistFetcher {
+	f := &playlistFetcher{
+		vodTTL:    vodTTL,
+		dvrWindow: window,
+		snapshots: make(map[string]*playlistSnapshot),
+		known:     make(map[string]time.Time),
+		windows:   make(map[string]*dvrWindow),
+		sequences: make(map[string]*sequenceState),
+	}
+	go f.cleanupLoop()
+	return f
+}
+
+// eligible 判断请求是否可以走共享的播放列表缓存
+// 带 Range 或条件请求头的请求需要上游直接响应
+func (f *playlistFetcher) eligible(r *http.Request, target *url.URL) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	for _, h := range conditionalRequestHeaders {
+		if r.Header.Get(h) != "" {
+			return false
+		}
+	}
+	if strings.HasSuffix(strings.ToLower(target.Path), ".m3u8") {
+		return true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.known[target.String()]
+	return ok
+}
+
+// markKnown 记录返回过播放列表的地址 (扩展名不是 .m3u8 的情况)
+func (f *playlistFetcher) markKnown(target *url.URL) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.known[target.String()] = time.Now()
+}
+
+// get 返回缓存中未过期的播放列表，否则合并并发请求向上游拉取
+// 不同请求头配置拉取到的内容可能不同，分开缓存
+func (f *playlistFetcher) get(ctx context.Context, target *url.URL, profile *headerProfile) (*http.Response, error) {
+	key := target.String() + "\x00" + profile.name()
+
+	f.mu.Lock()
+	snap, ok := f.snapshots[key]
+	f.mu.Unlock()
+	if ok && time.Now().Before(snap.expires) {
+		return snap.response(), nil
+	}
+
+	// 拉取不随单个观众断开而取消
+	fetchCtx := context.WithoutCancel(ctx)
+	ch := f.group.DoChan(key, func() (interface{}, error) {
+		return f.fetch(fetchCtx, key, target, profile)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*playlistSnapshot).response(), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (f *playlistFetcher) fetch(ctx context.Context, key string, target *url.URL, profile *headerProfile) (*playlistSnapshot, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	start := time.Now()
+
+	req, err := newUpstreamRequest(ctx, http.MethodGet, target, nil, profile)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := upstreamRetry.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := decodeResponseBody(resp); err != nil {
+		return nil, err
+	}
+
+	// 播放列表需要整体缓冲，按播放列表类别限制大小与读取时间
+	if err := limitResponse(resp, classPlaylist, start, cancel); err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &playlistSnapshot{
+		status: resp.StatusCode,
+		header: resp.Header.Clone(),
+		body:   body,
+	}
+	snap.header.Del("Content-Length")
+
+	if resp.StatusCode != http.StatusOK {
+		return snap, nil
+	}
+
+	ttl := f.vodTTL
+	if media, ok := parseMedia(body); ok && f.isLive(key, media) {
+		// 直播列表按目标时长的一半缓存，保证观众能及时拿到新分片
+		ttl = time.Duration(media.TargetDuration * float64(time.Second) / 2)
+		ttl = min(max(ttl, time.Second), 10*time.Second)
+		if f.dvrWindow > 0 {
+			var buf bytes.Buffer
+			if err := f.mergeWindow(key, media).Playlist().Encode(&buf); err == nil {
+				snap.body = buf.Bytes()
+			}
+		}
+	}
+	snap.expires = time.Now().Add(ttl)
+	snap.header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(ttl.Seconds())))
+
+	f.mu.Lock()
+	f.snapshots[key] = snap
+	f.known[target.String()] = time.Now()
+	f.mu.Unlock()
+	return snap, nil
+}
+
+// isLive 判断媒体播放列表是否为直播：没有 EXT-X-ENDLIST，或媒体序号比上次拉取时前进
+func (f *playlistFetcher) isLive(key string, media *hls.Media) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	state, ok := f.sequences[key]
+	if !ok {
+		state = &sequenceState{seq: media.MediaSequence}
+		f.sequences[key] = state
+	}
+	if media.MediaSequence > state.seq {
+		state.live = true
+	}
+	state.seq = media.MediaSequence
+	state.updated = time.Now()
+	return !media.EndList || state.live
+}
+
+// mergeWindow 将最新的直播列表并入滚动窗口，延长可回看的时间范围
+func (f *playlistFetcher) mergeWindow(key string, latest *hls.Media) *hls.Media {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	win, ok := f.windows[key]
+	if !ok {
+		win = &dvrWindow{}
+		f.windows[key] = win
+	}
+	win.updated = time.Now()
+	return win.merge(latest, f.dvrWindow)
+}
+
+// cleanupLoop 清理过期的快照与长时间未访问的直播窗口
+func (f *playlistFetcher) cleanupLoop() {
+	for {
+		time.Sleep(1 * time.Minute)
+		now := time.Now()
+		f.mu.Lock()
+		for key, snap := range f.snapshots {
+			if now.After(snap.expires) {
+				delete(f.snapshots, key)
+			}
+		}
+		for key, seen := range f.known {
+			if now.Sub(seen) > time.Hour {
+				delete(f.known, key)
+			}
+		}
+		for key, win := range f.windows {
+			if now.Sub(win.updated) > 10*time.Minute {
+				delete(f.windows, key)
+			}
+		}
+		for key, state := range f.sequences {
+			if now.Sub(state.updated) > 10*time.Minute {
+				delete(f.sequences, key)
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+// dvrWindow 记录直播列表中已经滚出上游窗口的分片
+type dvrWindow struct {
+	segments []*hls.Segment
+	updated  time.Time
+}
+
+func (w *dvrWindow) merge(latest *hls.Media, window time.Duration) *hls.Media {
+	if len(latest.Segments) == 0 {
+		return latest
+	}
+	first := latest.Segments[0].Seq
+
+	// 序号回退或出现断档说明直播重新开始，丢弃旧窗口
+	if n := len(w.segments); n > 0 && (w.segments[0].Seq > first || w.segments[n-1].Seq+1 < first) {
+		w.segments = nil
+	}
+
+	var older []*hls.Segment
+	for _, seg := range w.segments {
+		if seg.Seq < first {
+			older = append(older, seg.WithoutParts())
+		}
+	}
+
+	// 从最旧的分片开始裁剪，直到总时长不超过窗口
+	total := 0.0
+	for _, seg := range latest.Segments {
+		total += seg.Duration
+	}
+	for _, seg := range older {
+		total += seg.Duration
+	}
+	for len(older) > 0 && total > window.Seconds() {
+		total -= older[0].Duration
+		older = older[1:]
+	}
+
+	merged := *latest
+	merged.Segments = append(older, latest.Segments...)
+	for _, seg := range older {
+		if seg.Discontinuity {
+			merged.DiscontinuitySequence--
+		}
+	}
+	merged.DiscontinuitySequence = max(merged.DiscontinuitySequence, 0)
+	merged.MediaSequence = merged.Segments[0].Seq
+
+	w.segments = merged.Segments
+	return &merged
+}
+
+// parseMedia 解析媒体播放列表，主播放列表或格式错误时返回 false
+func parseMedia(body []byte) (*hls.Media, bool) {
+	playlist, err := hls.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, false
+	}
+	media, err := playlist.Media()
+	if err != nil || (media.TargetDuration == 0 && len(media.Segments) == 0) {
+		return nil, false
+	}
+	return media, true
+}
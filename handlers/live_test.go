@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zjyl1994/donggua-proxy/hls"
+)
+
+func TestPlaylistFetcherIsLive(t *testing.T) {
+	type fetch struct {
+		seq     int64
+		endList bool
+		live    bool
+	}
+	tests := []struct {
+		name    string
+		fetches []fetch
+	}{
+		{"vod", []fetch{{0, true, false}, {0, true, false}}},
+		{"no endlist", []fetch{{5, false, true}, {5, false, true}}},
+		{"advancing sequence with endlist", []fetch{{5, true, false}, {6, true, true}, {6, true, true}}},
+		{"sequence going back", []fetch{{9, true, false}, {3, true, false}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &playlistFetcher{sequences: make(map[string]*sequenceState), vodTTL: time.Minute}
+			for i, fe := range tt.fetches {
+				media := &hls.Media{MediaSequence: fe.seq, EndList: fe.endList}
+				if got := f.isLive("key", media); got != fe.live {
+					t.Fatalf("fetch %d: isLive() = %v, want %v", i, got, fe.live)
+				}
+			}
+		})
+	}
+}
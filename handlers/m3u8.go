@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/zjyl1994/donggua-proxy/config"
+	"github.com/zjyl1994/donggua-proxy/hls"
+)
+
+// readPlaylist 读取并解析上游播放列表，大小由 limitResponse 限制
+func readPlaylist(body io.Reader) (*hls.Playlist, error) {
+	return hls.Parse(body)
+}
+
+// rewritePlaylist 将播放列表中的分片、子列表、密钥等所有地址改写为经由代理访问
+// 返回媒体播放列表中按顺序出现的分片绝对地址，供预取使用
+// 使用了站点请求头配置时，子地址附带配置名以便沿用
+func rewritePlaylist(playlist *hls.Playlist, baseURL *url.URL, proxyOrigin string, profile *headerProfile) []string {
+	var segments []string
+	var encrypted []encryptedItem
+	decrypt := false
+	if media, err := playlist.Media(); err == nil {
+		for _, seg := range media.Segments {
+			if absolute, ok := resolvePlaylistURI(seg.URI(), baseURL); ok {
+				segments = append(segments, absolute)
+			}
+		}
+		if hlsKeys.mode == keyModeDecrypt {
+			encrypted, decrypt = planDecryption(media, baseURL)
+		}
+	}
+
+	var keyURLs, referenced []string
+	isMedia := !playlist.IsMaster()
+	playlist.RewriteURIs(func(uri, tag string) string {
+		absolute, ok := resolvePlaylistURI(uri, baseURL)
+		if !ok {
+			return uri
+		}
+		referenced = append(referenced, absolute)
+		if tag == "EXT-X-KEY" {
+			keyURLs = append(keyURLs, absolute)
+		}
+		params := profile.params(absolute, "")
+		// 媒体列表中的分片带上标记，代理时才会检查伪装成图片的 TS 分片
+		if config.SegmentUnwrap && isMedia && (tag == "" || tag == "EXT-X-PART") {
+			if params == nil {
+				params = url.Values{}
+			}
+			params.Set(segmentParam, "1")
+		}
+		return proxyURL(proxyOrigin, absolute, params)
+	})
+	// 白名单模式下，已返回的播放列表引用的主机允许访问
+	targetAllowlist.allowURLs(referenced)
+
+	if decrypt && len(encrypted) > 0 {
+		applyDecryption(playlist, encrypted, proxyOrigin, profile)
+		// 解密后的分片与原始分片内容不同，不参与预取
+		return nil
+	}
+	hlsKeys.register(keyURLs, profile)
+	return segments
+}
+
+// resolvePlaylistURI 将播放列表中的相对地址解析为绝对地址
+// data:、skd: 等非 http(s) 地址无法代理，返回 false 保持原样
+func resolvePlaylistURI(uri string, baseURL *url.URL) (string, bool) {
+	ref, err := url.Parse(strings.TrimSpace(uri))
+	if err != nil {
+		return "", false
+	}
+	resolved := baseURL.ResolveReference(ref)
+	if resolved.Scheme != "http" && resolved.Scheme != "https" {
+		return "", false
+	}
+	return resolved.String(), true
+}
+
+// proxyURL 生成经由代理访问 target 的地址，params 为附加的代理参数
+func proxyURL(proxyOrigin, target string, params url.Values) string {
+	u := proxyOrigin + "/?url=" + url.QueryEscape(target)
+	if len(params) > 0 {
+		u += "&" + params.Encode()
+	}
+	return u
+}
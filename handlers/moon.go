@@ -1,11 +1,13 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/zjyl1994/donggua-proxy/utils"
 )
@@ -54,7 +56,9 @@ func Moon2DongguaHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, moonUrl, nil)
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, moonUrl, nil)
 	if err != nil {
 		utils.LogError(r, fmt.Errorf("failed to create request: %w", err))
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -68,6 +72,11 @@ func Moon2DongguaHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer resp.Body.Close()
+	if err := decodeResponseBody(resp); err != nil {
+		utils.LogError(r, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
 
 	if resp.StatusCode != http.StatusOK {
 		utils.LogError(r, fmt.Errorf("remote server returned %d", resp.StatusCode))
@@ -86,7 +95,9 @@ func Moon2DongguaHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var dongguaSub DongguaSub
+	var apis []string
 	for key, site := range moonSub.ApiSite {
+		apis = append(apis, site.Api)
 		dongguaSub.Sites = append(dongguaSub.Sites, DongguaItem{
 			Key:    key,
 			Name:   site.Name,
@@ -95,9 +106,16 @@ func Moon2DongguaHandler(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
+	// 白名单模式下，可信订阅中的站点接口允许经由通用代理访问
+	// 该接口无需密码，否则任何人都能借一份自制订阅把任意主机加入白名单
+	if targetAllowlist.trustsSubscription(r, targetURL) {
+		targetAllowlist.addSiteAPIs(apis)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(dongguaSub); err != nil {
+	cw := newCompressWriter(w, r)
+	defer cw.Close()
+	if err := json.NewEncoder(cw).Encode(dongguaSub); err != nil {
 		utils.LogError(r, fmt.Errorf("failed to encode response: %w", err))
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
 }
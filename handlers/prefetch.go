@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zjyl1994/donggua-proxy/cache"
+	"github.com/zjyl1994/donggua-proxy/config"
+	"github.com/zjyl1994/donggua-proxy/utils"
+)
+
+// segmentPrefetcher 为 nil 时表示未开启分片预取
+var segmentPrefetcher = newPrefetcher(
+	config.PrefetchSegments,
+	config.PrefetchConcurrency,
+	int64(config.PrefetchCacheMB)*1024*1024,
+	config.PrefetchTTL,
+)
+
+// hlsStream 记录一个媒体播放列表中的分片顺序
+type hlsStream struct {
+	segments []string
+	index    map[string]int
+	sem      chan struct{}
+	updated  time.Time
+	profile  *headerProfile
+}
+
+// prefetcher 在播放器请求第 N 个分片时预先拉取后续分片到内存缓存
+type prefetcher struct {
+	depth       int
+	concurrency int
+	maxSegment  int64
+	ttl         time.Duration
+	cache       *cache.MemoryCache
+
+	mu       sync.Mutex
+	streams  map[string]*hlsStream
+	segments map[string]*hlsStream
+	inflight map[string]chan struct{}
+}
+
+func newPrefetcher(depth, concurrency int, cacheBytes int64, ttl time.Duration) *prefetcher {
+	if depth <= 0 || cacheBytes <= 0 {
+		return nil
+	}
+	p := &prefetcher{
+		depth:       depth,
+		concurrency: max(concurrency, 1),
+		// 单个分片最多占用缓存的 1/4，避免大文件把缓存挤空
+		maxSegment: cacheBytes / 4,
+		ttl:        ttl,
+		cache:      cache.NewMemoryCache(cacheBytes, ttl),
+		streams:    make(map[string]*hlsStream),
+		segments:   make(map[string]*hlsStream),
+		inflight:   make(map[string]chan struct{}),
+	}
+	go p.cleanupLoop()
+	return p
+}
+
+// prefetchKey 统一分片地址的表示方式，使播放列表中的地址与代理请求中的地址一致
+func prefetchKey(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.Fragment = ""
+	return u.String()
+}
+
+// register 记录播放列表的分片顺序，直播列表刷新时会覆盖旧记录
+func (p *prefetcher) register(playlistURL *url.URL, segments []string, profile *headerProfile) {
+	stream := &hlsStream{
+		segments: make([]string, 0, len(segments)),
+		index:    make(map[string]int, len(segments)),
+		updated:  time.Now(),
+		profile:  profile,
+	}
+	for _, seg := range segments {
+		key := prefetchKey(seg)
+		if _, dup := stream.index[key]; dup {
+			continue
+		}
+		stream.index[key] = len(stream.segments)
+		stream.segments = append(stream.segments, key)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	streamKey := prefetchKey(playlistURL.String())
+	if old, ok := p.streams[streamKey]; ok {
+		// 沿用原有的并发限制，避免刷新列表后并发数翻倍
+		stream.sem = old.sem
+		for _, key := range old.segments {
+			if p.segments[key] == old {
+				delete(p.segments, key)
+			}
+		}
+	} else {
+		stream.sem = make(chan struct{}, p.concurrency)
+	}
+	p.streams[streamKey] = stream
+	for _, key := range stream.segments {
+		p.segments[key] = stream
+	}
+}
+
+// trigger 开始预取 target 之后的若干个分片
+func (p *prefetcher) trigger(target *url.URL) {
+	key := prefetchKey(target.String())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stream, ok := p.segments[key]
+	if !ok {
+		return
+	}
+	idx := stream.index[key]
+	for _, next := range stream.segments[idx+1 : min(idx+1+p.depth, len(stream.segments))] {
+		if _, busy := p.inflight[next]; busy || p.cache.Contains(next) {
+			continue
+		}
+		done := make(chan struct{})
+		p.inflight[next] = done
+		go p.fetch(stream, next, done)
+	}
+}
+
+// serve 使用预取结果响应请求，分片正在预取时等待其完成
+// 返回 false 表示缓存未命中，调用者应继续请求上游
+func (p *prefetcher) serve(w http.ResponseWriter, r *http.Request, target *url.URL) bool {
+	key := prefetchKey(target.String())
+
+	p.mu.Lock()
+	done, busy := p.inflight[key]
+	p.mu.Unlock()
+	if busy {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+			return true
+		}
+	}
+
+	entry, ok := p.cache.Get(key)
+	if !ok {
+		return false
+	}
+	serveCachedEntry(w, r, entry)
+	return true
+}
+
+func (p *prefetcher) fetch(stream *hlsStream, key string, done chan struct{}) {
+	defer func() {
+		p.mu.Lock()
+		delete(p.inflight, key)
+		p.mu.Unlock()
+		close(done)
+	}()
+
+	stream.sem <- struct{}{}
+	defer func() { <-stream.sem }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.ttl)
+	defer cancel()
+
+	entry, err := p.download(ctx, key, stream.profile)
+	if err != nil {
+		log.Printf("[WARN] prefetch %s: %v", key, err)
+		return
+	}
+	p.cache.Set(key, entry)
+}
+
+func (p *prefetcher) download(ctx context.Context, rawURL string, profile *headerProfile) (*cache.Entry, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.ValidateTargetURL(target); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := newUpstreamRequest(ctx, http.MethodGet, target, nil, profile)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := upstreamRetry.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned %d", resp.StatusCode)
+	}
+	if !cache.Storable(resp.Header) {
+		return nil, fmt.Errorf("response is not shareable")
+	}
+	// 与代理请求相同的解压、去伪装和传输限制，保证缓存内容与直接代理的结果一致
+	if err := decodeResponseBody(resp); err != nil {
+		return nil, err
+	}
+	class := classifyProxyResponse(target, strings.ToLower(resp.Header.Get("Content-Type")), false)
+	// 预取的地址都来自媒体播放列表中的分片
+	if config.SegmentUnwrap && shouldUnwrap(true, class) && unwrapDisguisedSegment(resp) {
+		class = classSegment
+	}
+	if err := limitResponse(resp, class, start, cancel); err != nil {
+		return nil, err
+	}
+	if resp.ContentLength > p.maxSegment {
+		return nil, fmt.Errorf("segment too large: %d bytes", resp.ContentLength)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, p.maxSegment+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > p.maxSegment {
+		return nil, fmt.Errorf("segment too large: more than %d bytes", p.maxSegment)
+	}
+
+	return &cache.Entry{Header: cacheableHeader(resp.Header), Body: body, Stored: time.Now()}, nil
+}
+
+// cleanupLoop 清理长时间未刷新的播放列表记录
+func (p *prefetcher) cleanupLoop() {
+	for {
+		time.Sleep(1 * time.Minute)
+		p.mu.Lock()
+		for streamKey, stream := range p.streams {
+			if time.Since(stream.updated) > 10*time.Minute {
+				for _, key := range stream.segments {
+					if p.segments[key] == stream {
+						delete(p.segments, key)
+					}
+				}
+				delete(p.streams, streamKey)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// serveCachedEntry 使用缓存的响应体回复请求，支持 Range 和条件请求
+func serveCachedEntry(w http.ResponseWriter, r *http.Request, entry *cache.Entry) {
+	utils.CopyHeaders(w, entry.Header)
+	var modTime time.Time
+	if lm := entry.Header.Get("Last-Modified"); lm != "" {
+		modTime, _ = http.ParseTime(lm)
+	}
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(entry.Body))
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zjyl1994/donggua-proxy/config"
+	"github.com/zjyl1994/donggua-proxy/utils"
+)
+
+// allowLoopback 允许测试请求本机的 httptest 上游
+func allowLoopback(t *testing.T) {
+	t.Helper()
+	policy, err := utils.NewSSRFPolicy("", "", "127.0.0.0/8,::1/128", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := utils.Policy
+	utils.Policy = policy
+	t.Cleanup(func() { utils.Policy = old })
+}
+
+func TestPrefetcherTriggerServe(t *testing.T) {
+	allowLoopback(t)
+	oldUnwrap := config.SegmentUnwrap
+	config.SegmentUnwrap = true
+	t.Cleanup(func() { config.SegmentUnwrap = oldUnwrap })
+
+	png := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+	ts := tsPackets(5)
+	var mu sync.Mutex
+	hits := map[string]int{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/seg1.ts":
+			// 压缩后的分片应解压后缓存
+			w.Header().Set("Content-Type", "video/mp2t")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Set-Cookie", "session=secret")
+			gz := gzip.NewWriter(w)
+			gz.Write(ts)
+			gz.Close()
+		case "/seg2.png":
+			// 伪装成图片的分片应去掉图片头
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(append(append([]byte(nil), png...), ts...))
+		case "/seg3.ts":
+			w.Header().Set("Content-Type", "video/mp2t")
+			w.Header().Set("Cache-Control", "private")
+			w.Write(ts)
+		default:
+			w.Header().Set("Content-Type", "video/mp2t")
+			w.Write(ts)
+		}
+	}))
+	defer upstream.Close()
+
+	p := newPrefetcher(3, 2, 1<<20, time.Minute)
+	playlist, _ := url.Parse(upstream.URL + "/index.m3u8")
+	segURL := func(name string) *url.URL {
+		u, _ := url.Parse(upstream.URL + "/" + name)
+		return u
+	}
+	p.register(playlist, []string{
+		segURL("seg0.ts").String(), segURL("seg1.ts").String(), segURL("seg2.png").String(),
+		segURL("seg3.ts").String(), segURL("seg4.ts").String(),
+	}, nil)
+
+	p.trigger(segURL("seg0.ts"))
+
+	for _, name := range []string{"seg1.ts", "seg2.png"} {
+		w := httptest.NewRecorder()
+		if !p.serve(w, httptest.NewRequest(http.MethodGet, "/", nil), segURL(name)) {
+			t.Fatalf("%s: prefetch miss", name)
+		}
+		if !bytes.Equal(w.Body.Bytes(), ts) {
+			t.Errorf("%s: body has %d bytes, want the %d byte TS payload", name, w.Body.Len(), len(ts))
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "video/mp2t" {
+			t.Errorf("%s: Content-Type = %q", name, ct)
+		}
+		if w.Header().Get("Content-Encoding") != "" || w.Header().Get("Set-Cookie") != "" {
+			t.Errorf("%s: unexpected headers %v", name, w.Header())
+		}
+	}
+
+	// 不可共享的响应不缓存，超出预取深度的分片不预取
+	for _, name := range []string{"seg3.ts", "seg4.ts"} {
+		if p.serve(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), segURL(name)) {
+			t.Errorf("%s: unexpected prefetch hit", name)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if hits["/seg0.ts"] != 0 || hits["/seg1.ts"] != 1 || hits["/seg2.png"] != 1 || hits["/seg4.ts"] != 0 {
+		t.Errorf("upstream hits = %v", hits)
+	}
+}
+
+func TestPrefetcherSizeCap(t *testing.T) {
+	allowLoopback(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp2t")
+		body := strings.Repeat("x", 2048)
+		if r.URL.Query().Get("chunked") == "1" {
+			// 未声明长度时按实际读取的字节数限制
+			w.Write([]byte(body[:1024]))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(body[1024:]))
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer upstream.Close()
+
+	// 缓存 4KB，单个分片上限 1KB
+	p := newPrefetcher(1, 1, 4096, time.Minute)
+	for _, rawURL := range []string{upstream.URL + "/big.ts", upstream.URL + "/big.ts?chunked=1"} {
+		_, err := p.download(t.Context(), rawURL, nil)
+		if err == nil || !strings.Contains(err.Error(), "segment too large") {
+			t.Errorf("download(%s) error = %v, want segment too large", rawURL, err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/zjyl1994/donggua-proxy/config"
+)
+
+const (
+	// profileParam 改写后的子地址通过该参数沿用父播放列表的请求头配置
+	profileParam = "profile"
+	// profileSigParam 配置名与目标地址的签名，子地址跨主机时用于证明配置由代理下发
+	profileSigParam = "profile_sig"
+)
+
+// profileKey 签名密钥，未配置时每次启动随机生成
+var profileKey = newProfileKey(config.ProfileSigningKey)
+
+func newProfileKey(s string) []byte {
+	if s != "" {
+		return []byte(s)
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// signProfile 计算配置名与目标地址的签名，解密地址的签名同时覆盖密钥地址
+func signProfile(name, target, keyURL string) string {
+	mac := hmac.New(sha256.New, profileKey)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(target))
+	mac.Write([]byte{0})
+	mac.Write([]byte(keyURL))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// headerProfile 按目标主机匹配的上游请求头配置
+type headerProfile struct {
+	Name string `json:"name"`
+	// Hosts 匹配的主机，支持 "*.example.com" 匹配子域名
+	Hosts []string `json:"hosts"`
+	// Set 覆盖或新增的请求头，如 Referer、User-Agent、Cookie
+	Set map[string]string `json:"set"`
+	// Remove 去掉的默认请求头，如 Origin
+	Remove []string `json:"remove"`
+	// Forward 从客户端请求中原样转发的请求头
+	Forward []string `json:"forward"`
+}
+
+// headerProfiles 在启动时加载，之后只读
+var headerProfiles []*headerProfile
+
+// LoadHeaderProfiles 从 JSON 文件加载请求头配置，path 为空时不加载
+func LoadHeaderProfiles(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read header profiles: %w", err)
+	}
+	var profiles []*headerProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return fmt.Errorf("parse header profiles: %w", err)
+	}
+
+	names := make(map[string]bool)
+	for i, p := range profiles {
+		if p.Name == "" {
+			return fmt.Errorf("header profile #%d: missing name", i+1)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("header profile %q: duplicate name", p.Name)
+		}
+		names[p.Name] = true
+		for j, host := range p.Hosts {
+			p.Hosts[j] = strings.ToLower(strings.TrimSpace(host))
+		}
+	}
+	headerProfiles = profiles
+	return nil
+}
+
+// matchHost 判断主机是否匹配模式，"*.example.com" 同时匹配 example.com 本身
+func matchHost(pattern, host string) bool {
+	host = strings.ToLower(host)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return host == suffix || strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+// profileByName 按名称查找配置
+func profileByName(name string) *headerProfile {
+	for _, p := range headerProfiles {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// profileForHost 返回第一个匹配主机的配置
+func profileForHost(host string) *headerProfile {
+	for _, p := range headerProfiles {
+		if p.matches(host) {
+			return p
+		}
+	}
+	return nil
+}
+
+// matches 判断主机是否属于该配置
+func (p *headerProfile) matches(host string) bool {
+	for _, pattern := range p.Hosts {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// profileForRequest 优先使用请求中携带的配置名 (由父播放列表传递)，否则按目标主机匹配
+// 配置中可能含有 Cookie、令牌等请求头，携带的配置名只在目标主机属于该配置，
+// 或带有代理改写时生成的签名时才生效
+func profileForRequest(r *http.Request, target *url.URL) *headerProfile {
+	query := r.URL.Query()
+	if name := query.Get(profileParam); name != "" {
+		if p := profileByName(name); p != nil && (p.matches(target.Hostname()) || profileSigned(query, p)) {
+			return p
+		}
+	}
+	return profileForHost(target.Hostname())
+}
+
+// profileForKey 返回拉取解密密钥时使用的配置
+// 密钥地址来自请求参数，只有密钥主机属于该配置或签名覆盖了密钥地址时才沿用分片的配置
+func profileForKey(r *http.Request, profile *headerProfile, keyURL *url.URL) *headerProfile {
+	if profile != nil && (profile.matches(keyURL.Hostname()) || profileSigned(r.URL.Query(), profile)) {
+		return profile
+	}
+	return profileForHost(keyURL.Hostname())
+}
+
+// profileSigned 校验请求中的签名是否由代理为该配置与目标地址 (及密钥地址) 生成
+func profileSigned(query url.Values, p *headerProfile) bool {
+	sig := query.Get(profileSigParam)
+	if sig == "" || query.Get(profileParam) != p.Name {
+		return false
+	}
+	expected := signProfile(p.Name, strings.TrimSpace(query.Get("url")), query.Get("key"))
+	return hmac.Equal([]byte(sig), []byte(expected))
+}
+
+// apply 将配置中的 Set/Remove 应用到上游请求
+func (p *headerProfile) apply(req *http.Request) {
+	if p == nil {
+		return
+	}
+	for _, h := range p.Remove {
+		req.Header.Del(h)
+	}
+	for h, v := range p.Set {
+		req.Header.Set(h, v)
+	}
+}
+
+// forward 从客户端请求转发配置中列出的请求头
+func (p *headerProfile) forward(req *http.Request, client *http.Request) {
+	if p == nil {
+		return
+	}
+	for _, h := range p.Forward {
+		if vv := client.Header.Values(h); len(vv) > 0 {
+			req.Header[http.CanonicalHeaderKey(h)] = append([]string(nil), vv...)
+		}
+	}
+}
+
+// forwards 判断客户端请求是否携带需要转发的请求头
+// 携带时上游响应可能因人而异，不能走共享的播放列表缓存
+func (p *headerProfile) forwards(client *http.Request) bool {
+	if p == nil {
+		return false
+	}
+	for _, h := range p.Forward {
+		if client.Header.Get(h) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// params 返回改写子地址 target 时需要附加的参数，keyURL 为解密地址的密钥地址
+func (p *headerProfile) params(target, keyURL string) url.Values {
+	if p == nil {
+		return nil
+	}
+	return url.Values{
+		profileParam:    {p.Name},
+		profileSigParam: {signProfile(p.Name, target, keyURL)},
+	}
+}
+
+// name 返回配置名，nil 时为空字符串
+func (p *headerProfile) name() string {
+	if p == nil {
+		return ""
+	}
+	return p.Name
+}
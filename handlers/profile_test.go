@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestProfileForRequest(t *testing.T) {
+	site := &headerProfile{Name: "site", Hosts: []string{"*.site.example"}, Set: map[string]string{"Cookie": "secret"}}
+	other := &headerProfile{Name: "other", Hosts: []string{"other.example"}}
+	saved := headerProfiles
+	headerProfiles = []*headerProfile{site, other}
+	defer func() { headerProfiles = saved }()
+
+	const cdn = "https://cdn.example/seg0.ts"
+	const key = "https://keys.example/k"
+	signed := site.params(cdn, "")
+	signedKey := site.params(cdn, key)
+	tests := []struct {
+		name   string
+		target string
+		params url.Values
+		want   *headerProfile
+	}{
+		{"host match", "https://v.site.example/a.m3u8", nil, site},
+		{"no match", "https://attacker.example/", nil, nil},
+		{"name for own host", "https://v.site.example/a.m3u8", url.Values{"profile": {"site"}}, site},
+		{"name for foreign host", "https://attacker.example/", url.Values{"profile": {"site"}}, nil},
+		{"name falls back to host match", "https://other.example/", url.Values{"profile": {"site"}}, other},
+		{"signed cross host", cdn, signed, site},
+		{"signature for another url", "https://attacker.example/", signed, nil},
+		{"forged signature", cdn, url.Values{"profile": {"site"}, "profile_sig": {"AAAAAAAAAAAAAAAAAAAAAA"}}, nil},
+		{"signed with key", cdn, withKey(signedKey, key), site},
+		{"key swapped", cdn, withKey(signedKey, "https://attacker.example/k"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := url.Values{"url": {tt.target}}
+			for k, v := range tt.params {
+				q[k] = v
+			}
+			r := httptest.NewRequest(http.MethodGet, "/?"+q.Encode(), nil)
+			target, _ := url.Parse(tt.target)
+			if got := profileForRequest(r, target); got != tt.want {
+				t.Fatalf("profileForRequest() = %q, want %q", got.name(), tt.want.name())
+			}
+		})
+	}
+}
+
+func TestProfileForKey(t *testing.T) {
+	site := &headerProfile{Name: "site", Hosts: []string{"*.site.example"}}
+	saved := headerProfiles
+	headerProfiles = []*headerProfile{site}
+	defer func() { headerProfiles = saved }()
+
+	const seg = "https://v.site.example/seg.ts"
+	const cdnSeg = "https://cdn.example/seg.ts"
+	tests := []struct {
+		name   string
+		target string
+		key    string
+		params url.Values
+		want   *headerProfile
+	}{
+		{"key on profile host", seg, "https://k.site.example/k", nil, site},
+		{"foreign key by host match", seg, "https://attacker.example/k", nil, nil},
+		{"foreign key with bare name", seg, "https://attacker.example/k", url.Values{"profile": {"site"}}, nil},
+		{"signed key", cdnSeg, "https://keys.example/k", site.params(cdnSeg, "https://keys.example/k"), site},
+		{"signature without key", cdnSeg, "https://keys.example/k", site.params(cdnSeg, ""), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := withKey(tt.params, tt.key)
+			q.Set("url", tt.target)
+			r := httptest.NewRequest(http.MethodGet, "/?"+q.Encode(), nil)
+			target, _ := url.Parse(tt.target)
+			keyURL, _ := url.Parse(tt.key)
+			profile := profileForRequest(r, target)
+			if got := profileForKey(r, profile, keyURL); got != tt.want {
+				t.Fatalf("profileForKey() = %q, want %q", got.name(), tt.want.name())
+			}
+		})
+	}
+}
+
+func withKey(params url.Values, key string) url.Values {
+	q := url.Values{"key": {key}}
+	for k, v := range params {
+		q[k] = v
+	}
+	return q
+}
@@ -1,22 +1,64 @@
 package handlers
 
 import (
-	"bufio"
+	"context"
 	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/zjyl1994/donggua-proxy/config"
 	"github.com/zjyl1994/donggua-proxy/utils"
 )
 
+// forwardedRequestHeaders 原样转发给上游的客户端请求头
+// Accept-Encoding 不转发：由 Transport 自行协商 gzip 并透明解压，响应侧也会过滤 Content-Encoding，
+// 转发后上游可能返回播放器无法识别的压缩内容
+var forwardedRequestHeaders = []string{
+	"Accept",
+	"Accept-Language",
+	"Content-Type",
+	"Range",
+	"If-Range",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Match",
+	"If-Unmodified-Since",
+}
+
+// conditionalRequestHeaders 会使上游返回 304、412 或部分内容的请求头
+var conditionalRequestHeaders = []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"}
+
+// forwardRequestHeaders 按转发策略复制客户端请求头
+// 解密需要完整的密文，此时不转发 Range/If-Range
+func forwardRequestHeaders(dst, src *http.Request, decrypting bool) {
+	for _, h := range forwardedRequestHeaders {
+		if decrypting && (h == "Range" || h == "If-Range") {
+			continue
+		}
+		if vv := src.Header.Values(h); len(vv) > 0 {
+			dst.Header[h] = append([]string(nil), vv...)
+		}
+	}
+	for _, h := range extraForwardedHeaders {
+		if vv := src.Header.Values(h); len(vv) > 0 {
+			dst.Header[h] = append([]string(nil), vv...)
+		}
+	}
+}
+
 // ProxyHandler 处理通用代理请求
 func ProxyHandler(w http.ResponseWriter, r *http.Request) {
 	// 1. 处理 CORS 预检
 	utils.SetCORSHeaders(w)
+	if len(extraForwardedHeaders) > 0 {
+		allowed := w.Header().Get("Access-Control-Allow-Headers")
+		w.Header().Set("Access-Control-Allow-Headers", allowed+", "+strings.Join(extraForwardedHeaders, ", "))
+	}
 	if r.Method == http.MethodOptions {
 		w.WriteHeader(http.StatusNoContent)
 		return
@@ -41,13 +83,9 @@ func ProxyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 3. 验证访问密码 (Bearer Token)
-	if config.AccessPassword != "" {
-		auth := r.Header.Get("Authorization")
-		expected := "Bearer " + config.AccessPassword
-		if subtle.ConstantTimeCompare([]byte(auth), []byte(expected)) != 1 {
-			http.Error(w, "Unauthorized", http.StatusForbidden)
-			return
-		}
+	if config.AccessPassword != "" && !hasAccessPassword(r) {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return
 	}
 
 	targetURL, err := url.Parse(targetURLStr)
@@ -64,142 +102,291 @@ func ProxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 白名单模式下只代理允许的主机
+	if targetAllowlist != nil && !targetAllowlist.allowed(targetURL.Hostname()) {
+		utils.LogError(r, fmt.Errorf("host not in allowlist: %s", targetURL.Hostname()))
+		http.Error(w, "Forbidden URL", http.StatusForbidden)
+		return
+	}
+
+	// 限制可以接收 POST/PUT/PATCH/DELETE 的主机
+	if isMutatingMethod(r.Method) && !mutationAllowed(targetURL.Hostname()) {
+		utils.LogError(r, fmt.Errorf("method %s not allowed for host %s", r.Method, targetURL.Hostname()))
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 站点请求头配置：优先沿用父播放列表传递的配置
+	profile := profileForRequest(r, targetURL)
+
+	// 已登记的 HLS 密钥由密钥缓存直接返回
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && hlsKeys.isKnown(targetURL.String()) {
+		hlsKeys.serve(w, r, targetURL.String(), profile)
+		return
+	}
+
+	// 需要由代理解密的 AES-128 分片
+	var decryptKey, decryptIV []byte
+	if hlsKeys.mode == keyModeDecrypt && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		keyURLStr, iv, ok, err := parseDecryptParams(r.URL.Query())
+		if errors.Is(err, errDecryptSignature) {
+			utils.LogError(r, err)
+			http.Error(w, "Forbidden URL", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Invalid IV", http.StatusBadRequest)
+			return
+		}
+		if ok {
+			keyURL, err := url.Parse(keyURLStr)
+			if err == nil {
+				err = utils.ValidateTargetURL(keyURL)
+			}
+			if err != nil {
+				utils.LogError(r, fmt.Errorf("ssrf check failed for key: %w", err))
+				http.Error(w, "Forbidden URL", http.StatusForbidden)
+				return
+			}
+			// 密钥主机与目标主机一样受白名单限制
+			if targetAllowlist != nil && !targetAllowlist.allowed(keyURL.Hostname()) {
+				utils.LogError(r, fmt.Errorf("key host not in allowlist: %s", keyURL.Hostname()))
+				http.Error(w, "Forbidden URL", http.StatusForbidden)
+				return
+			}
+			if decryptKey, err = hlsKeys.get(r.Context(), keyURL.String(), profileForKey(r, profile, keyURL)); err != nil {
+				utils.LogError(r, fmt.Errorf("fetch key failed: %w", err))
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				return
+			}
+			decryptIV = iv
+		}
+	}
+
+	// 命中预取缓存时直接返回，同时预取后续分片
+	// 解密请求的内容与缓存的原始分片不同，不使用缓存
+	if r.Method == http.MethodGet && segmentPrefetcher != nil && decryptKey == nil {
+		segmentPrefetcher.trigger(targetURL)
+		if segmentPrefetcher.serve(newStreamWriter(w, config.StreamIdleTimeout, nil), r, targetURL) {
+			return
+		}
+	}
+
+	// 命中磁盘分片缓存时直接返回
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && segmentCache != nil && decryptKey == nil {
+		if segmentCache.serve(newStreamWriter(w, config.StreamIdleTimeout, nil), r, targetURL) {
+			return
+		}
+	}
+
 	// 4. 构建代理请求
-	proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL.String(), r.Body)
+	// 超出传输时间限制时通过 cancel 中止上游请求
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	start := time.Now()
+	reqBody, contentLength, ok := prepareRequestBody(w, r)
+	if !ok {
+		utils.LogError(r, fmt.Errorf("request body too large: %d bytes", r.ContentLength))
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	proxyReq, err := newUpstreamRequest(ctx, r.Method, targetURL, reqBody, profile)
 	if err != nil {
 		utils.LogError(r, fmt.Errorf("failed to create proxy request: %w", err))
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	// 沿用客户端声明的长度，未声明 (-1) 时以 chunked 转发
+	proxyReq.ContentLength = contentLength
 
-	// 设置伪装头信息
-	proxyReq.Header.Set("Referer", targetURL.Scheme+"://"+targetURL.Host+"/")
-	proxyReq.Header.Set("Origin", targetURL.Scheme+"://"+targetURL.Host)
-	proxyReq.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
+	// 转发关键头，使 304 与部分响应可以端到端传递
+	forwardRequestHeaders(proxyReq, r, decryptKey != nil)
+	profile.forward(proxyReq, r)
 
-	// 转发关键头
-	if rRange := r.Header.Get("Range"); rRange != "" {
-		proxyReq.Header.Set("Range", rRange)
-	}
-	if accept := r.Header.Get("Accept"); accept != "" {
-		proxyReq.Header.Set("Accept", accept)
-	}
-	if contentType := r.Header.Get("Content-Type"); contentType != "" {
-		proxyReq.Header.Set("Content-Type", contentType)
+	// 播放列表走共享缓存，合并多个观众的刷新请求
+	var resp *http.Response
+	if playlistCache.eligible(r, targetURL) && !profile.forwards(r) {
+		resp, err = playlistCache.get(ctx, targetURL, profile)
+	} else {
+		resp, err = upstreamRetry.do(proxyReq)
 	}
-
-	resp, err := utils.DefaultClient.Do(proxyReq)
 	if err != nil {
 		utils.LogError(r, fmt.Errorf("proxy request failed: %w", err))
+		// 解析后的地址 (或跳转目标) 被 SSRF 策略拒绝
+		var policyErr *utils.PolicyError
+		if errors.As(err, &policyErr) {
+			http.Error(w, "Forbidden URL", http.StatusForbidden)
+			return
+		}
+		// 未声明长度的请求体超出限制
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Bad Gateway", http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
+	contentType := strings.ToLower(resp.Header.Get("Content-Type"))
+	isM3u8 := strings.HasSuffix(strings.ToLower(targetURL.Path), ".m3u8") ||
+		strings.Contains(contentType, "mpegurl")
+	class := classifyProxyResponse(targetURL, contentType, isM3u8)
+
+	// 无法解压的编码只能原样透传给客户端，需要改写或解密的内容返回 502
+	var passEncoding string
+	if err := decodeResponseBody(resp); err != nil {
+		var encErr *unsupportedEncodingError
+		if !errors.As(err, &encErr) || isM3u8 || decryptKey != nil {
+			utils.LogError(r, err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		passEncoding = resp.Header.Get("Content-Encoding")
+	}
+
+	// 去掉伪装成图片的 TS 分片前缀，只处理媒体分片 (部分请求的 Range 偏移无法对应，跳过)
+	if config.SegmentUnwrap && r.Method == http.MethodGet && r.Header.Get("Range") == "" && passEncoding == "" &&
+		resp.StatusCode == http.StatusOK && decryptKey == nil && !isM3u8 && shouldUnwrap(listedSegment(r), class) {
+		if unwrapDisguisedSegment(resp) {
+			contentType, class = "video/mp2t", classSegment
+		}
+	}
+
+	// 按内容类别限制响应大小与传输时间
+	if err := limitResponse(resp, class, start, cancel); err != nil {
+		utils.LogError(r, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
 	// 5. 复制目标服务器的响应头
 	utils.CopyHeadersWithFilter(w, resp.Header, utils.DefaultExcludedResponseHeaders)
+	if passEncoding != "" {
+		w.Header().Set("Content-Encoding", passEncoding)
+	}
 	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
 		if loc := strings.TrimSpace(resp.Header.Get("Location")); loc != "" {
 			if locURL, err := url.Parse(loc); err == nil {
 				resolved := targetURL.ResolveReference(locURL)
 				if err := utils.ValidateTargetURL(resolved); err == nil {
 					proxyOrigin := utils.GetProxyOrigin(r, config.TrustProxy, config.TrustedProxyCIDRs)
-					w.Header().Set("Location", proxyOrigin+"/?url="+url.QueryEscape(resolved.String()))
+					w.Header().Set("Location", proxyURL(proxyOrigin, resolved.String(), profile.params(resolved.String(), "")))
+					targetAllowlist.allowURLs([]string{resolved.String()})
 				}
 			}
 		}
 	}
 
-	contentType := strings.ToLower(resp.Header.Get("Content-Type"))
-	isM3u8 := strings.HasSuffix(strings.ToLower(targetURL.Path), ".m3u8") ||
-		strings.Contains(contentType, "mpegurl")
-
 	// 6. 处理 M3U8 重写或直接流式透传
 	if isM3u8 && resp.StatusCode == http.StatusOK {
+		playlist, err := readPlaylist(resp.Body)
+		if err != nil {
+			// 格式错误的播放列表不做透传，避免播放器拿到改写了一半的内容
+			utils.LogError(r, fmt.Errorf("parse m3u8 failed: %w", err))
+			for k := range resp.Header {
+				w.Header().Del(k)
+			}
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		playlistCache.markKnown(targetURL)
+
+		proxyOrigin := utils.GetProxyOrigin(r, config.TrustProxy, config.TrustedProxyCIDRs)
+		segments := rewritePlaylist(playlist, targetURL, proxyOrigin, profile)
+
 		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
 		w.Header().Del("Content-Length")
+		weakenETag(w.Header())
+		cw := newCompressWriter(w, r)
 		w.WriteHeader(resp.StatusCode)
-
-		proxyOrigin := utils.GetProxyOrigin(r, config.TrustProxy, config.TrustedProxyCIDRs)
-		if err := rewriteM3u8(w, resp.Body, targetURL, proxyOrigin); err != nil {
-			utils.LogError(r, fmt.Errorf("rewrite m3u8 failed: %w", err))
+		if err := playlist.Encode(cw); err != nil {
+			utils.LogError(r, fmt.Errorf("write m3u8 failed: %w", err))
+		}
+		cw.Close()
+		if segmentPrefetcher != nil && len(segments) > 0 {
+			segmentPrefetcher.register(targetURL, segments, profile)
 		}
 	} else {
+		var body io.Reader = resp.Body
+		if decryptKey != nil && resp.StatusCode == http.StatusOK {
+			if body, err = newCBCDecryptReader(resp.Body, decryptKey, decryptIV); err != nil {
+				utils.LogError(r, fmt.Errorf("init decryption failed: %w", err))
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			for _, h := range []string{"Content-Length", "Content-Range", "Accept-Ranges", "ETag"} {
+				w.Header().Del(h)
+			}
+			if !strings.HasPrefix(contentType, "video/") && !strings.HasPrefix(contentType, "audio/") {
+				w.Header().Set("Content-Type", "video/mp2t")
+			}
+		}
+
+		var cacheWriter *segmentCacheWriter
+		if segmentCache != nil && decryptKey == nil && passEncoding == "" {
+			cacheWriter = segmentCache.begin(r, targetURL, resp)
+		}
 		w.WriteHeader(resp.StatusCode)
 
+		// 媒体透传按空闲时间计算超时，数据持续流动时不受 WriteTimeout 限制
+		stream := newStreamWriter(w, config.StreamIdleTimeout, cancel)
+		defer stream.stop()
+
 		// 使用 BufferPool 优化 IO 复制
 		bufPtr := utils.BufferPool.Get().(*[]byte)
 		defer utils.BufferPool.Put(bufPtr)
-		if _, err := io.CopyBuffer(w, resp.Body, *bufPtr); err != nil {
+		writers := []io.Writer{stream}
+		if cacheWriter != nil {
+			writers = append(writers, cacheWriter)
+		}
+		// 站点接口返回的 JSON 中引用的播放地址加入白名单
+		var collector *urlCollector
+		if targetAllowlist.isSiteAPI(targetURL.Hostname()) && resp.StatusCode == http.StatusOK &&
+			(strings.Contains(contentType, "json") || strings.Contains(contentType, "text")) {
+			collector = &urlCollector{}
+			writers = append(writers, collector)
+		}
+		_, err := io.CopyBuffer(io.MultiWriter(writers...), body, *bufPtr)
+		if err != nil && stream.idleExpired() {
+			err = fmt.Errorf("upstream idle for %s: %w", config.StreamIdleTimeout, err)
+		}
+		if err != nil {
 			utils.LogError(r, fmt.Errorf("copy response failed: %w", err))
 		}
-	}
-}
-
-// rewriteM3u8 实现流式重写，减少内存压力
-func rewriteM3u8(w io.Writer, body io.Reader, baseURL *url.URL, proxyOrigin string) error {
-	scanner := bufio.NewScanner(body)
-	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
-
-	basePath := "/"
-	if idx := strings.LastIndex(baseURL.Path, "/"); idx >= 0 {
-		basePath = baseURL.Path[:idx+1]
-	}
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		trimmed := strings.TrimSpace(line)
-
-		if trimmed == "" {
-			fmt.Fprintln(w, line)
-			continue
+		if cacheWriter != nil {
+			cacheWriter.finish(r, err)
 		}
-
-		if strings.HasPrefix(trimmed, "#") {
-			// 重写包含 URI 的标签（如加密 Key 或媒体描述）
-			if strings.Contains(trimmed, `URI="`) {
-				fmt.Fprintln(w, rewriteTagURIs(line, baseURL, proxyOrigin, basePath))
-			} else {
-				fmt.Fprintln(w, line)
-			}
-		} else {
-			// 重写 TS 分片或嵌套的 M3U8 链接
-			absolute := utils.ResolveURL(trimmed, baseURL, basePath)
-			fmt.Fprintf(w, "%s/?url=%s\n", proxyOrigin, url.QueryEscape(absolute))
+		if collector != nil && err == nil {
+			targetAllowlist.allowURLs(collector.urls())
+		}
+		abortOnTransferLimit(err)
+		if stream.idleExpired() {
+			panic(http.ErrAbortHandler)
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return err
-	}
-	return nil
 }
 
-func rewriteTagURIs(line string, baseURL *url.URL, proxyOrigin, basePath string) string {
-	parts := strings.Split(line, `URI="`)
-	if len(parts) < 2 {
-		return line
+// hasAccessPassword 判断请求是否携带了正确的访问密码，未设置密码时返回 false
+func hasAccessPassword(r *http.Request) bool {
+	if config.AccessPassword == "" {
+		return false
 	}
+	expected := "Bearer " + config.AccessPassword
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) == 1
+}
 
-	var result strings.Builder
-	result.WriteString(parts[0])
-
-	for i := 1; i < len(parts); i++ {
-		endIdx := strings.Index(parts[i], `"`)
-		if endIdx == -1 {
-			result.WriteString(`URI="`)
-			result.WriteString(parts[i])
-			continue
-		}
-
-		uri := parts[i][:endIdx]
-		absolute := utils.ResolveURL(uri, baseURL, basePath)
-
-		result.WriteString(`URI="`)
-		result.WriteString(proxyOrigin)
-		result.WriteString("/?url=")
-		result.WriteString(url.QueryEscape(absolute))
-		result.WriteString(`"`)
-		result.WriteString(parts[i][endIdx+1:])
+// newUpstreamRequest 构建发往目标站点的请求，设置伪装头信息并应用站点请求头配置
+func newUpstreamRequest(ctx context.Context, method string, targetURL *url.URL, body io.Reader, profile *headerProfile) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, targetURL.String(), body)
+	if err != nil {
+		return nil, err
 	}
-	return result.String()
+	req.Header.Set("Referer", targetURL.Scheme+"://"+targetURL.Host+"/")
+	req.Header.Set("Origin", targetURL.Scheme+"://"+targetURL.Host)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
+	profile.apply(req)
+	return req, nil
 }
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/zjyl1994/donggua-proxy/config"
+	"github.com/zjyl1994/donggua-proxy/utils"
+)
+
+var (
+	// maxRequestBody 转发给上游的请求体上限，0 表示不限制
+	maxRequestBody = int64(config.ProxyMaxRequestBodyMB) << 20
+	// mutatingHosts 非空时，POST/PUT/PATCH/DELETE 只转发给匹配的主机
+	mutatingHosts = normalizeMutatingHosts(config.ProxyMutatingHosts)
+	// extraForwardedHeaders 额外转发给上游的客户端请求头
+	extraForwardedHeaders = parseForwardHeaders(config.ProxyForwardHeaders)
+)
+
+// unforwardableHeaders 不允许通过 PROXY_FORWARD_HEADERS 转发的请求头：
+// 访问密码、逐跳头、由 Transport 管理的头、代理自行设置的伪装头以及客户端身份信息
+var unforwardableHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Cookie":              true,
+	"Host":                true,
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Content-Length":      true,
+	"Accept-Encoding":     true,
+	"Expect":              true,
+	"Referer":             true,
+	"Origin":              true,
+	"User-Agent":          true,
+	"Forwarded":           true,
+	"Via":                 true,
+	"X-Forwarded-For":     true,
+	"X-Forwarded-Host":    true,
+	"X-Forwarded-Proto":   true,
+	"X-Real-Ip":           true,
+}
+
+// parseForwardHeaders 解析额外转发的请求头，忽略不允许转发的头
+func parseForwardHeaders(s string) []string {
+	var headers []string
+	for _, h := range utils.SplitList(s) {
+		h = textproto.CanonicalMIMEHeaderKey(h)
+		if unforwardableHeaders[h] || strings.HasPrefix(h, "Sec-") {
+			log.Printf("[WARN] PROXY_FORWARD_HEADERS: %s cannot be forwarded, ignored", h)
+			continue
+		}
+		headers = append(headers, h)
+	}
+	return headers
+}
+
+func normalizeMutatingHosts(s string) []string {
+	var hosts []string
+	for _, h := range utils.SplitList(s) {
+		hosts = append(hosts, strings.ToLower(h))
+	}
+	return hosts
+}
+
+// isMutatingMethod 判断是否为会修改上游状态的请求方法
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// mutationAllowed 判断是否允许向目标主机发送 POST/PUT/PATCH/DELETE
+func mutationAllowed(host string) bool {
+	if len(mutatingHosts) == 0 {
+		return true
+	}
+	for _, pattern := range mutatingHosts {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareRequestBody 限制客户端请求体大小，并返回转发给上游的请求体与长度
+// 客户端声明的 Content-Length 超出限制时返回 false，调用方应返回 413；
+// 未声明长度 (chunked) 的请求体在读取超出限制时由上游请求返回 *http.MaxBytesError
+func prepareRequestBody(w http.ResponseWriter, r *http.Request) (body io.ReadCloser, contentLength int64, ok bool) {
+	if r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody {
+		return http.NoBody, 0, true
+	}
+	if maxRequestBody > 0 {
+		if r.ContentLength > maxRequestBody {
+			return nil, 0, false
+		}
+		return http.MaxBytesReader(w, r.Body, maxRequestBody), r.ContentLength, true
+	}
+	return r.Body, r.ContentLength, true
+}
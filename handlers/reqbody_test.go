@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPrepareRequestBody(t *testing.T) {
+	saved := maxRequestBody
+	defer func() { maxRequestBody = saved }()
+	maxRequestBody = 8
+
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		wantOK        bool
+		wantLength    int64
+		wantReadErr   bool
+	}{
+		{name: "no body", contentLength: 0, wantOK: true},
+		{name: "within limit", body: "12345678", contentLength: 8, wantOK: true, wantLength: 8},
+		{name: "declared too large", body: "123456789", contentLength: 9},
+		{name: "chunked within limit", body: "1234", contentLength: -1, wantOK: true, wantLength: -1},
+		// 未声明长度时读取超出限制才报错
+		{name: "chunked too large", body: "123456789", contentLength: -1, wantOK: true, wantLength: -1, wantReadErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			r.ContentLength = tt.contentLength
+			body, length, ok := prepareRequestBody(httptest.NewRecorder(), r)
+			if ok != tt.wantOK || length != tt.wantLength {
+				t.Fatalf("prepareRequestBody() = %d, %v, want %d, %v", length, ok, tt.wantLength, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			data, err := io.ReadAll(body)
+			var maxBytesErr *http.MaxBytesError
+			if tt.wantReadErr {
+				if !errors.As(err, &maxBytesErr) {
+					t.Fatalf("read error = %v, want *http.MaxBytesError", err)
+				}
+				return
+			}
+			if err != nil || string(data) != tt.body {
+				t.Fatalf("read %q, %v, want %q", data, err, tt.body)
+			}
+		})
+	}
+
+	// 不限制时原样返回请求体
+	maxRequestBody = 0
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", 100)))
+	if body, length, ok := prepareRequestBody(httptest.NewRecorder(), r); !ok || length != 100 || body != r.Body {
+		t.Fatalf("unlimited: prepareRequestBody() = %d, %v", length, ok)
+	}
+}
+
+func TestMutationAllowed(t *testing.T) {
+	saved := mutatingHosts
+	defer func() { mutatingHosts = saved }()
+
+	mutatingHosts = nil
+	if !mutationAllowed("any.example") {
+		t.Fatal("empty list should allow every host")
+	}
+
+	mutatingHosts = normalizeMutatingHosts("API.example.com, *.upload.example")
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"api.example.com", true},
+		{"API.Example.com", true},
+		{"www.example.com", false},
+		{"upload.example", true},
+		{"a.b.upload.example", true},
+		{"evilupload.example", false},
+	}
+	for _, tt := range tests {
+		if got := mutationAllowed(tt.host); got != tt.want {
+			t.Errorf("mutationAllowed(%s) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestProxyRejectsMutation(t *testing.T) {
+	savedHosts, savedMax := mutatingHosts, maxRequestBody
+	defer func() { mutatingHosts, maxRequestBody = savedHosts, savedMax }()
+	mutatingHosts = normalizeMutatingHosts("api.example.com")
+	maxRequestBody = 8
+
+	proxy := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/?"+url.Values{"url": {target}}.Encode(), strings.NewReader(body))
+		ProxyHandler(rec, r)
+		return rec
+	}
+
+	// 不在名单中的主机只能使用 GET/HEAD
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		rec := proxy(method, "https://www.example.com/x", "{}")
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, HEAD, OPTIONS" {
+			t.Errorf("%s: status = %d, Allow = %q, want 405", method, rec.Code, rec.Header().Get("Allow"))
+		}
+	}
+
+	// 允许的主机继续检查请求体大小
+	if rec := proxy(http.MethodPost, "https://api.example.com/x", "123456789"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: status = %d, want 413", rec.Code)
+	}
+}
@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/zjyl1994/donggua-proxy/config"
+	"github.com/zjyl1994/donggua-proxy/utils"
+)
+
+const (
+	// maxRetryBackoff 单次重试等待时间上限，上游 Retry-After 超过该值时不再重试
+	maxRetryBackoff = 5 * time.Second
+	// retryBudgetReserve 预算的初始额度，保证低流量时也能重试
+	retryBudgetReserve = 10
+	// retryBudgetMax 预算最多累积的额度
+	retryBudgetMax = 100
+)
+
+var upstreamRetry = newUpstreamRetrier(
+	config.UpstreamRetries,
+	config.UpstreamRetryStatus,
+	config.UpstreamRetryBackoff,
+	config.UpstreamRetryBudgetPercent,
+)
+
+// retryBudget 限制重试占请求总数的比例，防止上游故障时重试放大流量
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	tokens float64
+}
+
+// deposit 每个新请求按比例增加额度
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+b.ratio, retryBudgetMax)
+}
+
+// withdraw 每次重试消耗一个额度，额度不足时返回 false
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// upstreamRetrier 对幂等的上游请求 (GET/HEAD) 在连接错误或指定状态码时退避重试
+type upstreamRetrier struct {
+	retries  int
+	statuses map[int]bool
+	backoff  time.Duration
+	budget   *retryBudget
+}
+
+func newUpstreamRetrier(retries int, statuses string, backoff time.Duration, budgetPercent int) *upstreamRetrier {
+	rt := &upstreamRetrier{
+		retries:  max(retries, 0),
+		statuses: make(map[int]bool),
+		backoff:  max(backoff, 0),
+		budget:   &retryBudget{ratio: float64(budgetPercent) / 100, tokens: retryBudgetReserve},
+	}
+	for _, s := range utils.SplitList(statuses) {
+		code, err := strconv.Atoi(s)
+		if err != nil {
+			log.Printf("[WARN] invalid retry status %q", s)
+			continue
+		}
+		rt.statuses[code] = true
+	}
+	return rt
+}
+
+// idempotent 判断请求是否可以安全地重新发送
+func (rt *upstreamRetrier) idempotent(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// do 发送请求，必要时重试；成功的 200 响应在上游支持 Range 时可以断点续传
+func (rt *upstreamRetrier) do(req *http.Request) (*http.Response, error) {
+	if rt.retries == 0 || !rt.idempotent(req) {
+		return utils.DefaultClient.Do(req)
+	}
+	rt.budget.deposit()
+
+	for attempt := 0; ; attempt++ {
+		resp, err := utils.DefaultClient.Do(req)
+		wait, retry := rt.shouldRetry(req, resp, err, attempt)
+		if !retry {
+			if err == nil {
+				rt.wrapResumable(req, resp)
+			}
+			return resp, err
+		}
+
+		reason := fmt.Sprint(err)
+		if resp != nil {
+			reason = resp.Status
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+		log.Printf("[WARN] retry %s %s (attempt %d, %s): %s", req.Method, req.URL.Redacted(), attempt+2, wait.Round(time.Millisecond), reason)
+		if !sleepContext(req.Context(), wait) {
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// shouldRetry 判断是否需要重试以及重试前的等待时间
+func (rt *upstreamRetrier) shouldRetry(req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, bool) {
+	if attempt >= rt.retries || req.Context().Err() != nil {
+		return 0, false
+	}
+	wait := rt.jitter(attempt)
+	if err != nil {
+		if !retryableError(err) {
+			return 0, false
+		}
+	} else {
+		if !rt.statuses[resp.StatusCode] {
+			return 0, false
+		}
+		if after, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			if after > maxRetryBackoff {
+				return 0, false
+			}
+			wait = max(wait, after)
+		}
+	}
+	if !rt.budget.withdraw() {
+		return 0, false
+	}
+	return wait, true
+}
+
+// jitter 指数退避加抖动：在 [d/2, d] 之间随机取值，d = backoff*2^attempt，不超过 maxRetryBackoff
+func (rt *upstreamRetrier) jitter(attempt int) time.Duration {
+	if rt.backoff <= 0 {
+		return 0
+	}
+	// 逐次翻倍而不是移位，重试次数很大时也不会溢出
+	d := rt.backoff
+	for i := 0; i < attempt && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, maxRetryBackoff)
+	return d/2 + rand.N(d/2+1)
+}
+
+// wrapResumable 为可续传的响应包装断点续传的 Body
+// 需要上游声明 Accept-Ranges 并提供校验值，且内容未被 Transport 透明解压
+func (rt *upstreamRetrier) wrapResumable(req *http.Request, resp *http.Response) {
+	if req.Method != http.MethodGet || resp.StatusCode != http.StatusOK || resp.Uncompressed {
+		return
+	}
+	if req.Header.Get("Range") != "" || !strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes") {
+		return
+	}
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	if validator == "" {
+		return
+	}
+	resp.Body = &resumableBody{rt: rt, req: req, body: resp.Body, validator: validator}
+}
+
+// resumableBody 读取中断时使用 Range 从断点继续读取
+type resumableBody struct {
+	rt        *upstreamRetrier
+	req       *http.Request
+	body      io.ReadCloser
+	validator string
+	read      int64
+	resumes   int
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	for {
+		n, err := b.body.Read(p)
+		b.read += int64(n)
+		if err == nil || err == io.EOF || !retryableError(err) {
+			return n, err
+		}
+		if !b.resume(err) {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume 重新请求剩余部分，成功时替换 Body
+func (b *resumableBody) resume(cause error) bool {
+	for b.resumes < b.rt.retries {
+		if b.req.Context().Err() != nil || !b.rt.budget.withdraw() {
+			return false
+		}
+		wait := b.rt.jitter(b.resumes)
+		b.resumes++
+		log.Printf("[WARN] resume %s at byte %d (%s): %v", b.req.URL.Redacted(), b.read, wait.Round(time.Millisecond), cause)
+		if !sleepContext(b.req.Context(), wait) {
+			return false
+		}
+
+		req := b.req.Clone(b.req.Context())
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.read))
+		req.Header.Set("If-Range", b.validator)
+		resp, err := utils.DefaultClient.Do(req)
+		if err != nil {
+			cause = err
+			continue
+		}
+		// 上游内容已变化或不支持 Range 时无法拼接
+		if resp.StatusCode != http.StatusPartialContent ||
+			!strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", b.read)) {
+			resp.Body.Close()
+			return false
+		}
+		b.body.Close()
+		b.body = resp.Body
+		return true
+	}
+	return false
+}
+
+func (b *resumableBody) Close() error {
+	return b.body.Close()
+}
+
+// retryableError 判断错误是否可能因重试而恢复 (超时、连接被重置或拒绝、提前断开等)
+// 地址不可达、证书错误、SSRF 策略拒绝等不会因重试而改变的错误不重试
+func retryableError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// parseRetryAfter 解析秒数或 HTTP 日期形式的 Retry-After
+func parseRetryAfter(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// sleepContext 等待指定时间，context 取消时返回 false
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryJitter(t *testing.T) {
+	tests := []struct {
+		backoff time.Duration
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{100 * time.Millisecond, 0, 50 * time.Millisecond, 100 * time.Millisecond},
+		{100 * time.Millisecond, 2, 200 * time.Millisecond, 400 * time.Millisecond},
+		{100 * time.Millisecond, 10, maxRetryBackoff / 2, maxRetryBackoff},
+		{100 * time.Millisecond, 70, maxRetryBackoff / 2, maxRetryBackoff},
+		{time.Hour, 1000, maxRetryBackoff / 2, maxRetryBackoff},
+		{1, 64, maxRetryBackoff / 2, maxRetryBackoff},
+		{0, 5, 0, 0},
+		{-time.Second, 5, 0, 0},
+	}
+	for _, tt := range tests {
+		rt := newUpstreamRetrier(1000, "", tt.backoff, 10)
+		for i := 0; i < 100; i++ {
+			if d := rt.jitter(tt.attempt); d < tt.min || d > tt.max {
+				t.Fatalf("jitter(backoff=%s, attempt=%d) = %s, want [%s, %s]", tt.backoff, tt.attempt, d, tt.min, tt.max)
+			}
+		}
+	}
+}
+
+// timeoutError 模拟实现了 net.Error 的超时错误
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryableError(t *testing.T) {
+	opErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{io.ErrUnexpectedEOF, true},
+		{fmt.Errorf("read: %w", io.EOF), true},
+		{opErr(syscall.ECONNRESET), true},
+		{opErr(syscall.ECONNREFUSED), true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, true},
+		{&net.DNSError{Err: "timeout", IsTimeout: true}, true},
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{opErr(syscall.EHOSTUNREACH), false},
+		{opErr(syscall.ENETUNREACH), false},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("address blocked by policy")}, false},
+		{x509.UnknownAuthorityError{}, false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+	}
+	for _, tt := range tests {
+		if got := retryableError(tt.err); got != tt.want {
+			t.Errorf("retryableError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := &retryBudget{ratio: 0.25}
+	if b.withdraw() {
+		t.Fatal("empty budget allowed a retry")
+	}
+	// 每 4 个请求积累一次重试额度
+	for i := 0; i < 4; i++ {
+		b.deposit()
+	}
+	if !b.withdraw() {
+		t.Fatal("budget should allow one retry after 4 requests")
+	}
+	if b.withdraw() {
+		t.Fatal("budget allowed more retries than deposited")
+	}
+
+	b = &retryBudget{ratio: 1}
+	for i := 0; i < 2*retryBudgetMax; i++ {
+		b.deposit()
+	}
+	if b.tokens != retryBudgetMax {
+		t.Fatalf("tokens = %v, want capped at %d", b.tokens, retryBudgetMax)
+	}
+}
+
+func TestUpstreamRetrierDo(t *testing.T) {
+	allowLoopback(t)
+	tests := []struct {
+		name       string
+		method     string
+		body       io.Reader
+		failures   int
+		retryAfter string
+		budget     float64
+		wantStatus int
+		wantHits   int32
+	}{
+		{name: "retries until success", method: http.MethodGet, failures: 2, budget: 10, wantStatus: http.StatusOK, wantHits: 3},
+		{name: "gives up after retries", method: http.MethodGet, failures: 5, budget: 10, wantStatus: http.StatusServiceUnavailable, wantHits: 4},
+		{name: "head is retried", method: http.MethodHead, failures: 1, budget: 10, wantStatus: http.StatusOK, wantHits: 2},
+		{name: "post is not retried", method: http.MethodPost, failures: 1, budget: 10, wantStatus: http.StatusServiceUnavailable, wantHits: 1},
+		{name: "get with body is not retried", method: http.MethodGet, body: strings.NewReader("x"), failures: 1, budget: 10, wantStatus: http.StatusServiceUnavailable, wantHits: 1},
+		{name: "exhausted budget", method: http.MethodGet, failures: 1, budget: 0, wantStatus: http.StatusServiceUnavailable, wantHits: 1},
+		{name: "budget limits retries", method: http.MethodGet, failures: 5, budget: 1, wantStatus: http.StatusServiceUnavailable, wantHits: 2},
+		{name: "long retry-after", method: http.MethodGet, failures: 1, retryAfter: "60", budget: 10, wantStatus: http.StatusServiceUnavailable, wantHits: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if hits.Add(1) <= int32(tt.failures) {
+					if tt.retryAfter != "" {
+						w.Header().Set("Retry-After", tt.retryAfter)
+					}
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.Write([]byte("ok"))
+			}))
+			defer upstream.Close()
+
+			rt := newUpstreamRetrier(3, "502,503", 0, 0)
+			rt.budget.tokens = tt.budget
+			req, _ := http.NewRequest(tt.method, upstream.URL, tt.body)
+			resp, err := rt.do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus || hits.Load() != tt.wantHits {
+				t.Fatalf("got %d after %d requests, want %d after %d", resp.StatusCode, hits.Load(), tt.wantStatus, tt.wantHits)
+			}
+		})
+	}
+}
+
+// cutServer 第一次响应只发送前 cut 个字节就断开连接，之后按 Range 请求返回剩余部分
+// changed 为 true 时模拟内容在两次请求之间发生变化
+func cutServer(t *testing.T, data []byte, cut int, changed bool) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	const etag = `"v1"`
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nAccept-Ranges: bytes\r\nETag: %s\r\n\r\n", len(data), etag)
+			buf.Write(data[:cut])
+			buf.Flush()
+			return
+		}
+
+		w.Header().Set("Accept-Ranges", "bytes")
+		if changed {
+			w.Header().Set("ETag", `"v2"`)
+		} else {
+			w.Header().Set("ETag", etag)
+		}
+		// If-Range 与当前校验值不一致时返回完整内容
+		var start int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start); err != nil || r.Header.Get("If-Range") != w.Header().Get("ETag") {
+			w.Write(data)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)-start))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[start:])
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestResumableBody(t *testing.T) {
+	allowLoopback(t)
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+
+	srv, hits := cutServer(t, data, 30000, false)
+	rt := newUpstreamRetrier(2, "", 0, 10)
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	resp, err := rt.do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := resp.Body.(*resumableBody); !ok {
+		t.Fatalf("body %T is not resumable", resp.Body)
+	}
+	got, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) || hits.Load() != 2 {
+		t.Fatalf("read %d bytes in %d requests, want %d in 2", len(got), hits.Load(), len(data))
+	}
+
+	// 内容已变化时上游返回 200，不能拼接，读取以原错误结束
+	srv, hits = cutServer(t, data, 30000, true)
+	req, _ = http.NewRequest(http.MethodGet, srv.URL, nil)
+	resp, err = rt.do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !errors.Is(err, io.ErrUnexpectedEOF) || len(got) != 30000 || hits.Load() != 2 {
+		t.Fatalf("read %d bytes in %d requests, err %v; want 30000 bytes in 2 requests and ErrUnexpectedEOF", len(got), hits.Load(), err)
+	}
+}
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zjyl1994/donggua-proxy/cache"
+	"github.com/zjyl1994/donggua-proxy/config"
+	"github.com/zjyl1994/donggua-proxy/utils"
+)
+
+// segmentCache 为 nil 时表示未开启磁盘分片缓存
+var segmentCache = newSegmentDiskCache(
+	config.SegmentCacheDir,
+	int64(config.SegmentCacheMB)*1024*1024,
+	config.SegmentCacheTTL,
+	utils.SplitList(config.SegmentCacheStripParams),
+)
+
+// segmentDiskCache 多个观众共享的 HLS 分片磁盘缓存
+type segmentDiskCache struct {
+	store       *cache.DiskCache
+	fallbackTTL time.Duration
+	maxObject   int64
+	stripAll    bool
+	stripParams map[string]bool
+}
+
+func newSegmentDiskCache(dir string, maxBytes int64, fallbackTTL time.Duration, stripParams []string) *segmentDiskCache {
+	if dir == "" || maxBytes <= 0 {
+		return nil
+	}
+	store, err := cache.OpenDiskCache(dir, maxBytes)
+	if err != nil {
+		log.Printf("[ERROR] segment cache disabled: %v", err)
+		return nil
+	}
+	c := &segmentDiskCache{
+		store:       store,
+		fallbackTTL: fallbackTTL,
+		// 单个对象最多占用缓存的 1/8
+		maxObject:   maxBytes / 8,
+		stripParams: make(map[string]bool),
+	}
+	for _, p := range stripParams {
+		if p == "*" {
+			c.stripAll = true
+		}
+		c.stripParams[p] = true
+	}
+	return c
+}
+
+// key 规范化分片地址：去掉 fragment 和配置的查询参数 (如带时效的签名)，并对剩余参数排序
+func (c *segmentDiskCache) key(target *url.URL) string {
+	u := *target
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	u.RawFragment = ""
+	if c.stripAll {
+		u.RawQuery = ""
+	} else {
+		query := u.Query()
+		for p := range c.stripParams {
+			query.Del(p)
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// serve 使用缓存对象响应请求，支持 Range 与条件请求
+// 返回 false 表示未命中，调用者应继续请求上游
+func (c *segmentDiskCache) serve(w http.ResponseWriter, r *http.Request, target *url.URL) bool {
+	f, meta, ok := c.store.Open(c.key(target))
+	if !ok {
+		return false
+	}
+	defer f.Close()
+
+	utils.CopyHeaders(w, meta.Header)
+	w.Header().Set("Age", strconv.FormatInt(int64(time.Since(meta.Stored).Seconds()), 10))
+	var modTime time.Time
+	if lm := meta.Header.Get("Last-Modified"); lm != "" {
+		modTime, _ = http.ParseTime(lm)
+	}
+	http.ServeContent(w, r, "", modTime, f)
+	return true
+}
+
+// begin 判断上游响应是否可缓存，可缓存时返回写入器，需在复制结束后调用 finish
+func (c *segmentDiskCache) begin(r *http.Request, target *url.URL, resp *http.Response) *segmentCacheWriter {
+	if r.Method != http.MethodGet || r.Header.Get("Range") != "" || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	if !isMediaSegment(target, resp.Header.Get("Content-Type")) {
+		return nil
+	}
+	if resp.ContentLength > c.maxObject {
+		return nil
+	}
+	now := time.Now()
+	ttl, ok := cache.Freshness(resp.Header, now, c.fallbackTTL)
+	if !ok {
+		return nil
+	}
+
+	key := c.key(target)
+	dw, err := c.store.Create(key)
+	if err != nil {
+		utils.LogError(r, err)
+		return nil
+	}
+	return &segmentCacheWriter{
+		cache:    c,
+		writer:   dw,
+		expected: resp.ContentLength,
+		meta: &cache.Meta{
+			URL:     key,
+			Header:  cacheableHeader(resp.Header),
+			Stored:  now,
+			Expires: now.Add(ttl),
+		},
+	}
+}
+
+// segmentCacheWriter 在透传响应体的同时写入缓存，写入失败不影响客户端
+type segmentCacheWriter struct {
+	cache    *segmentDiskCache
+	writer   *cache.DiskWriter
+	expected int64
+	meta     *cache.Meta
+}
+
+func (sw *segmentCacheWriter) Write(p []byte) (int, error) {
+	if sw.writer.Size()+int64(len(p)) > sw.cache.maxObject {
+		// 超出单对象上限后不再缓存，finish 时丢弃
+		sw.expected = -2
+		return len(p), nil
+	}
+	return sw.writer.Write(p)
+}
+
+// finish 在完整读取上游响应后提交缓存，否则丢弃
+func (sw *segmentCacheWriter) finish(r *http.Request, copyErr error) {
+	if copyErr != nil || sw.expected == -2 || (sw.expected >= 0 && sw.writer.Size() != sw.expected) {
+		sw.writer.Abort()
+		return
+	}
+	if err := sw.writer.Commit(sw.meta); err != nil {
+		utils.LogError(r, err)
+	}
+}
+
+// isMediaSegment 根据 Content-Type 和扩展名判断是否为媒体分片
+func isMediaSegment(target *url.URL, contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch strings.ToLower(mediaType) {
+	case "video/mp2t", "video/iso.segment", "video/mp4", "audio/mp4", "audio/aac", "audio/mpeg":
+		return true
+	case "", "application/octet-stream", "binary/octet-stream":
+		switch strings.ToLower(path.Ext(target.Path)) {
+		case ".ts", ".m4s", ".m4v", ".m4a", ".mp4", ".aac", ".cmfv", ".cmfa":
+			return true
+		}
+	}
+	return false
+}
+
+// uncacheableHeaders 不随缓存保存的响应头，Set-Cookie 等属于单个用户，不能回放给其他人
+var uncacheableHeaders = map[string]bool{
+	"content-length": true,
+	"age":            true,
+	"set-cookie":     true,
+	"set-cookie2":    true,
+}
+
+// cacheableHeader 复制需要随缓存保存的响应头，去掉逐跳头、长度和 Cookie
+func cacheableHeader(src http.Header) http.Header {
+	header := make(http.Header)
+	for k, vv := range src {
+		if lk := strings.ToLower(k); utils.DefaultExcludedResponseHeaders[lk] || uncacheableHeaders[lk] {
+			continue
+		}
+		header[k] = append([]string(nil), vv...)
+	}
+	return header
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCacheableHeader(t *testing.T) {
+	src := http.Header{
+		"Content-Type":   {"video/mp2t"},
+		"Etag":           {`"v1"`},
+		"Content-Length": {"100"},
+		"Age":            {"5"},
+		"Connection":     {"keep-alive"},
+		"Set-Cookie":     {"session=secret"},
+		"Set-Cookie2":    {"legacy=secret"},
+	}
+	got := cacheableHeader(src)
+	for _, k := range []string{"Content-Length", "Age", "Connection", "Set-Cookie", "Set-Cookie2"} {
+		if v := got.Get(k); v != "" {
+			t.Errorf("%s = %q, want dropped", k, v)
+		}
+	}
+	if got.Get("Content-Type") != "video/mp2t" || got.Get("Etag") != `"v1"` {
+		t.Errorf("cacheable headers lost: %v", got)
+	}
+}
+
+func TestSegmentCacheBegin(t *testing.T) {
+	c := newSegmentDiskCache(t.TempDir(), 1<<20, time.Minute, nil)
+	target, _ := url.Parse("https://cdn.example/seg0.ts")
+	tests := []struct {
+		name   string
+		header http.Header
+		want   bool
+	}{
+		{"cacheable", http.Header{"Cache-Control": {"max-age=60"}}, true},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, false},
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, false},
+		{"vary star", http.Header{"Vary": {"*"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.header.Set("Content-Type", "video/mp2t")
+			resp := &http.Response{StatusCode: http.StatusOK, Header: tt.header, ContentLength: -1}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			sw := c.begin(r, target, resp)
+			if (sw != nil) != tt.want {
+				t.Fatalf("begin() = %v, want cacheable %v", sw, tt.want)
+			}
+			if sw != nil {
+				sw.writer.Abort()
+			}
+		})
+	}
+}
+
+func TestSegmentCacheRoundTrip(t *testing.T) {
+	c := newSegmentDiskCache(t.TempDir(), 1<<20, time.Minute, []string{"token"})
+	target, _ := url.Parse("https://cdn.example/seg0.ts?token=a&q=1")
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ContentLength: 10,
+		Header: http.Header{
+			"Content-Type": {"video/mp2t"},
+			"Set-Cookie":   {"session=secret"},
+		},
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// 长度不符的响应不会提交
+	sw := c.begin(r, target, resp)
+	sw.Write([]byte("short"))
+	sw.finish(r, nil)
+	if c.serve(httptest.NewRecorder(), r, target) {
+		t.Fatal("truncated body was cached")
+	}
+	sw = c.begin(r, target, resp)
+	sw.Write([]byte("0123456789"))
+	sw.finish(r, errors.New("connection reset"))
+	if c.serve(httptest.NewRecorder(), r, target) {
+		t.Fatal("failed copy was cached")
+	}
+
+	sw = c.begin(r, target, resp)
+	sw.Write([]byte("0123456789"))
+	sw.finish(r, nil)
+
+	// 签名参数不同的地址命中同一个缓存对象
+	other, _ := url.Parse("https://cdn.example/seg0.ts?q=1&token=b")
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Range", "bytes=2-4")
+	w := httptest.NewRecorder()
+	if !c.serve(w, r, other) {
+		t.Fatal("cache miss")
+	}
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+		t.Errorf("got %d %q, want 206 \"234\"", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Set-Cookie") != "" {
+		t.Errorf("Set-Cookie replayed: %q", w.Header().Get("Set-Cookie"))
+	}
+	if w.Header().Get("Age") == "" {
+		t.Error("missing Age header")
+	}
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// streamWriter 媒体透传使用的 ResponseWriter
+// 服务器的 WriteTimeout 按整个响应计算，会截断大文件与长时间的渐进式播放。
+// streamWriter 在持续写出数据时不断延后写超时，只有 idle 内没有写出任何数据才超时；
+// 同时在上游 idle 内没有数据时通过 cancel 中止上游请求
+type streamWriter struct {
+	http.ResponseWriter
+	rc       *http.ResponseController
+	idle     time.Duration
+	extended time.Time
+	timer    *time.Timer
+	expired  atomic.Bool
+}
+
+// newStreamWriter 创建 streamWriter，idle 为 0 时沿用服务器的 WriteTimeout
+// cancel 可以为 nil (如直接从缓存返回)
+func newStreamWriter(w http.ResponseWriter, idle time.Duration, cancel context.CancelFunc) *streamWriter {
+	sw := &streamWriter{ResponseWriter: w, rc: http.NewResponseController(w), idle: idle}
+	if idle <= 0 {
+		return sw
+	}
+	if cancel != nil {
+		sw.timer = time.AfterFunc(idle, func() {
+			sw.expired.Store(true)
+			cancel()
+		})
+	}
+	sw.extend()
+	return sw
+}
+
+// extend 延后写超时，最多每 idle/10 (不超过 1 秒) 更新一次
+func (sw *streamWriter) extend() {
+	if sw.idle <= 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(sw.extended) < min(sw.idle/10, time.Second) {
+		return
+	}
+	sw.extended = now
+	// HTTP/1 与 HTTP/2 均支持，不支持时保留服务器的 WriteTimeout
+	_ = sw.rc.SetWriteDeadline(now.Add(sw.idle))
+	if sw.timer != nil {
+		sw.timer.Reset(sw.idle)
+	}
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	sw.extend()
+	return sw.ResponseWriter.Write(p)
+}
+
+// Unwrap 供 http.ResponseController 访问底层的 ResponseWriter
+func (sw *streamWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// idleExpired 是否因上游长时间没有数据而中止
+func (sw *streamWriter) idleExpired() bool {
+	return sw.expired.Load()
+}
+
+// stop 停止空闲计时
+func (sw *streamWriter) stop() {
+	if sw.timer != nil {
+		sw.timer.Stop()
+	}
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamWriterIdleCancel(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sw := newStreamWriter(httptest.NewRecorder(), idle, cancel)
+	defer sw.stop()
+
+	// 持续写出数据时空闲计时不断延后，总时长超过 idle 也不中止
+	for i := 0; i < 10; i++ {
+		sw.Write([]byte("x"))
+		time.Sleep(idle / 4)
+	}
+	if ctx.Err() != nil || sw.idleExpired() {
+		t.Fatal("stream cancelled while data was flowing")
+	}
+
+	// 停止写出后 idle 内中止上游请求
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * idle):
+		t.Fatal("stalled stream was not cancelled")
+	}
+	if !sw.idleExpired() {
+		t.Fatal("idleExpired() = false after the idle timeout")
+	}
+
+	// stop 之后不再中止
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	sw = newStreamWriter(httptest.NewRecorder(), idle, cancel)
+	sw.stop()
+	time.Sleep(2 * idle)
+	if ctx.Err() != nil || sw.idleExpired() {
+		t.Fatal("stopped stream was cancelled")
+	}
+}
+
+func TestStreamWriterWriteDeadline(t *testing.T) {
+	const writeTimeout = 100 * time.Millisecond
+	writeErr := make(chan error, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := newStreamWriter(w, 2*writeTimeout, nil)
+		rc := http.NewResponseController(sw)
+		write := func() error {
+			if _, err := io.WriteString(sw, "chunk\n"); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+		if r.URL.Path == "/flow" {
+			// 总时长远超 WriteTimeout，但数据持续流动，写超时随之延后
+			for i := 0; i < 8; i++ {
+				if err := write(); err != nil {
+					writeErr <- err
+					return
+				}
+				time.Sleep(writeTimeout / 2)
+			}
+			writeErr <- nil
+			return
+		}
+		// 客户端停止读取后写入阻塞，超过 idle 没有进展时写超时生效
+		chunk := strings.Repeat("x", 64*1024)
+		for {
+			if _, err := io.WriteString(sw, chunk); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+	}))
+	srv.Config.WriteTimeout = writeTimeout
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/flow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || strings.Count(string(body), "chunk") != 8 {
+		t.Fatalf("flow: read %q, %v", body, err)
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatalf("flow: handler write failed: %v", err)
+	}
+
+	resp, err = http.Get(srv.URL + "/stall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	select {
+	case err := <-writeErr:
+		if err == nil {
+			t.Fatal("stall: handler write did not fail")
+		}
+	case <-time.After(20 * writeTimeout):
+		t.Fatal("stall: write deadline did not fire")
+	}
+}
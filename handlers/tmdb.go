@@ -1,11 +1,13 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/zjyl1994/donggua-proxy/utils"
 )
@@ -77,7 +79,11 @@ func TmdbImageHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func proxyTMDB(w http.ResponseWriter, r *http.Request, targetURL string, isImage bool) {
-	req, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL, nil)
+	// 超出传输时间限制时通过 cancel 中止上游请求
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, r.Method, targetURL, nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -89,13 +95,27 @@ func proxyTMDB(w http.ResponseWriter, r *http.Request, targetURL string, isImage
 		req.Header.Set("Accept", "*/*")
 	}
 
-	resp, err := utils.DefaultClient.Do(req)
+	resp, err := upstreamRetry.do(req)
 	if err != nil {
 		utils.LogError(r, fmt.Errorf("tmdb request failed: %w", err))
 		http.Error(w, "Bad Gateway", http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
+	if err := decodeResponseBody(resp); err != nil {
+		utils.LogError(r, fmt.Errorf("tmdb response: %w", err))
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	class := classTMDBJSON
+	if isImage {
+		class = classImage
+	}
+	if err := limitResponse(resp, class, start, cancel); err != nil {
+		utils.LogError(r, fmt.Errorf("tmdb response: %w", err))
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
 
 	utils.CopyHeadersWithFilter(w, resp.Header, utils.DefaultExcludedResponseHeaders)
 
@@ -107,12 +127,20 @@ func proxyTMDB(w http.ResponseWriter, r *http.Request, targetURL string, isImage
 		}
 	}
 
+	// 图片本身已压缩，只压缩 JSON
+	var dst io.Writer = w
+	if !isImage {
+		cw := newCompressWriter(w, r)
+		defer cw.Close()
+		dst = cw
+	}
 	w.WriteHeader(resp.StatusCode)
 
 	// 使用 BufferPool 优化 IO 复制
 	bufPtr := utils.BufferPool.Get().(*[]byte)
 	defer utils.BufferPool.Put(bufPtr)
-	if _, err := io.CopyBuffer(w, resp.Body, *bufPtr); err != nil {
+	if _, err := io.CopyBuffer(dst, resp.Body, *bufPtr); err != nil {
 		utils.LogError(r, fmt.Errorf("copy response failed: %w", err))
+		abortOnTransferLimit(err)
 	}
 }
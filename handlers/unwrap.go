@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+)
+
+const (
+	tsPacketSize = 188
+	// unwrapPeekSize 查找 TS 同步字节的范围，伪装头通常只有几 KB
+	unwrapPeekSize = 64 * 1024
+	// unwrapSyncCount 连续多少个同步字节才认为找到了 TS 数据
+	unwrapSyncCount = 5
+)
+
+// segmentParam 改写媒体播放列表时附加在分片地址上的参数，标记该地址是播放列表中的分片
+const segmentParam = "seg"
+
+// shouldUnwrap 判断响应是否可能是伪装的分片：
+// 按扩展名或内容类型识别为媒体分片，或者是媒体播放列表中引用的分片地址 (listed)。
+// 其他图片与文件即使内容中恰好出现同步字节也原样透传
+func shouldUnwrap(listed bool, class contentClass) bool {
+	return class == classSegment || listed
+}
+
+// listedSegment 判断代理请求的地址是否来自媒体播放列表中的分片
+func listedSegment(r *http.Request) bool {
+	return r.URL.Query().Get(segmentParam) == "1"
+}
+
+// imageSignatures 常见图片文件头
+var imageSignatures = [][]byte{
+	{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'},
+	[]byte("GIF87a"),
+	[]byte("GIF89a"),
+	{0xff, 0xd8, 0xff},
+	[]byte("BM"),
+}
+
+// unwrapDisguisedSegment 处理伪装成图片的 TS 分片
+// 响应体以图片文件头开始、其后出现 MPEG-TS 同步字节 (每 188 字节一个 0x47) 时，
+// 去掉前缀并改为 video/mp2t。返回 true 表示已处理
+func unwrapDisguisedSegment(resp *http.Response) bool {
+	br := bufio.NewReaderSize(resp.Body, unwrapPeekSize)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, resp.Body}
+
+	head, _ := br.Peek(8)
+	if !hasImageSignature(head) {
+		return false
+	}
+
+	buf, _ := br.Peek(unwrapPeekSize)
+	offset := findTSSync(buf)
+	if offset <= 0 {
+		return false
+	}
+	if _, err := br.Discard(offset); err != nil {
+		return false
+	}
+
+	resp.Header.Set("Content-Type", "video/mp2t")
+	for _, h := range []string{"Content-Length", "Content-Range", "Accept-Ranges", "ETag"} {
+		resp.Header.Del(h)
+	}
+	resp.ContentLength = -1
+	return true
+}
+
+func hasImageSignature(head []byte) bool {
+	for _, sig := range imageSignatures {
+		if bytes.HasPrefix(head, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// findTSSync 返回第一个满足连续同步字节条件的偏移，找不到返回 -1
+func findTSSync(buf []byte) int {
+	for offset := 1; offset+tsPacketSize*(unwrapSyncCount-1) < len(buf); offset++ {
+		if buf[offset] != 0x47 {
+			continue
+		}
+		matched := true
+		for i := 1; i < unwrapSyncCount; i++ {
+			if buf[offset+i*tsPacketSize] != 0x47 {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return offset
+		}
+	}
+	return -1
+}
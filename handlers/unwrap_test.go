@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// tsPackets 生成 n 个以同步字节开头的 TS 包
+func tsPackets(n int) []byte {
+	data := make([]byte, n*tsPacketSize)
+	for i := 0; i < n; i++ {
+		data[i*tsPacketSize] = 0x47
+	}
+	return data
+}
+
+func TestShouldUnwrap(t *testing.T) {
+	tests := []struct {
+		target      string
+		query       string
+		contentType string
+		want        bool
+	}{
+		{"https://a/seg0.ts", "", "image/png", true},
+		{"https://a/seg0.png", "", "video/mp2t", true},
+		{"https://a/seg0.png", segmentParam + "=1", "image/png", true},
+		{"https://a/poster.png", "", "image/png", false},
+		{"https://a/file.bin", "", "application/octet-stream", false},
+	}
+	for _, tt := range tests {
+		target, _ := url.Parse(tt.target)
+		r := httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil)
+		class := classifyProxyResponse(target, tt.contentType, false)
+		if got := shouldUnwrap(listedSegment(r), class); got != tt.want {
+			t.Errorf("shouldUnwrap(%s, %s) = %v, want %v", tt.target, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestUnwrapDisguisedSegment(t *testing.T) {
+	png := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0, 0, 0, 0}
+	tests := []struct {
+		name   string
+		body   []byte
+		want   bool
+		offset int
+	}{
+		{"disguised", append(append([]byte(nil), png...), tsPackets(10)...), true, len(png)},
+		{"plain ts", tsPackets(10), false, 0},
+		{"image without ts", append(append([]byte(nil), png...), bytes.Repeat([]byte{1}, 4096)...), false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				Header:        http.Header{"Content-Type": {"image/png"}, "Content-Length": {"1"}},
+				Body:          io.NopCloser(bytes.NewReader(tt.body)),
+				ContentLength: int64(len(tt.body)),
+			}
+			if got := unwrapDisguisedSegment(resp); got != tt.want {
+				t.Fatalf("unwrapDisguisedSegment() = %v, want %v", got, tt.want)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if !bytes.Equal(body, tt.body[tt.offset:]) {
+				t.Fatalf("body has %d bytes, want %d", len(body), len(tt.body)-tt.offset)
+			}
+			if tt.want && (resp.Header.Get("Content-Type") != "video/mp2t" || resp.Header.Get("Content-Length") != "") {
+				t.Fatalf("headers not updated: %v", resp.Header)
+			}
+		})
+	}
+}
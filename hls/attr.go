@@ -0,0 +1,123 @@
+package hls
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Attr 属性列表中的一项，保留原始键名大小写与引号形式
+type Attr struct {
+	Key    string
+	Value  string
+	Quoted bool
+}
+
+// AttrList 标签的属性列表，如 METHOD=AES-128,URI="key.bin"
+type AttrList []Attr
+
+// ParseAttrList 解析属性列表，引号内的逗号不作为分隔符
+func ParseAttrList(s string) (AttrList, error) {
+	var attrs AttrList
+	i := 0
+	for i < len(s) {
+		// 跳过分隔符和空白
+		for i < len(s) && (s[i] == ',' || s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
+		if i >= len(s) {
+			break
+		}
+
+		eq := strings.IndexByte(s[i:], '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("attribute without value at offset %d", i)
+		}
+		key := strings.TrimSpace(s[i : i+eq])
+		if key == "" || strings.ContainsAny(key, `,"`) {
+			return nil, fmt.Errorf("invalid attribute name %q", key)
+		}
+		i += eq + 1
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+
+		attr := Attr{Key: key}
+		if i < len(s) && s[i] == '"' {
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted string for %s", key)
+			}
+			attr.Value = s[i+1 : i+1+end]
+			attr.Quoted = true
+			i += end + 2
+			// 引号后只允许出现空白和逗号
+			for i < len(s) && s[i] == ' ' {
+				i++
+			}
+			if i < len(s) && s[i] != ',' {
+				return nil, fmt.Errorf("unexpected character after quoted value of %s", key)
+			}
+		} else {
+			end := strings.IndexByte(s[i:], ',')
+			if end < 0 {
+				end = len(s) - i
+			}
+			attr.Value = strings.TrimSpace(s[i : i+end])
+			i += end
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs, nil
+}
+
+// Get 按键名 (不区分大小写) 获取属性值
+func (a AttrList) Get(key string) (string, bool) {
+	for _, attr := range a {
+		if strings.EqualFold(attr.Key, key) {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+// Set 修改已有属性的值，不存在时以带引号的形式追加
+func (a *AttrList) Set(key, value string) {
+	for i := range *a {
+		if strings.EqualFold((*a)[i].Key, key) {
+			(*a)[i].Value = value
+			return
+		}
+	}
+	*a = append(*a, Attr{Key: key, Value: value, Quoted: true})
+}
+
+// Del 删除属性
+func (a *AttrList) Del(key string) {
+	out := (*a)[:0]
+	for _, attr := range *a {
+		if !strings.EqualFold(attr.Key, key) {
+			out = append(out, attr)
+		}
+	}
+	*a = out
+}
+
+// String 序列化属性列表
+func (a AttrList) String() string {
+	var b strings.Builder
+	for i, attr := range a {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(attr.Key)
+		b.WriteByte('=')
+		if attr.Quoted {
+			b.WriteByte('"')
+			b.WriteString(attr.Value)
+			b.WriteByte('"')
+		} else {
+			b.WriteString(attr.Value)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,176 @@
+package hls
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Segment 媒体播放列表中的一个分片
+type Segment struct {
+	// Seq 分片的媒体序号
+	Seq           int64
+	Duration      float64
+	Discontinuity bool
+	// Lines 分片自身的标签 (EXTINF、PROGRAM-DATE-TIME、PART 等) 与地址行，不含 KEY/MAP
+	Lines []*Line
+	// Key/Map 对该分片生效的 EXT-X-KEY 与 EXT-X-MAP，可能为 nil
+	Key *Line
+	Map *Line
+}
+
+// URI 返回分片地址
+func (s *Segment) URI() string {
+	for i := len(s.Lines) - 1; i >= 0; i-- {
+		if s.Lines[i].Type == LineURI {
+			return s.Lines[i].URI
+		}
+	}
+	return ""
+}
+
+// WithoutParts 返回去掉 LL-HLS 部分分片标签的副本，已经完整的旧分片不再需要
+func (s *Segment) WithoutParts() *Segment {
+	c := *s
+	c.Lines = make([]*Line, 0, len(s.Lines))
+	for _, l := range s.Lines {
+		if l.Type != LineTag || l.Tag != "EXT-X-PART" {
+			c.Lines = append(c.Lines, l)
+		}
+	}
+	return &c
+}
+
+// Media 按分片组织的媒体播放列表
+type Media struct {
+	// Header 首个分片之前作用于整个列表的标签，不含 MEDIA-SEQUENCE/DISCONTINUITY-SEQUENCE
+	Header []*Line
+	// Trailer 最后一个分片之后的标签，如 ENDLIST、PRELOAD-HINT、RENDITION-REPORT
+	Trailer  []*Line
+	Segments []*Segment
+
+	TargetDuration        float64
+	MediaSequence         int64
+	DiscontinuitySequence int64
+	EndList               bool
+}
+
+// playlistLevelTags 出现在首个分片之前、作用于整个列表的标签
+var playlistLevelTags = map[string]bool{
+	"EXT-X-VERSION":              true,
+	"EXT-X-TARGETDURATION":       true,
+	"EXT-X-PLAYLIST-TYPE":        true,
+	"EXT-X-INDEPENDENT-SEGMENTS": true,
+	"EXT-X-START":                true,
+	"EXT-X-SERVER-CONTROL":       true,
+	"EXT-X-PART-INF":             true,
+	"EXT-X-ALLOW-CACHE":          true,
+	"EXT-X-I-FRAMES-ONLY":        true,
+	"EXT-X-DEFINE":               true,
+}
+
+// Media 将播放列表按分片组织，主播放列表返回错误
+func (p *Playlist) Media() (*Media, error) {
+	if p.IsMaster() {
+		return nil, errors.New("not a media playlist")
+	}
+
+	m := &Media{}
+	var pending []*Line
+	var key, mapLine *Line
+	discontinuity := false
+	duration := 0.0
+	for i, l := range p.Lines {
+		if i == 0 && l.Type == LineTag && l.Tag == "EXTM3U" {
+			continue
+		}
+		switch l.Type {
+		case LineBlank, LineComment:
+			continue
+		case LineURI:
+			m.Segments = append(m.Segments, &Segment{
+				Seq:           m.MediaSequence + int64(len(m.Segments)),
+				Duration:      duration,
+				Discontinuity: discontinuity,
+				Lines:         append(pending, l),
+				Key:           key,
+				Map:           mapLine,
+			})
+			pending, discontinuity, duration = nil, false, 0
+			continue
+		}
+
+		switch l.Tag {
+		case "EXT-X-TARGETDURATION":
+			m.TargetDuration, _ = strconv.ParseFloat(strings.TrimSpace(l.Value), 64)
+			m.Header = append(m.Header, l)
+		case "EXT-X-MEDIA-SEQUENCE":
+			m.MediaSequence, _ = strconv.ParseInt(strings.TrimSpace(l.Value), 10, 64)
+		case "EXT-X-DISCONTINUITY-SEQUENCE":
+			m.DiscontinuitySequence, _ = strconv.ParseInt(strings.TrimSpace(l.Value), 10, 64)
+		case "EXT-X-ENDLIST":
+			m.EndList = true
+			pending = append(pending, l)
+		case "EXT-X-KEY":
+			if method, _ := l.Attrs.Get("METHOD"); strings.EqualFold(method, "NONE") {
+				key = nil
+			} else {
+				key = l
+			}
+		case "EXT-X-MAP":
+			mapLine = l
+		case "EXT-X-DISCONTINUITY":
+			discontinuity = true
+			pending = append(pending, l)
+		case "EXTINF":
+			durStr, _, _ := strings.Cut(l.Value, ",")
+			duration, _ = strconv.ParseFloat(strings.TrimSpace(durStr), 64)
+			pending = append(pending, l)
+		default:
+			if playlistLevelTags[l.Tag] && len(m.Segments) == 0 && len(pending) == 0 {
+				m.Header = append(m.Header, l)
+			} else {
+				pending = append(pending, l)
+			}
+		}
+	}
+	m.Trailer = pending
+	return m, nil
+}
+
+// Playlist 将分片重新组装为播放列表，在 KEY/MAP 变化处输出对应标签
+func (m *Media) Playlist() *Playlist {
+	p := &Playlist{Lines: []*Line{NewTag("EXTM3U", "")}}
+	p.Lines = append(p.Lines, m.Header...)
+	p.Lines = append(p.Lines, NewTag("EXT-X-MEDIA-SEQUENCE", strconv.FormatInt(m.MediaSequence, 10)))
+	if m.DiscontinuitySequence > 0 {
+		p.Lines = append(p.Lines, NewTag("EXT-X-DISCONTINUITY-SEQUENCE", strconv.FormatInt(m.DiscontinuitySequence, 10)))
+	}
+
+	var key, mapLine *Line
+	for _, seg := range m.Segments {
+		if !sameLine(seg.Key, key) {
+			if seg.Key == nil {
+				p.Lines = append(p.Lines, NewTag("EXT-X-KEY", "METHOD=NONE"))
+			} else {
+				p.Lines = append(p.Lines, seg.Key)
+			}
+			key = seg.Key
+		}
+		if seg.Map != nil && !sameLine(seg.Map, mapLine) {
+			p.Lines = append(p.Lines, seg.Map)
+			mapLine = seg.Map
+		}
+		p.Lines = append(p.Lines, seg.Lines...)
+	}
+	p.Lines = append(p.Lines, m.Trailer...)
+	return p
+}
+
+// sameLine 比较两行内容是否相同，来自不同次解析的相同标签视为相同
+func sameLine(a, b *Line) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a == b || a.String() == b.String()
+}
@@ -0,0 +1,263 @@
+// Package hls 实现 HLS 播放列表 (主列表与媒体列表，含 LL-HLS 标签) 的解析、修改与序列化
+package hls
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// LineType 播放列表中一行的类型
+type LineType int
+
+const (
+	LineBlank LineType = iota
+	LineComment
+	LineTag
+	LineURI
+)
+
+// Line 播放列表中的一行
+type Line struct {
+	Type LineType
+	// Raw 原始文本 (去掉换行符)，未修改的行按原样输出
+	Raw string
+	// Tag 标签名，不含 '#'，如 EXT-X-KEY
+	Tag string
+	// Value 标签冒号之后的原始文本
+	Value string
+	// Attrs 标签的属性列表，仅对使用属性列表的标签有效
+	Attrs AttrList
+	// URI 地址行的内容
+	URI string
+
+	// parsed 解析时按字段序列化的结果，字段未被修改时输出 Raw
+	parsed string
+}
+
+// attrListTags 值为属性列表的标签
+var attrListTags = map[string]bool{
+	"EXT-X-KEY":                true,
+	"EXT-X-SESSION-KEY":        true,
+	"EXT-X-MAP":                true,
+	"EXT-X-MEDIA":              true,
+	"EXT-X-STREAM-INF":         true,
+	"EXT-X-I-FRAME-STREAM-INF": true,
+	"EXT-X-SESSION-DATA":       true,
+	"EXT-X-CONTENT-STEERING":   true,
+	"EXT-X-PART":               true,
+	"EXT-X-PART-INF":           true,
+	"EXT-X-PRELOAD-HINT":       true,
+	"EXT-X-RENDITION-REPORT":   true,
+	"EXT-X-SERVER-CONTROL":     true,
+	"EXT-X-SKIP":               true,
+	"EXT-X-START":              true,
+	"EXT-X-DATERANGE":          true,
+	"EXT-X-DEFINE":             true,
+}
+
+// uriAttrs 各标签中携带地址的属性 (默认只有 URI)
+var uriAttrs = map[string][]string{
+	"EXT-X-CONTENT-STEERING": {"SERVER-URI"},
+	"EXT-X-DATERANGE":        {"X-ASSET-URI", "X-ASSET-LIST"},
+}
+
+// String 序列化一行，未修改的行按原样输出，修改过的标签按属性重新生成
+func (l *Line) String() string {
+	s := l.build()
+	if l.Raw != "" && s == l.parsed {
+		return l.Raw
+	}
+	return s
+}
+
+func (l *Line) build() string {
+	switch l.Type {
+	case LineTag:
+		if l.Attrs != nil {
+			return "#" + l.Tag + ":" + l.Attrs.String()
+		}
+		if l.Value != "" {
+			return "#" + l.Tag + ":" + l.Value
+		}
+		return "#" + l.Tag
+	case LineURI:
+		return l.URI
+	default:
+		return l.Raw
+	}
+}
+
+// URIAttrs 返回该标签中携带地址的属性名
+func (l *Line) URIAttrs() []string {
+	if l.Type != LineTag || l.Attrs == nil {
+		return nil
+	}
+	if names, ok := uriAttrs[l.Tag]; ok {
+		return names
+	}
+	return []string{"URI"}
+}
+
+// NewTag 创建标签行
+func NewTag(tag, value string) *Line {
+	l := &Line{Type: LineTag, Tag: tag, Value: value}
+	if attrListTags[tag] {
+		l.Attrs, _ = ParseAttrList(value)
+	}
+	return l
+}
+
+// ParseLine 解析单行文本
+func ParseLine(raw string) (*Line, error) {
+	l, err := parseLine(strings.TrimRight(raw, "\r"))
+	if err != nil {
+		return nil, err
+	}
+	l.parsed = l.build()
+	return l, nil
+}
+
+func parseLine(raw string) (*Line, error) {
+	trimmed := strings.TrimSpace(raw)
+	switch {
+	case trimmed == "":
+		return &Line{Type: LineBlank, Raw: raw}, nil
+	case !strings.HasPrefix(trimmed, "#"):
+		return &Line{Type: LineURI, Raw: raw, URI: trimmed}, nil
+	case !strings.HasPrefix(trimmed, "#EXT"):
+		return &Line{Type: LineComment, Raw: raw}, nil
+	}
+
+	tag, value, _ := strings.Cut(trimmed[1:], ":")
+	l := &Line{Type: LineTag, Raw: raw, Tag: tag, Value: value}
+	// 未知标签中出现 URI= 时也按属性列表处理，保证地址都能被改写
+	if attrListTags[tag] || (strings.HasPrefix(tag, "EXT-X-") && strings.Contains(strings.ToUpper(value), "URI=")) {
+		attrs, err := ParseAttrList(value)
+		switch {
+		case err == nil:
+			l.Attrs = attrs
+		case hasURIAttr(tag, value):
+			// 无法取出地址时不能透传，否则播放器会绕过代理直接访问
+			return nil, fmt.Errorf("#%s: %w", tag, err)
+		}
+		// 格式错误但不含地址的标签作为不透明的行原样保留
+	}
+	return l, nil
+}
+
+// hasURIAttr 粗略判断格式错误的属性列表中是否出现了该标签的地址属性
+func hasURIAttr(tag, value string) bool {
+	names, ok := uriAttrs[tag]
+	if !ok {
+		names = []string{"URI"}
+	}
+	for _, part := range strings.Split(value, ",") {
+		key, _, _ := strings.Cut(part, "=")
+		for _, name := range names {
+			if strings.EqualFold(strings.TrimSpace(key), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Decoder 逐行读取播放列表
+type Decoder struct {
+	scanner *bufio.Scanner
+	lineNo  int
+}
+
+// NewDecoder 创建 Decoder，单行最长 1MB
+func NewDecoder(r io.Reader) *Decoder {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	return &Decoder{scanner: scanner}
+}
+
+// Next 返回下一行，读取完毕时返回 io.EOF
+func (d *Decoder) Next() (*Line, error) {
+	if !d.scanner.Scan() {
+		if err := d.scanner.Err(); err != nil {
+			return nil, err
+		}
+		if d.lineNo == 0 {
+			return nil, errors.New("empty playlist")
+		}
+		return nil, io.EOF
+	}
+	d.lineNo++
+	text := d.scanner.Text()
+	if d.lineNo == 1 {
+		text = strings.TrimPrefix(text, "\ufeff")
+		if strings.TrimSpace(text) != "#EXTM3U" {
+			return nil, errors.New("missing #EXTM3U header")
+		}
+	}
+	l, err := ParseLine(text)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", d.lineNo, err)
+	}
+	return l, nil
+}
+
+// Playlist 完整的播放列表
+type Playlist struct {
+	Lines []*Line
+}
+
+// Parse 读取完整的播放列表
+func Parse(r io.Reader) (*Playlist, error) {
+	d := NewDecoder(r)
+	p := &Playlist{}
+	for {
+		l, err := d.Next()
+		if err == io.EOF {
+			return p, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.Lines = append(p.Lines, l)
+	}
+}
+
+// IsMaster 判断是否为主播放列表
+func (p *Playlist) IsMaster() bool {
+	for _, l := range p.Lines {
+		if l.Type == LineTag && (l.Tag == "EXT-X-STREAM-INF" || l.Tag == "EXT-X-I-FRAME-STREAM-INF") {
+			return true
+		}
+	}
+	return false
+}
+
+// RewriteURIs 对所有地址行和标签中的地址属性调用 fn，并用返回值替换
+// tag 为地址所在的标签名，地址行为空字符串
+func (p *Playlist) RewriteURIs(fn func(uri, tag string) string) {
+	for _, l := range p.Lines {
+		switch l.Type {
+		case LineURI:
+			l.URI = fn(l.URI, "")
+		case LineTag:
+			for _, name := range l.URIAttrs() {
+				if uri, ok := l.Attrs.Get(name); ok && uri != "" {
+					l.Attrs.Set(name, fn(uri, l.Tag))
+				}
+			}
+		}
+	}
+}
+
+// Encode 序列化播放列表
+func (p *Playlist) Encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, l := range p.Lines {
+		bw.WriteString(l.String())
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
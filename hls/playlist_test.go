@@ -0,0 +1,252 @@
+package hls
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+		types   []LineType
+	}{
+		{
+			name:  "media",
+			input: "#EXTM3U\n#EXT-X-TARGETDURATION:10\n\n# comment\n#EXTINF:9.5,\nseg0.ts\n",
+			types: []LineType{LineTag, LineTag, LineBlank, LineComment, LineTag, LineURI},
+		},
+		{
+			name:  "bom and crlf",
+			input: "\ufeff#EXTM3U\r\n#EXTINF:4,\r\nseg0.ts\r\n",
+			types: []LineType{LineTag, LineTag, LineURI},
+		},
+		{
+			name:  "quoted comma in attribute",
+			input: "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"k?a=1,b=2\",IV=0x01\n",
+			types: []LineType{LineTag, LineTag},
+		},
+		{
+			name:  "unknown tag with uri",
+			input: "#EXTM3U\n#EXT-X-FOO:URI=\"x.bin\"\n",
+			types: []LineType{LineTag, LineTag},
+		},
+		{
+			name:  "malformed attributes without uri",
+			input: "#EXTM3U\n#EXT-X-MEDIA:TYPE=AUDIO,NAME=\"en\n#EXT-X-SERVER-CONTROL:CAN-SKIP-UNTIL\n",
+			types: []LineType{LineTag, LineTag, LineTag},
+		},
+		{name: "empty", input: "", wantErr: "empty playlist"},
+		{name: "missing header", input: "#EXTINF:4,\nseg0.ts\n", wantErr: "missing #EXTM3U header"},
+		{name: "html", input: "<html></html>\n", wantErr: "missing #EXTM3U header"},
+		{name: "unterminated quote", input: "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\n", wantErr: "line 2: #EXT-X-KEY: unterminated quoted string"},
+		{name: "attribute without value", input: "#EXTM3U\n#EXT-X-MAP:URI\n", wantErr: "line 2: #EXT-X-MAP: attribute without value"},
+		{name: "malformed daterange uri", input: "#EXTM3U\n#EXT-X-DATERANGE:ID=\"ad,X-ASSET-URI=a.m3u8\n", wantErr: "line 2: #EXT-X-DATERANGE: unterminated quoted string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Parse(strings.NewReader(tt.input))
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("Parse() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var types []LineType
+			for _, l := range p.Lines {
+				types = append(types, l.Type)
+			}
+			if !reflect.DeepEqual(types, tt.types) {
+				t.Fatalf("line types = %v, want %v", types, tt.types)
+			}
+		})
+	}
+}
+
+func TestParseAttrList(t *testing.T) {
+	attrs, err := ParseAttrList(`METHOD=AES-128, URI="https://a/k?x=1,y=2",IV=0xABC`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := AttrList{
+		{Key: "METHOD", Value: "AES-128"},
+		{Key: "URI", Value: "https://a/k?x=1,y=2", Quoted: true},
+		{Key: "IV", Value: "0xABC"},
+	}
+	if !reflect.DeepEqual(attrs, want) {
+		t.Fatalf("ParseAttrList() = %+v, want %+v", attrs, want)
+	}
+	if got := attrs.String(); got != `METHOD=AES-128,URI="https://a/k?x=1,y=2",IV=0xABC` {
+		t.Fatalf("String() = %q", got)
+	}
+}
+
+func TestRewriteURIsAndEncode(t *testing.T) {
+	input := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:7",
+		`#EXT-X-MAP:URI="init.mp4"`,
+		`#EXT-X-KEY:METHOD=AES-128,URI="key.bin"`,
+		"#EXTINF:4.000,",
+		"seg0.m4s",
+		`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part1.m4s"`,
+		`#EXT-X-DATERANGE:ID="ad",START-DATE="2024-01-01T00:00:00Z",X-ASSET-URI="ad.m3u8"`,
+		"",
+	}, "\n")
+	p, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []string
+	p.RewriteURIs(func(uri, tag string) string {
+		seen = append(seen, tag+" "+uri)
+		return "/p/" + uri
+	})
+	wantSeen := []string{"EXT-X-MAP init.mp4", "EXT-X-KEY key.bin", " seg0.m4s", "EXT-X-PRELOAD-HINT part1.m4s", "EXT-X-DATERANGE ad.m3u8"}
+	if !reflect.DeepEqual(seen, wantSeen) {
+		t.Fatalf("rewritten = %q, want %q", seen, wantSeen)
+	}
+
+	var b strings.Builder
+	if err := p.Encode(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:7",
+		`#EXT-X-MAP:URI="/p/init.mp4"`,
+		`#EXT-X-KEY:METHOD=AES-128,URI="/p/key.bin"`,
+		"#EXTINF:4.000,",
+		"/p/seg0.m4s",
+		`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="/p/part1.m4s"`,
+		`#EXT-X-DATERANGE:ID="ad",START-DATE="2024-01-01T00:00:00Z",X-ASSET-URI="/p/ad.m3u8"`,
+		"",
+	}, "\n")
+	if b.String() != want {
+		t.Fatalf("Encode() =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestEncodeKeepsUnmodifiedLines(t *testing.T) {
+	input := strings.Join([]string{
+		"#EXTM3U",
+		`#EXT-X-KEY:METHOD=AES-128, URI="key.bin"`,
+		`#EXT-X-MAP: URI="init.mp4"`,
+		`#EXT-X-MEDIA:TYPE=AUDIO,NAME="en`,
+		"#EXTINF:4.000,  ",
+		"  seg0.m4s",
+		"",
+	}, "\n")
+	p, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Lines[3].Attrs != nil {
+		t.Fatalf("malformed tag attrs = %+v, want nil", p.Lines[3].Attrs)
+	}
+
+	// 只改写 init.mp4，其余行保持原有的空白与格式
+	p.RewriteURIs(func(uri, tag string) string {
+		if uri == "init.mp4" {
+			return "/p/" + uri
+		}
+		return uri
+	})
+	var b strings.Builder
+	if err := p.Encode(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"#EXTM3U",
+		`#EXT-X-KEY:METHOD=AES-128, URI="key.bin"`,
+		`#EXT-X-MAP:URI="/p/init.mp4"`,
+		`#EXT-X-MEDIA:TYPE=AUDIO,NAME="en`,
+		"#EXTINF:4.000,  ",
+		"  seg0.m4s",
+		"",
+	}, "\n")
+	if b.String() != want {
+		t.Fatalf("Encode() =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestMedia(t *testing.T) {
+	input := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:6",
+		"#EXT-X-MEDIA-SEQUENCE:100",
+		"#EXT-X-DISCONTINUITY-SEQUENCE:2",
+		`#EXT-X-KEY:METHOD=AES-128,URI="k1"`,
+		"#EXTINF:6,",
+		"a.ts",
+		"#EXT-X-DISCONTINUITY",
+		`#EXT-X-KEY:METHOD=NONE`,
+		"#EXTINF:5.5,",
+		"b.ts",
+		"#EXT-X-ENDLIST",
+	}, "\n")
+	p, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := p.Media()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.TargetDuration != 6 || m.MediaSequence != 100 || m.DiscontinuitySequence != 2 || !m.EndList {
+		t.Fatalf("media = %+v", m)
+	}
+	if len(m.Segments) != 2 {
+		t.Fatalf("got %d segments, want 2", len(m.Segments))
+	}
+	tests := []struct {
+		seq           int64
+		duration      float64
+		discontinuity bool
+		uri           string
+		key           bool
+	}{
+		{100, 6, false, "a.ts", true},
+		{101, 5.5, true, "b.ts", false},
+	}
+	for i, tt := range tests {
+		seg := m.Segments[i]
+		if seg.Seq != tt.seq || seg.Duration != tt.duration || seg.Discontinuity != tt.discontinuity ||
+			seg.URI() != tt.uri || (seg.Key != nil) != tt.key {
+			t.Fatalf("segment %d = %+v", i, seg)
+		}
+	}
+
+	// 重新组装后 KEY 在变化处输出，ENDLIST 保留在末尾
+	var b strings.Builder
+	m.Playlist().Encode(&b)
+	want := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:6",
+		"#EXT-X-MEDIA-SEQUENCE:100",
+		"#EXT-X-DISCONTINUITY-SEQUENCE:2",
+		`#EXT-X-KEY:METHOD=AES-128,URI="k1"`,
+		"#EXTINF:6,",
+		"a.ts",
+		`#EXT-X-KEY:METHOD=NONE`,
+		"#EXT-X-DISCONTINUITY",
+		"#EXTINF:5.5,",
+		"b.ts",
+		"#EXT-X-ENDLIST",
+		"",
+	}, "\n")
+	if b.String() != want {
+		t.Fatalf("Playlist() =\n%s\nwant\n%s", b.String(), want)
+	}
+
+	master, _ := Parse(strings.NewReader("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\nv.m3u8\n"))
+	if _, err := master.Media(); err == nil {
+		t.Fatal("Media() on a master playlist should fail")
+	}
+}
@@ -4,19 +4,74 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/quic-go/quic-go/http3"
 	"github.com/zjyl1994/donggua-proxy/config"
 	"github.com/zjyl1994/donggua-proxy/handlers"
 	"github.com/zjyl1994/donggua-proxy/middleware"
+	"github.com/zjyl1994/donggua-proxy/resolver"
+	"github.com/zjyl1994/donggua-proxy/server"
+	"github.com/zjyl1994/donggua-proxy/utils"
 	"golang.org/x/time/rate"
 )
 
 func main() {
+	upstreams, err := resolver.ParseUpstreams(config.DNSUpstreams)
+	if err != nil {
+		log.Fatal(err)
+	}
+	domainUpstreams, err := resolver.ParseDomainUpstreams(config.DNSDomainUpstreams)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hosts, err := resolver.ParseHosts(config.DNSHosts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// 未配置上游时查询 /etc/resolv.conf 中的 nameserver 以便按记录 TTL 缓存，
+	// /etc/hosts 中的条目 (DNS_HOSTS 优先) 同样生效
+	var systemUpstreams []resolver.Upstream
+	if len(upstreams) == 0 {
+		if systemUpstreams, err = resolver.ReadResolvConf("/etc/resolv.conf"); err != nil {
+			log.Printf("[WARN] read /etc/resolv.conf failed, using the system resolver: %v", err)
+		}
+		if fileHosts, err := resolver.ReadHostsFile("/etc/hosts"); err == nil {
+			for name, ips := range fileHosts {
+				if _, ok := hosts[name]; !ok {
+					hosts[name] = ips
+				}
+			}
+		}
+	}
+	utils.Resolver = resolver.New(resolver.Config{
+		Upstreams:       upstreams,
+		SystemUpstreams: systemUpstreams,
+		DomainUpstreams: domainUpstreams,
+		Hosts:           hosts,
+		MinTTL:          config.DNSMinTTL,
+		MaxTTL:          config.DNSMaxTTL,
+		NegativeTTL:     config.DNSNegativeTTL,
+		CacheSize:       config.DNSCacheSize,
+	})
+	policy, err := utils.NewSSRFPolicy(config.SSRFAllowHosts, config.SSRFDenyHosts, config.SSRFAllowCIDRs, config.SSRFDenyCIDRs, config.SSRFAllowPorts, config.SSRFDenyPorts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	utils.Policy = policy
+	utils.Dialer = utils.NewEyeballsDialer(strings.ToLower(config.DialIPPreference), config.DialFallbackDelay, config.DialTimeout, config.DialFailurePenalty)
+
+	if err := handlers.LoadHeaderProfiles(config.HeaderProfilesFile); err != nil {
+		log.Fatal(err)
+	}
+
 	// TMDB 代理路由
 	http.HandleFunc("/api/", handlers.TmdbAPIHandler)
 	http.HandleFunc("/t/", handlers.TmdbImageHandler)
@@ -27,45 +82,234 @@ func main() {
 	// 通用代理路由 (作为默认 fallback)
 	http.HandleFunc("/", handlers.ProxyHandler)
 
-	// 健康检查接口
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
+	// 健康检查接口：/health 兼容旧版本，/livez 存活检查，/readyz 就绪检查 (公开监听上只返回总体状态)
+	http.HandleFunc("/health", handlers.HealthHandler)
+	http.HandleFunc("/livez", handlers.LivenessHandler)
+	http.HandleFunc("/readyz", handlers.PublicReadinessHandler)
+
+	// 内部管理接口，只挂载在 handler=admin 的监听上
+	adminMux := http.NewServeMux()
+	adminMux.HandleFunc("/health", handlers.HealthHandler)
+	adminMux.HandleFunc("/livez", handlers.LivenessHandler)
+	adminMux.HandleFunc("/readyz", handlers.ReadinessHandler)
+	adminMux.HandleFunc("/metrics", handlers.MetricsHandler)
 
-	fmt.Printf("DongguaTV Proxy is running on port %s\n", config.ListenAddr)
+	// 未配置 LISTENERS 时只监听 LISTEN_ADDR (配置证书时使用 TLS)
+	specs := []server.ListenerSpec{{Network: "tcp", Address: config.ListenAddr, TLS: config.TLSCerts != "", Handler: server.HandlerPublic}}
+	if config.Listeners != "" {
+		if specs, err = server.ParseListeners(config.Listeners); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// 设置限流器: 从环境变量读取配置 (默认 50/100)
 	limiter := middleware.NewIPRateLimiter(rate.Limit(config.RateLimit), config.BurstLimit)
+	if config.RateLimitRedisURL != "" {
+		backend, err := middleware.NewRedisBackend(config.RateLimitRedisURL, rate.Limit(config.RateLimit), config.BurstLimit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pingCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		if err := backend.Ping(pingCtx); err != nil {
+			log.Printf("[WARN] rate limit redis unreachable, requests are allowed until it recovers: %v", err)
+		}
+		cancel()
+		limiter.SetBackend(backend)
+	}
 	limiter.EnableTrustedProxies(config.TrustProxy, config.TrustedProxyCIDRs)
+	// 仅对通用代理的分片请求排队，避免播放器因瞬时超限而卡顿
+	limiter.EnableDelay(config.RateLimitMaxDelay, func(r *http.Request) bool {
+		return r.URL.Path == "/" && r.URL.Query().Has("url")
+	})
+
+	publicHandler := limiter.LimitMiddleware(http.DefaultServeMux)
+
+	// 配置证书时提供 HTTPS，证书文件变化后自动重新加载
+	var certs *server.CertStore
+	if config.TLSCerts != "" {
+		if certs, err = server.NewCertStore(config.TLSCerts); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// 第一个 TLS 监听的地址，用于 HTTP/3 与 HTTP 跳转
+	var tlsAddr string
+	for _, spec := range specs {
+		if spec.TLS && certs == nil {
+			log.Fatalf("listener %s requires TLS_CERTS", spec)
+		}
+		if spec.TLS && spec.Network == "tcp" && spec.Handler == server.HandlerPublic && tlsAddr == "" {
+			tlsAddr = spec.Address
+		}
+	}
 
-	server := &http.Server{
-		Addr:              config.ListenAddr,
-		Handler:           limiter.LimitMiddleware(http.DefaultServeMux),
-		ReadTimeout:       10 * time.Second,
-		ReadHeaderTimeout: 10 * time.Second,
-		WriteTimeout:      60 * time.Second,
-		IdleTimeout:       120 * time.Second,
-		MaxHeaderBytes:    1 << 20,
-		ErrorLog:          log.New(os.Stderr, "", log.LstdFlags),
+	// HTTP/3 与 TCP 服务共享处理链 (含限流) 与证书，在 TLS 监听上通过 Alt-Svc 通告
+	var h3 *http3.Server
+	if config.HTTP3 {
+		addr := config.HTTP3Addr
+		if addr == "" {
+			addr = tlsAddr
+		}
+		if certs == nil || addr == "" {
+			log.Fatal("HTTP3 requires TLS_CERTS and a public tls listener")
+		}
+		h3 = server.NewHTTP3Server(addr, publicHandler, certs.TLSConfig(), config.HTTP3AltSvcPort, 120*time.Second, config.WriteTimeout)
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, stop := context.WithCancel(context.Background())
 	defer stop()
 
-	errCh := make(chan error, 1)
-	go func() {
-		errCh <- server.ListenAndServe()
-	}()
-
-	select {
-	case <-ctx.Done():
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		_ = server.Shutdown(shutdownCtx)
-	case err := <-errCh:
-		if err != nil && err != http.ErrServerClosed {
+	// systemd socket activation 或上一个进程交接的监听，按地址对应 specs 与 HTTP 跳转监听
+	inherited, err := server.InheritedListeners()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var listeners []net.Listener
+	listen := func(network, addr string, create func() (net.Listener, error)) net.Listener {
+		ln, err := inherited.Take(network, addr)
+		if err != nil {
 			log.Fatal(err)
 		}
+		if ln == nil {
+			if ln, err = create(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		listeners = append(listeners, ln)
+		return ln
+	}
+
+	var servers []*http.Server
+	errCh := make(chan error, len(specs)+2)
+	for _, spec := range specs {
+		handler := publicHandler
+		if spec.Handler == server.HandlerAdmin {
+			handler = adminMux
+		} else if h3 != nil && spec.TLS {
+			// 明文监听 (h2c、Unix 套接字、反代后端) 上的客户端无法直接改用 HTTP/3，不通告
+			handler = server.AltSvc(h3, handler)
+		}
+		if spec.Network == "unix" {
+			handler = server.LocalPeer(handler)
+		}
+		srv := &http.Server{
+			Handler:           handler,
+			Protocols:         spec.Protocols(),
+			ReadTimeout:       10 * time.Second,
+			ReadHeaderTimeout: 10 * time.Second,
+			WriteTimeout:      config.WriteTimeout,
+			IdleTimeout:       120 * time.Second,
+			MaxHeaderBytes:    1 << 20,
+			ErrorLog:          log.New(os.Stderr, "", log.LstdFlags),
+		}
+		if spec.TLS {
+			srv.TLSConfig = certs.TLSConfig()
+		}
+		ln := listen(spec.Network, spec.Address, spec.Listen)
+		fmt.Printf("DongguaTV Proxy is listening on %s\n", spec)
+		servers = append(servers, srv)
+		go func(tls bool) {
+			if tls {
+				errCh <- srv.ServeTLS(ln, "", "")
+			} else {
+				errCh <- srv.Serve(ln)
+			}
+		}(spec.TLS)
+	}
+	if certs != nil {
+		go certs.Watch(ctx, config.TLSReloadInterval)
+	}
+	if h3 != nil {
+		go func() {
+			errCh <- server.ListenAndServeHTTP3(h3, 10*time.Second)
+		}()
+	}
+
+	// HTTP 跳转 HTTPS
+	if tlsAddr != "" && config.HTTPRedirectAddr != "" {
+		_, httpsPort, _ := net.SplitHostPort(tlsAddr)
+		redirectSrv := &http.Server{
+			Handler:           server.RedirectHandler(httpsPort),
+			ReadHeaderTimeout: 10 * time.Second,
+			WriteTimeout:      10 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			ErrorLog:          log.New(os.Stderr, "", log.LstdFlags),
+		}
+		ln := listen("tcp", config.HTTPRedirectAddr, func() (net.Listener, error) {
+			return net.Listen("tcp", config.HTTPRedirectAddr)
+		})
+		servers = append(servers, redirectSrv)
+		go func() {
+			errCh <- redirectSrv.Serve(ln)
+		}()
+	}
+	for _, addr := range inherited.CloseUnused() {
+		log.Printf("[WARN] closed inherited listener %s://%s that matches no configured listener", addr.Network(), addr)
+	}
+	// 由 SIGUSR2 交接启动时，通知旧进程开始排空
+	if err := server.NotifyReady(); err != nil {
+		log.Printf("[WARN] notify handoff ready failed: %v", err)
+	}
+
+	// SIGTERM/SIGINT 排空后退出；SIGUSR2 将监听交给新进程后排空退出，用于不中断服务的重启
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR2)
+	for {
+		select {
+		case sig := <-sigCh:
+			handedOff := false
+			if sig == syscall.SIGUSR2 {
+				proc, err := server.Handoff(listeners, config.HandoffTimeout)
+				if err != nil {
+					log.Printf("[ERROR] hand off listeners failed: %v", err)
+					continue
+				}
+				log.Printf("[INFO] listeners handed off to pid %d", proc.Pid)
+				proc.Release()
+				handedOff = true
+			}
+			stop()
+			drain(servers, h3, handedOff)
+			return
+		case err := <-errCh:
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}
+	}
+}
+
+// drain 停止接受新请求，等待进行中的请求 (如分片、MP4 流) 在 DRAIN_TIMEOUT 内完成
+// 未交接监听时先在 DRAIN_DELAY 内继续服务但 /health 与 /readyz 返回 503，便于负载均衡摘除实例
+func drain(servers []*http.Server, h3 *http3.Server, handedOff bool) {
+	handlers.StartDraining()
+	if !handedOff && config.DrainDelay > 0 {
+		log.Printf("[INFO] draining, stop accepting new requests in %s", config.DrainDelay)
+		time.Sleep(config.DrainDelay)
+	}
+	log.Printf("[INFO] draining, waiting up to %s for active requests", config.DrainTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				// 超时后强制关闭剩余连接
+				srv.Close()
+			}
+		}()
+	}
+	if h3 != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = h3.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		log.Printf("[WARN] drain timeout, remaining connections closed")
 	}
 }
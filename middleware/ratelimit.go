@@ -1,8 +1,13 @@
 package middleware
 
 import (
+	"context"
+	"errors"
+	"log"
+	"math"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -10,63 +15,86 @@ import (
 	"golang.org/x/time/rate"
 )
 
+// Decision is the outcome of taking one token from a client's bucket
+type Decision struct {
+	// Allowed reports whether the request may proceed (possibly after Delay)
+	Allowed bool
+	// Delay is how long an allowed request must wait before proceeding
+	Delay time.Duration
+	// RetryAfter is how long a rejected client should wait before retrying
+	RetryAfter time.Duration
+
+	Limit     int
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+
+	// Cancel, when set, returns the token of a delayed request to the bucket.
+	// It is called if the client goes away before the delay has passed.
+	Cancel func()
+}
+
+// Backend stores the token buckets used by IPRateLimiter
+type Backend interface {
+	// Take consumes one token for key. When the bucket is empty the request
+	// is allowed with a Delay if the wait is no longer than maxDelay.
+	Take(ctx context.Context, key string, maxDelay time.Duration) (Decision, error)
+}
+
 // IPRateLimiter manages rate limiters for each IP address
 type IPRateLimiter struct {
-	ips      map[string]*rate.Limiter
-	lastSeen map[string]time.Time
-	mu       sync.Mutex
-	r        rate.Limit
-	b        int
+	backend Backend
+	mu      sync.Mutex
 
 	trustProxy  bool
 	trustedNets []*net.IPNet
+
+	// maxDelay is the longest a request matched by delayMatch may be queued
+	// instead of rejected when the bucket is empty
+	maxDelay   time.Duration
+	delayMatch func(*http.Request) bool
+}
+
+// AddIP creates a new limiter for an IP if it doesn't exist.
+// Only the in-memory backend keeps a rate.Limiter per IP; with any other
+// backend AddIP returns nil.
+func (i *IPRateLimiter) AddIP(ip string) *rate.Limiter {
+	if m, ok := i.currentBackend().(*MemoryBackend); ok {
+		return m.AddIP(ip)
+	}
+	return nil
+}
+
+// GetLimiter returns the limiter for a given IP, see AddIP
+func (i *IPRateLimiter) GetLimiter(ip string) *rate.Limiter {
+	if m, ok := i.currentBackend().(*MemoryBackend); ok {
+		return m.GetLimiter(ip)
+	}
+	return nil
 }
 
-// NewIPRateLimiter creates a new IPRateLimiter
+// NewIPRateLimiter creates a new IPRateLimiter backed by an in-memory map
 // r: requests per second
 // b: burst size
 func NewIPRateLimiter(r rate.Limit, b int) *IPRateLimiter {
-	i := &IPRateLimiter{
-		ips:      make(map[string]*rate.Limiter),
-		lastSeen: make(map[string]time.Time),
-		r:        r,
-		b:        b,
+	return &IPRateLimiter{
+		backend: NewMemoryBackend(r, b),
 	}
-
-	// Start background cleanup goroutine
-	go i.cleanupLoop()
-
-	return i
 }
 
-// AddIP creates a new limiter for an IP if it doesn't exist
-func (i *IPRateLimiter) AddIP(ip string) *rate.Limiter {
+// SetBackend replaces the bucket storage, e.g. with a RedisBackend shared
+// between several proxy instances
+func (i *IPRateLimiter) SetBackend(backend Backend) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	limiter, exists := i.ips[ip]
-	if !exists {
-		limiter = rate.NewLimiter(i.r, i.b)
-		i.ips[ip] = limiter
-	}
-
-	i.lastSeen[ip] = time.Now()
-	return limiter
+	i.backend = backend
 }
 
-// GetLimiter returns the limiter for a given IP
-func (i *IPRateLimiter) GetLimiter(ip string) *rate.Limiter {
+func (i *IPRateLimiter) currentBackend() Backend {
 	i.mu.Lock()
-	limiter, exists := i.ips[ip]
-
-	if !exists {
-		i.mu.Unlock()
-		return i.AddIP(ip)
-	}
-
-	i.lastSeen[ip] = time.Now()
-	i.mu.Unlock()
-	return limiter
+	defer i.mu.Unlock()
+	return i.backend
 }
 
 func (i *IPRateLimiter) EnableTrustedProxies(trustProxy bool, cidrs string) {
@@ -103,6 +131,28 @@ func (i *IPRateLimiter) EnableTrustedProxies(trustProxy bool, cidrs string) {
 	i.trustedNets = nets
 }
 
+// EnableDelay lets requests matched by match wait up to maxDelay for a token
+// instead of being rejected immediately. A zero maxDelay disables queueing.
+func (i *IPRateLimiter) EnableDelay(maxDelay time.Duration, match func(*http.Request) bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.maxDelay = maxDelay
+	i.delayMatch = match
+}
+
+func (i *IPRateLimiter) allowedDelay(r *http.Request) time.Duration {
+	i.mu.Lock()
+	maxDelay := i.maxDelay
+	match := i.delayMatch
+	i.mu.Unlock()
+
+	if maxDelay <= 0 || (match != nil && !match(r)) {
+		return 0
+	}
+	return maxDelay
+}
+
 func (i *IPRateLimiter) isTrustedProxy(remoteIP net.IP) bool {
 	if remoteIP == nil {
 		return false
@@ -138,21 +188,6 @@ func extractClientIP(r *http.Request, fallback string) string {
 	return fallback
 }
 
-// cleanupLoop removes old entries to prevent memory leaks
-func (i *IPRateLimiter) cleanupLoop() {
-	for {
-		time.Sleep(1 * time.Minute)
-		i.mu.Lock()
-		for ip, lastSeen := range i.lastSeen {
-			if time.Since(lastSeen) > 3*time.Minute {
-				delete(i.ips, ip)
-				delete(i.lastSeen, ip)
-			}
-		}
-		i.mu.Unlock()
-	}
-}
-
 // LimitMiddleware wraps an http.Handler with rate limiting
 func (i *IPRateLimiter) LimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -170,12 +205,53 @@ func (i *IPRateLimiter) LimitMiddleware(next http.Handler) http.Handler {
 			ipStr = extractClientIP(r, ipStr)
 		}
 
-		limiter := i.GetLimiter(ipStr)
-		if !limiter.Allow() {
+		decision, err := i.currentBackend().Take(r.Context(), ipStr, i.allowedDelay(r))
+		if err != nil {
+			// Fail open: a broken shared store must not take the proxy down.
+			// A backend that is backing off has already logged the failure.
+			if !errors.Is(err, errBackendUnavailable) {
+				log.Printf("[ERROR] rate limit backend: %v", err)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		setRateLimitHeaders(w, decision)
+		if !decision.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(decision.RetryAfter)))
 			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
 			return
 		}
 
+		if decision.Delay > 0 {
+			timer := time.NewTimer(decision.Delay)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				// The client gave up while queued, hand its token back
+				timer.Stop()
+				if decision.Cancel != nil {
+					decision.Cancel()
+				}
+				return
+			}
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
+
+// setRateLimitHeaders writes the IETF RateLimit-Limit/Remaining/Reset headers
+// describing the state of the client's token bucket
+func setRateLimitHeaders(w http.ResponseWriter, d Decision) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(max(d.Remaining, 0)))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// MemoryBackend keeps one rate.Limiter per key in process memory
+type MemoryBackend struct {
+	ips      map[string]*rate.Limiter
+	lastSeen map[string]time.Time
+	mu       sync.Mutex
+	r        rate.Limit
+	b        int
+}
+
+// NewMemoryBackend creates a new MemoryBackend
+// r: requests per second
+// b: burst size
+func NewMemoryBackend(r rate.Limit, b int) *MemoryBackend {
+	m := &MemoryBackend{
+		ips:      make(map[string]*rate.Limiter),
+		lastSeen: make(map[string]time.Time),
+		r:        r,
+		b:        b,
+	}
+
+	// Start background cleanup goroutine
+	go m.cleanupLoop()
+
+	return m
+}
+
+// AddIP creates a new limiter for an IP if it doesn't exist
+func (m *MemoryBackend) AddIP(ip string) *rate.Limiter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	limiter, exists := m.ips[ip]
+	if !exists {
+		limiter = rate.NewLimiter(m.r, m.b)
+		m.ips[ip] = limiter
+	}
+
+	m.lastSeen[ip] = time.Now()
+	return limiter
+}
+
+// GetLimiter returns the limiter for a given IP
+func (m *MemoryBackend) GetLimiter(ip string) *rate.Limiter {
+	m.mu.Lock()
+	limiter, exists := m.ips[ip]
+
+	if !exists {
+		m.mu.Unlock()
+		return m.AddIP(ip)
+	}
+
+	m.lastSeen[ip] = time.Now()
+	m.mu.Unlock()
+	return limiter
+}
+
+// Take implements Backend
+func (m *MemoryBackend) Take(_ context.Context, key string, maxDelay time.Duration) (Decision, error) {
+	limiter := m.GetLimiter(key)
+	now := time.Now()
+
+	reservation := limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+
+	d := Decision{Allowed: true, Delay: delay}
+	if delay > 0 {
+		d.Cancel = reservation.Cancel
+	}
+	if !reservation.OK() || delay > maxDelay {
+		reservation.CancelAt(now)
+		d = Decision{RetryAfter: delay}
+		if !reservation.OK() || delay == rate.InfDuration {
+			// The limiter can never satisfy the request, tell the client to back off
+			d.RetryAfter = time.Minute
+		}
+	}
+
+	tokens := limiter.TokensAt(now)
+	d.Limit = limiter.Burst()
+	d.Remaining = int(math.Floor(tokens))
+	if missing := float64(d.Limit) - tokens; missing > 0 && limiter.Limit() > 0 {
+		d.Reset = time.Duration(missing / float64(limiter.Limit()) * float64(time.Second))
+	}
+	return d, nil
+}
+
+// cleanupLoop removes old entries to prevent memory leaks
+func (m *MemoryBackend) cleanupLoop() {
+	for {
+		time.Sleep(1 * time.Minute)
+		m.mu.Lock()
+		for ip, lastSeen := range m.lastSeen {
+			if time.Since(lastSeen) > 3*time.Minute {
+				delete(m.ips, ip)
+				delete(m.lastSeen, ip)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,429 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// tokenBucketScript implements the same token bucket as rate.Limiter on the
+// Redis side. The server clock is used so replicas with skewed clocks agree.
+// Returns {allowed, delay_ms, remaining, reset_ms}; delay_ms is -1 when the
+// bucket can never refill.
+const tokenBucketScript = `
+if redis.replicate_commands then redis.replicate_commands() end
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local max_delay = tonumber(ARGV[3])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+  tokens = burst
+  ts = now
+end
+if now > ts then
+  tokens = math.min(burst, tokens + (now - ts) * rate / 1000)
+end
+local allowed = 0
+local delay = 0
+if tokens >= 1 then
+  allowed = 1
+elseif rate > 0 then
+  delay = math.ceil((1 - tokens) * 1000 / rate)
+  if delay <= max_delay then allowed = 1 end
+else
+  delay = -1
+end
+if allowed == 1 then tokens = tokens - 1 end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+local ttl = 60000
+if rate > 0 then ttl = math.ceil(burst * 1000 / rate) + 1000 end
+redis.call('PEXPIRE', KEYS[1], ttl)
+local reset = 0
+if rate > 0 and tokens < burst then reset = math.ceil((burst - tokens) * 1000 / rate) end
+return {allowed, delay, math.max(0, math.floor(tokens)), reset}
+`
+
+// refundScript returns one token taken by tokenBucketScript, used when a
+// delayed request is abandoned. The bucket never grows above the burst size.
+const refundScript = `
+local tokens = tonumber(redis.call('HGET', KEYS[1], 'tokens'))
+if tokens ~= nil then
+  redis.call('HSET', KEYS[1], 'tokens', tostring(math.min(tonumber(ARGV[1]), tokens + 1)))
+end
+return 1
+`
+
+// RedisBackend keeps token buckets in a Redis-protocol server so that every
+// proxy instance sharing the server enforces one combined limit per client
+type RedisBackend struct {
+	r         rate.Limit
+	b         int
+	keyPrefix string
+	scriptSHA string
+	refundSHA string
+
+	network  string
+	addr     string
+	password string
+	username string
+	db       int
+	useTLS   bool
+	tlsHost  string
+
+	pool chan *redisConn
+
+	// While the server is known to be down requests skip the dial and fail
+	// open immediately; the pause doubles on every failure up to
+	// maxRedisBackoff
+	mu        sync.Mutex
+	failures  int
+	downUntil time.Time
+}
+
+const (
+	minRedisBackoff = time.Second
+	maxRedisBackoff = 30 * time.Second
+)
+
+// errBackendUnavailable is returned without contacting the server while the
+// backend is backing off after a connection failure
+var errBackendUnavailable = errors.New("rate limit backend unavailable")
+
+// NewRedisBackend creates a RedisBackend from a URL of the form
+// redis://[user:password@]host:port/db (rediss:// for TLS,
+// unix:///path/to/redis.sock for a Unix socket)
+// r: requests per second
+// b: burst size
+func NewRedisBackend(rawURL string, r rate.Limit, b int) (*RedisBackend, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+
+	rb := &RedisBackend{
+		r:         r,
+		b:         b,
+		keyPrefix: "dgproxy:ratelimit:",
+		scriptSHA: scriptSHA1(tokenBucketScript),
+		refundSHA: scriptSHA1(refundScript),
+		pool:      make(chan *redisConn, 16),
+	}
+
+	switch u.Scheme {
+	case "redis", "rediss":
+		rb.network = "tcp"
+		rb.addr = u.Host
+		if u.Port() == "" {
+			rb.addr = net.JoinHostPort(u.Hostname(), "6379")
+		}
+		rb.useTLS = u.Scheme == "rediss"
+		rb.tlsHost = u.Hostname()
+		if db := strings.Trim(u.Path, "/"); db != "" {
+			if rb.db, err = strconv.Atoi(db); err != nil {
+				return nil, fmt.Errorf("invalid redis db %q", db)
+			}
+		}
+	case "unix":
+		rb.network = "unix"
+		rb.addr = u.Path
+		if db := u.Query().Get("db"); db != "" {
+			if rb.db, err = strconv.Atoi(db); err != nil {
+				return nil, fmt.Errorf("invalid redis db %q", db)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported redis scheme: %s", u.Scheme)
+	}
+
+	if u.User != nil {
+		rb.password, _ = u.User.Password()
+		if rb.password == "" {
+			// redis://password@host form
+			rb.password = u.User.Username()
+		} else {
+			rb.username = u.User.Username()
+		}
+	}
+
+	return rb, nil
+}
+
+// Ping checks that the server is reachable
+func (rb *RedisBackend) Ping(ctx context.Context) error {
+	_, err := rb.do(ctx, "PING")
+	return err
+}
+
+// Take implements Backend
+func (rb *RedisBackend) Take(ctx context.Context, key string, maxDelay time.Duration) (Decision, error) {
+	reply, err := rb.eval(ctx, tokenBucketScript, rb.scriptSHA,
+		"1",
+		rb.keyPrefix+key,
+		strconv.FormatFloat(float64(rb.r), 'f', -1, 64),
+		strconv.Itoa(rb.b),
+		strconv.FormatInt(maxDelay.Milliseconds(), 10),
+	)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 4 {
+		return Decision{}, fmt.Errorf("unexpected redis reply: %v", reply)
+	}
+	ints := make([]int64, len(values))
+	for idx, v := range values {
+		if ints[idx], ok = v.(int64); !ok {
+			return Decision{}, fmt.Errorf("unexpected redis reply: %v", reply)
+		}
+	}
+
+	d := Decision{
+		Allowed:   ints[0] == 1,
+		Limit:     rb.b,
+		Remaining: int(ints[2]),
+		Reset:     time.Duration(ints[3]) * time.Millisecond,
+	}
+	delay := time.Duration(ints[1]) * time.Millisecond
+	switch {
+	case d.Allowed:
+		d.Delay = delay
+		if delay > 0 {
+			d.Cancel = func() { rb.refund(key) }
+		}
+	case ints[1] < 0:
+		// The bucket can never refill, tell the client to back off
+		d.RetryAfter = time.Minute
+	default:
+		d.RetryAfter = delay
+	}
+	return d, nil
+}
+
+// refund gives back the token of an abandoned delayed request. The caller's
+// context has already ended, so the refund gets a short context of its own.
+func (rb *RedisBackend) refund(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err := rb.eval(ctx, refundScript, rb.refundSHA, "1", rb.keyPrefix+key, strconv.Itoa(rb.b))
+	if err != nil && !errors.Is(err, errBackendUnavailable) {
+		log.Printf("[WARN] rate limit refund: %v", err)
+	}
+}
+
+// eval runs a script by its SHA1, sending the full script when the server
+// has not cached it yet
+func (rb *RedisBackend) eval(ctx context.Context, script, sha string, args ...string) (interface{}, error) {
+	reply, err := rb.do(ctx, append([]string{"EVALSHA", sha}, args...)...)
+	var redisErr redisError
+	if errors.As(err, &redisErr) && strings.HasPrefix(string(redisErr), "NOSCRIPT") {
+		reply, err = rb.do(ctx, append([]string{"EVAL", script}, args...)...)
+	}
+	return reply, err
+}
+
+// do sends one command on a pooled connection and returns the parsed reply
+func (rb *RedisBackend) do(ctx context.Context, args ...string) (interface{}, error) {
+	if rb.backingOff() {
+		return nil, errBackendUnavailable
+	}
+	conn, err := rb.getConn(ctx)
+	if err != nil {
+		rb.markDown(ctx, err)
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(2 * time.Second)
+	}
+	conn.SetDeadline(deadline)
+
+	reply, err := conn.do(args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// Network or protocol error, the connection state is unknown
+		conn.Close()
+		rb.markDown(ctx, err)
+		return nil, err
+	}
+	rb.markUp()
+	rb.putConn(conn)
+	return reply, err
+}
+
+func (rb *RedisBackend) backingOff() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return time.Now().Before(rb.downUntil)
+}
+
+// markDown starts or extends the back-off after a connection failure.
+// Failures caused by the caller's own context ending say nothing about the
+// server and are ignored.
+func (rb *RedisBackend) markDown(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	backoff := min(minRedisBackoff<<min(rb.failures, 5), maxRedisBackoff)
+	rb.failures++
+	rb.downUntil = time.Now().Add(backoff)
+	log.Printf("[WARN] rate limit redis unreachable, allowing requests for %s: %v", backoff, err)
+}
+
+func (rb *RedisBackend) markUp() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.failures = 0
+	rb.downUntil = time.Time{}
+}
+
+func (rb *RedisBackend) getConn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-rb.pool:
+		return conn, nil
+	default:
+	}
+
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+	var c net.Conn
+	var err error
+	if rb.useTLS {
+		c, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: rb.tlsHost}}).DialContext(ctx, rb.network, rb.addr)
+	} else {
+		c, err = dialer.DialContext(ctx, rb.network, rb.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis dial: %w", err)
+	}
+
+	conn := &redisConn{Conn: c, rd: bufio.NewReader(c)}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if rb.password != "" {
+		args := []string{"AUTH", rb.password}
+		if rb.username != "" {
+			args = []string{"AUTH", rb.username, rb.password}
+		}
+		if _, err := conn.do(args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis auth: %w", err)
+		}
+	}
+	if rb.db != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(rb.db)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis select: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (rb *RedisBackend) putConn(conn *redisConn) {
+	conn.SetDeadline(time.Time{})
+	select {
+	case rb.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func scriptSHA1(script string) string {
+	sum := sha1.Sum([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisConn speaks the minimal subset of RESP needed by RedisBackend
+type redisConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.Conn, buf.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.rd, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, n)
+		for idx := range values {
+			v, err := c.readReply()
+			var redisErr redisError
+			if err != nil && !errors.As(err, &redisErr) {
+				return nil, err
+			}
+			values[idx] = v
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,288 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a minimal RESP server. EVALSHA fails with NOSCRIPT until the
+// script has been sent with EVAL; script calls are answered by eval.
+type fakeRedis struct {
+	ln     net.Listener
+	eval   func(args []string) []int64
+	loaded atomic.Bool
+
+	mu   sync.Mutex
+	last []string
+}
+
+func newFakeRedis(t *testing.T, eval func(args []string) []int64) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, eval: eval}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) url() string {
+	return "redis://" + f.ln.Addr().String()
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	rd := bufio.NewReader(c)
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.last = args
+		f.mu.Unlock()
+
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			io.WriteString(c, "+PONG\r\n")
+		case "AUTH", "SELECT":
+			io.WriteString(c, "+OK\r\n")
+		case "EVALSHA":
+			if !f.loaded.Load() {
+				io.WriteString(c, "-NOSCRIPT No matching script\r\n")
+				continue
+			}
+			writeInts(c, f.eval(args[2:]))
+		case "EVAL":
+			f.loaded.Store(true)
+			writeInts(c, f.eval(args[2:]))
+		default:
+			fmt.Fprintf(c, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+func (f *fakeRedis) lastCommand() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.last
+}
+
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func writeInts(w io.Writer, values []int64) {
+	fmt.Fprintf(w, "*%d\r\n", len(values))
+	for _, v := range values {
+		fmt.Fprintf(w, ":%d\r\n", v)
+	}
+}
+
+func TestRedisBackendTake(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply []int64
+		want  Decision
+	}{
+		{
+			name:  "allow",
+			reply: []int64{1, 0, 4, 200},
+			want:  Decision{Allowed: true, Limit: 5, Remaining: 4, Reset: 200 * time.Millisecond},
+		},
+		{
+			name:  "delay",
+			reply: []int64{1, 150, 0, 1000},
+			want:  Decision{Allowed: true, Delay: 150 * time.Millisecond, Limit: 5, Reset: time.Second},
+		},
+		{
+			name:  "deny",
+			reply: []int64{0, 300, 0, 1000},
+			want:  Decision{RetryAfter: 300 * time.Millisecond, Limit: 5, Reset: time.Second},
+		},
+		{
+			name:  "never refills",
+			reply: []int64{0, -1, 0, 0},
+			want:  Decision{RetryAfter: time.Minute, Limit: 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeRedis(t, func([]string) []int64 { return tt.reply })
+			rb, err := NewRedisBackend(f.url(), 2.5, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The first call falls back from EVALSHA to EVAL, the second uses the cached script
+			for i := 0; i < 2; i++ {
+				got, err := rb.Take(context.Background(), "1.2.3.4", 200*time.Millisecond)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Only delayed requests can hand their token back
+				if (got.Cancel != nil) != (tt.want.Delay > 0) {
+					t.Fatalf("Take() Cancel set = %v, want %v", got.Cancel != nil, tt.want.Delay > 0)
+				}
+				got.Cancel = nil
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("Take() = %+v, want %+v", got, tt.want)
+				}
+			}
+
+			cmd := f.lastCommand()
+			wantCmd := []string{"EVALSHA", scriptSHA1(tokenBucketScript), "1", "dgproxy:ratelimit:1.2.3.4", "2.5", "5", "200"}
+			if strings.Join(cmd, " ") != strings.Join(wantCmd, " ") {
+				t.Fatalf("command = %q, want %q", cmd, wantCmd)
+			}
+		})
+	}
+}
+
+func TestRedisBackendRefund(t *testing.T) {
+	f := newFakeRedis(t, func([]string) []int64 { return []int64{1, 150, 0, 1000} })
+	rb, err := NewRedisBackend(f.url(), 2.5, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := rb.Take(context.Background(), "1.2.3.4", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Cancel()
+
+	cmd := f.lastCommand()
+	wantCmd := []string{"EVALSHA", scriptSHA1(refundScript), "1", "dgproxy:ratelimit:1.2.3.4", "5"}
+	if strings.Join(cmd, " ") != strings.Join(wantCmd, " ") {
+		t.Fatalf("command = %q, want %q", cmd, wantCmd)
+	}
+}
+
+func TestRedisBackendUnexpectedReply(t *testing.T) {
+	f := newFakeRedis(t, func([]string) []int64 { return []int64{1, 0} })
+	rb, err := NewRedisBackend(f.url(), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rb.Take(context.Background(), "k", 0); err == nil {
+		t.Fatal("Take() with a short reply should fail")
+	}
+}
+
+func TestRedisBackendFailOpen(t *testing.T) {
+	// A server that accepts and immediately drops every connection
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepts atomic.Int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepts.Add(1)
+			c.Close()
+		}
+	}()
+
+	rb, err := NewRedisBackend("redis://"+ln.Addr().String(), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := NewIPRateLimiter(1, 1)
+	limiter.SetBackend(rb)
+	var served int
+	handler := limiter.LimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+	}))
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want 200", i, rec.Code)
+		}
+	}
+	if served != 3 {
+		t.Fatalf("served %d requests, want 3", served)
+	}
+	// Requests after the first failure skip the server while backing off
+	if n := accepts.Load(); n != 1 {
+		t.Fatalf("server accepted %d connections, want 1", n)
+	}
+	if _, err := rb.Take(context.Background(), "k", 0); err != errBackendUnavailable {
+		t.Fatalf("Take() while backing off = %v, want errBackendUnavailable", err)
+	}
+}
+
+func TestRedisBackendRecovers(t *testing.T) {
+	f := newFakeRedis(t, func([]string) []int64 { return []int64{1, 0, 0, 0} })
+	rb, err := NewRedisBackend(f.url(), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb.markDown(context.Background(), io.ErrUnexpectedEOF)
+	if _, err := rb.Take(context.Background(), "k", 0); err != errBackendUnavailable {
+		t.Fatalf("Take() while backing off = %v, want errBackendUnavailable", err)
+	}
+
+	// Once the back-off has passed the next request reaches the server again
+	rb.mu.Lock()
+	rb.downUntil = time.Now()
+	rb.mu.Unlock()
+	if _, err := rb.Take(context.Background(), "k", 0); err != nil {
+		t.Fatal(err)
+	}
+	if rb.backingOff() || rb.failures != 0 {
+		t.Fatal("backend should be marked up after a successful reply")
+	}
+}
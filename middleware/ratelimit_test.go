@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryBackendCancel(t *testing.T) {
+	m := NewMemoryBackend(1, 1)
+	if d, _ := m.Take(context.Background(), "k", time.Second); !d.Allowed || d.Delay != 0 || d.Cancel != nil {
+		t.Fatalf("first Take() = %+v, want immediate", d)
+	}
+	d, _ := m.Take(context.Background(), "k", 2*time.Second)
+	if !d.Allowed || d.Delay <= 0 || d.Cancel == nil {
+		t.Fatalf("second Take() = %+v, want delayed with Cancel", d)
+	}
+	d.Cancel()
+
+	// The returned token lets the next request queue for the same delay again
+	// instead of stacking behind the abandoned one
+	next, _ := m.Take(context.Background(), "k", 2*time.Second)
+	if !next.Allowed || next.Delay > d.Delay {
+		t.Fatalf("Take() after Cancel = %+v, want delay <= %v", next, d.Delay)
+	}
+}
+
+func TestLimitMiddlewareReturnsTokenOnDisconnect(t *testing.T) {
+	limiter := NewIPRateLimiter(1, 1)
+	limiter.EnableDelay(2*time.Second, nil)
+	var served int
+	handler := limiter.LimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Queued behind the empty bucket, then the client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+	if served != 1 {
+		t.Fatalf("served %d requests, want 1", served)
+	}
+
+	// Without the refund the bucket would be two tokens short and this
+	// request would wait close to two seconds
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if served != 2 {
+		t.Fatalf("served %d requests, want 2", served)
+	}
+	if waited := time.Since(start); waited > 1500*time.Millisecond {
+		t.Fatalf("waited %v, want the abandoned token back", waited)
+	}
+}
+
+func TestIPRateLimiterGetLimiter(t *testing.T) {
+	limiter := NewIPRateLimiter(1, 3)
+	l := limiter.GetLimiter("1.2.3.4")
+	if l == nil || l.Burst() != 3 || limiter.AddIP("1.2.3.4") != l {
+		t.Fatalf("GetLimiter() = %v, want the shared per-IP limiter", l)
+	}
+
+	rb, err := NewRedisBackend("redis://127.0.0.1:1", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter.SetBackend(rb)
+	if limiter.GetLimiter("1.2.3.4") != nil {
+		t.Fatal("GetLimiter() with a shared backend should return nil")
+	}
+}
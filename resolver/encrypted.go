@@ -0,0 +1,140 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// tlsUpstream DNS-over-TLS (RFC 7858) 上游，复用空闲连接
+type tlsUpstream struct {
+	addr   string
+	config *tls.Config
+	idle   chan net.Conn
+}
+
+// NewTLSUpstream 创建 DoT 上游，addr 必须是 IP 地址，未指定端口时使用 853
+// serverName 为空时按 IP 地址校验证书
+func NewTLSUpstream(addr, serverName string) (Upstream, error) {
+	addr, err := ipAddr(addr, "853")
+	if err != nil {
+		return nil, err
+	}
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(addr)
+	}
+	return &tlsUpstream{
+		addr:   addr,
+		config: &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12},
+		idle:   make(chan net.Conn, 4),
+	}, nil
+}
+
+func (u *tlsUpstream) String() string {
+	return "tls://" + u.addr
+}
+
+func (u *tlsUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	ctx, cancel := withExchangeTimeout(ctx)
+	defer cancel()
+
+	// 服务器可能已关闭空闲连接，复用失败时重新建立连接再试一次
+	select {
+	case conn := <-u.idle:
+		if resp, err := exchangeStream(ctx, conn, query); err == nil {
+			u.release(conn)
+			return resp, nil
+		}
+		conn.Close()
+	default:
+	}
+
+	d := tls.Dialer{Config: u.config}
+	conn, err := d.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := exchangeStream(ctx, conn, query)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	u.release(conn)
+	return resp, nil
+}
+
+// release 归还连接，空闲连接已满时关闭
+func (u *tlsUpstream) release(conn net.Conn) {
+	conn.SetDeadline(time.Time{})
+	select {
+	case u.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// httpsUpstream DNS-over-HTTPS (RFC 8484) 上游
+type httpsUpstream struct {
+	url    string
+	host   string
+	client *http.Client
+}
+
+// NewHTTPSUpstream 创建 DoH 上游，使用 POST application/dns-message
+// rawURL 的主机必须是 IP 地址；serverName 非空时用于校验证书并作为 Host 请求头
+func NewHTTPSUpstream(rawURL, serverName string) (Upstream, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid doh url %q: %w", rawURL, err)
+	}
+	if _, err := ipAddr(u.Host, "443"); err != nil {
+		return nil, err
+	}
+	return &httpsUpstream{
+		url:  rawURL,
+		host: serverName,
+		client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:     &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12},
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: 4,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 5 * time.Second,
+			},
+		},
+	}, nil
+}
+
+func (u *httpsUpstream) String() string {
+	return u.url
+}
+
+func (u *httpsUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	ctx, cancel := withExchangeTimeout(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	if u.host != "" {
+		req.Host = u.host
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh server returned %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+}
@@ -0,0 +1,125 @@
+package resolver
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// answer 一次 A/AAAA 查询的结果
+type answer struct {
+	rcode dnsmessage.RCode
+	ips   []net.IP
+	// ttl 应答记录 (含 CNAME 链) 中最小的 TTL；否定应答取 SOA 的 minimum
+	ttl time.Duration
+}
+
+// buildQuery 构建单个问题的递归查询报文
+func buildQuery(host string, qtype dnsmessage.Type) (uint16, []byte, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return 0, nil, err
+	}
+	id := uint16(rand.Uint32())
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return 0, nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return 0, nil, err
+	}
+	msg, err := b.Finish()
+	return id, msg, err
+}
+
+// parseAnswer 解析响应报文，只接受与查询 ID 一致的响应
+func parseAnswer(id uint16, msg []byte, qtype dnsmessage.Type) (*answer, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+	if h.ID != id || !h.Response {
+		return nil, fmt.Errorf("mismatched dns response")
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+
+	ans := &answer{rcode: h.RCode}
+	var minTTL uint32
+	first := true
+	track := func(ttl uint32) {
+		if first || ttl < minTTL {
+			minTTL = ttl
+			first = false
+		}
+	}
+
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case rh.Type == dnsmessage.TypeA && qtype == dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, err
+			}
+			ans.ips = append(ans.ips, net.IP(r.A[:]))
+			track(rh.TTL)
+		case rh.Type == dnsmessage.TypeAAAA && qtype == dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, err
+			}
+			ans.ips = append(ans.ips, net.IP(r.AAAA[:]))
+			track(rh.TTL)
+		case rh.Type == dnsmessage.TypeCNAME:
+			// CNAME 过期后整条链都需要重新解析
+			track(rh.TTL)
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// 否定应答按 SOA 的 minimum 与 TTL 中较小者缓存 (RFC 2308)
+	if len(ans.ips) == 0 {
+		for {
+			rh, err := p.AuthorityHeader()
+			if err != nil {
+				break
+			}
+			if rh.Type != dnsmessage.TypeSOA {
+				if p.SkipAuthority() != nil {
+					break
+				}
+				continue
+			}
+			soa, err := p.SOAResource()
+			if err != nil {
+				break
+			}
+			minTTL, first = min(rh.TTL, soa.MinTTL), false
+			break
+		}
+	}
+
+	if !first {
+		ans.ttl = time.Duration(minTTL) * time.Second
+	}
+	return ans, nil
+}
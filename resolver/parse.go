@@ -0,0 +1,154 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ParseUpstream 解析上游地址，服务器必须以 IP 地址给出，# 后可指定证书主机名
+//
+//	1.1.1.1 / udp://1.1.1.1:53              UDP (截断时改用 TCP)
+//	tcp://8.8.8.8                            TCP
+//	tls://8.8.8.8#dns.google                 DNS-over-TLS
+//	https://8.8.8.8/dns-query#dns.google     DNS-over-HTTPS
+func ParseUpstream(s string) (Upstream, error) {
+	s = strings.TrimSpace(s)
+	scheme, rest, ok := strings.Cut(s, "://")
+	if !ok {
+		scheme, rest = "udp", s
+	}
+	switch strings.ToLower(scheme) {
+	case "udp":
+		return NewUDPUpstream(rest)
+	case "tcp":
+		return NewTCPUpstream(rest)
+	case "tls":
+		addr, serverName, _ := strings.Cut(rest, "#")
+		return NewTLSUpstream(addr, serverName)
+	case "https":
+		rawURL, serverName, _ := strings.Cut(s, "#")
+		return NewHTTPSUpstream(rawURL, serverName)
+	default:
+		return nil, fmt.Errorf("unsupported dns upstream %q", s)
+	}
+}
+
+// ParseUpstreams 解析逗号分隔的上游列表
+func ParseUpstreams(s string) ([]Upstream, error) {
+	var upstreams []Upstream
+	for _, item := range strings.Split(s, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		u, err := ParseUpstream(item)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, u)
+	}
+	return upstreams, nil
+}
+
+// ParseDomainUpstreams 解析按域名指定的上游，如
+// "themoviedb.org,tmdb.org=tls://1.1.1.1;example-cdn.com=https://8.8.8.8/dns-query#dns.google,8.8.8.8"
+// 分号分隔各项，等号左侧为逗号分隔的域名 (同时匹配子域名)，右侧为上游列表
+func ParseDomainUpstreams(s string) (map[string][]Upstream, error) {
+	result := make(map[string][]Upstream)
+	for _, entry := range strings.Split(s, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		domains, list, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid domain upstream entry %q", entry)
+		}
+		upstreams, err := ParseUpstreams(list)
+		if err != nil {
+			return nil, err
+		}
+		if len(upstreams) == 0 {
+			return nil, fmt.Errorf("no upstream for %q", domains)
+		}
+		for _, d := range strings.Split(domains, ",") {
+			if d = normalizeHost(d); d != "" {
+				result[d] = upstreams
+			}
+		}
+	}
+	return result, nil
+}
+
+// ParseHosts 解析静态解析表，如 "a.example.com=1.2.3.4,2001:db8::1;b.example.com=5.6.7.8"
+func ParseHosts(s string) (map[string][]net.IP, error) {
+	result := make(map[string][]net.IP)
+	for _, entry := range strings.Split(s, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		host, list, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid hosts entry %q", entry)
+		}
+		host = normalizeHost(host)
+		for _, addr := range strings.Split(list, ",") {
+			ip := net.ParseIP(strings.TrimSpace(addr))
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q for %s", addr, host)
+			}
+			result[host] = append(result[host], ip)
+		}
+	}
+	return result, nil
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(host), "."))
+}
+
+// ReadResolvConf 读取 resolv.conf 中的 nameserver 作为上游
+func ReadResolvConf(path string) ([]Upstream, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var upstreams []Upstream
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		// 忽略无法解析的地址
+		if u, err := NewUDPUpstream(fields[1]); err == nil {
+			upstreams = append(upstreams, u)
+		}
+	}
+	return upstreams, nil
+}
+
+// ReadHostsFile 读取 hosts 文件，如 /etc/hosts
+func ReadHostsFile(path string) (map[string][]net.IP, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]net.IP)
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr, _, _ := strings.Cut(fields[0], "%")
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = normalizeHost(name)
+			result[name] = append(result[name], ip)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,329 @@
+// Package resolver 实现带缓存的 DNS 解析：按记录 TTL 缓存 (带上下限)、否定缓存、LRU 容量限制与并发查询合并，
+// 支持 UDP/TCP/DoT/DoH 上游、按域名指定上游与静态解析表
+package resolver
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sync/singleflight"
+)
+
+// Config 解析器配置
+type Config struct {
+	// Upstreams 依次尝试的上游，为空时使用 SystemUpstreams
+	Upstreams []Upstream
+	// SystemUpstreams 系统配置的 nameserver (见 ReadResolvConf)，同样按记录 TTL 缓存；
+	// 单标签域名、.local 域名，或这些 nameserver 都不可用时改用系统解析器
+	// (遵循 /etc/hosts、nsswitch 与 search/ndots)
+	SystemUpstreams []Upstream
+	// DomainUpstreams 按域名 (含子域名) 指定的上游，优先于 Upstreams
+	DomainUpstreams map[string][]Upstream
+	// Hosts 静态解析表，命中时不查询上游
+	Hosts map[string][]net.IP
+	// MinTTL/MaxTTL 缓存时间的上下限
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// NegativeTTL NXDOMAIN、无记录与 SERVFAIL 的最长缓存时间
+	NegativeTTL time.Duration
+	// CacheSize 最多缓存的域名数
+	CacheSize int
+}
+
+// cacheEntry 一个域名的解析结果
+type cacheEntry struct {
+	host    string
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// systemLookupTimeout 单次系统解析的超时
+const systemLookupTimeout = 10 * time.Second
+
+// Resolver 带缓存的解析器，可并发使用
+type Resolver struct {
+	cfg   Config
+	group singleflight.Group
+	// lookupSystem 没有配置上游的域名使用的系统解析
+	lookupSystem func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+	mu    sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+// New 创建解析器
+func New(cfg Config) *Resolver {
+	if cfg.MaxTTL < cfg.MinTTL {
+		cfg.MaxTTL = cfg.MinTTL
+	}
+	if cfg.CacheSize <= 0 {
+		cfg.CacheSize = 1
+	}
+	return &Resolver{
+		cfg:          cfg,
+		lookupSystem: net.DefaultResolver.LookupIPAddr,
+		lru:          list.New(),
+		items:        make(map[string]*list.Element),
+	}
+}
+
+// LookupIP 解析域名的 IPv4 与 IPv6 地址，失败时返回 *net.DNSError
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	host = normalizeHost(host)
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if ips, ok := r.cfg.Hosts[host]; ok {
+		return append([]net.IP(nil), ips...), nil
+	}
+
+	if entry, ok := r.cached(host); ok {
+		return entry.ips, entry.err
+	}
+
+	// 查询不随单个请求取消，结果供后续请求使用
+	lookupCtx := context.WithoutCancel(ctx)
+	ch := r.group.DoChan(host, func() (interface{}, error) {
+		entry := r.resolve(lookupCtx, host)
+		return entry, nil
+	})
+	select {
+	case res := <-ch:
+		entry := res.Val.(*cacheEntry)
+		return entry.ips, entry.err
+	case <-ctx.Done():
+		return nil, &net.DNSError{Err: ctx.Err().Error(), Name: host, IsTimeout: errors.Is(ctx.Err(), context.DeadlineExceeded)}
+	}
+}
+
+// cached 返回未过期的缓存并将其移到 LRU 头部
+func (r *Resolver) cached(host string) (*cacheEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	el, ok := r.items[host]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		r.lru.Remove(el)
+		delete(r.items, host)
+		return nil, false
+	}
+	r.lru.MoveToFront(el)
+	return entry, true
+}
+
+// store 写入缓存，超出容量时淘汰最久未使用的域名
+func (r *Resolver) store(entry *cacheEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if el, ok := r.items[entry.host]; ok {
+		el.Value = entry
+		r.lru.MoveToFront(el)
+		return
+	}
+	r.items[entry.host] = r.lru.PushFront(entry)
+	for r.lru.Len() > r.cfg.CacheSize {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.items, oldest.Value.(*cacheEntry).host)
+	}
+}
+
+// Len 返回缓存的域名数
+func (r *Resolver) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lru.Len()
+}
+
+// resolve 选择上游查询并写入缓存
+func (r *Resolver) resolve(ctx context.Context, host string) *cacheEntry {
+	if upstreams := r.upstreamsFor(host); len(upstreams) > 0 {
+		return r.resolveWith(ctx, host, upstreams)
+	}
+	// 单标签域名依赖 search 域，.local 通常由 mDNS 解析
+	if len(r.cfg.SystemUpstreams) == 0 || !strings.Contains(host, ".") || strings.HasSuffix(host, ".local") {
+		return r.resolveSystem(ctx, host)
+	}
+	entry := r.resolveWith(ctx, host, r.cfg.SystemUpstreams)
+	var dnsErr *net.DNSError
+	if errors.As(entry.err, &dnsErr) && dnsErr.IsTemporary && !dnsErr.IsNotFound {
+		return r.resolveSystem(ctx, host)
+	}
+	return entry
+}
+
+// resolveWith 向 upstreams 并发查询 A 与 AAAA 记录并按结果写入缓存
+// 网络错误不缓存，下一次请求会重新查询
+func (r *Resolver) resolveWith(ctx context.Context, host string, upstreams []Upstream) *cacheEntry {
+	type result struct {
+		ans *answer
+		err error
+	}
+	qtypes := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make([]result, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ans, err := r.query(ctx, host, qtype, upstreams)
+			results[i] = result{ans, err}
+		}()
+	}
+	wg.Wait()
+
+	entry := &cacheEntry{host: host}
+	var ttl time.Duration
+	haveTTL := false
+	rcode := dnsmessage.RCodeSuccess
+	var netErr error
+	for _, res := range results {
+		if res.err != nil {
+			netErr = res.err
+			continue
+		}
+		entry.ips = append(entry.ips, res.ans.ips...)
+		if len(res.ans.ips) > 0 && (!haveTTL || res.ans.ttl < ttl) {
+			ttl, haveTTL = res.ans.ttl, true
+		}
+		if res.ans.rcode != dnsmessage.RCodeSuccess {
+			rcode = res.ans.rcode
+		}
+	}
+
+	switch {
+	case len(entry.ips) > 0:
+		entry.expires = time.Now().Add(min(max(ttl, r.cfg.MinTTL), r.cfg.MaxTTL))
+	case netErr != nil:
+		entry.err = &net.DNSError{Err: netErr.Error(), Name: host, IsTimeout: isTimeout(netErr), IsTemporary: true}
+		return entry
+	default:
+		entry.err = r.negativeError(host, rcode)
+		entry.expires = time.Now().Add(r.negativeTTL(results[0].ans, results[1].ans))
+	}
+	r.store(entry)
+	return entry
+}
+
+// resolveSystem 使用系统解析器查询
+// 系统解析器不提供记录的 TTL，结果只按 MinTTL 缓存，避免短 TTL 的地址长时间过期不更新
+func (r *Resolver) resolveSystem(ctx context.Context, host string) *cacheEntry {
+	ctx, cancel := context.WithTimeout(ctx, systemLookupTimeout)
+	defer cancel()
+
+	entry := &cacheEntry{host: host}
+	addrs, err := r.lookupSystem(ctx, host)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			entry.err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			entry.expires = time.Now().Add(r.cfg.NegativeTTL)
+			r.store(entry)
+			return entry
+		}
+		msg := err.Error()
+		if dnsErr != nil {
+			msg = dnsErr.Err
+		}
+		entry.err = &net.DNSError{Err: msg, Name: host, IsTimeout: isTimeout(err), IsTemporary: true}
+		return entry
+	}
+	for _, addr := range addrs {
+		entry.ips = append(entry.ips, addr.IP)
+	}
+	entry.expires = time.Now().Add(r.cfg.MinTTL)
+	r.store(entry)
+	return entry
+}
+
+// negativeTTL 否定应答按 SOA 给出的时间缓存，不超过 NegativeTTL
+func (r *Resolver) negativeTTL(answers ...*answer) time.Duration {
+	ttl := r.cfg.NegativeTTL
+	for _, ans := range answers {
+		if ans != nil && ans.ttl > 0 && ans.rcode != dnsmessage.RCodeServerFailure {
+			ttl = min(ttl, ans.ttl)
+		}
+	}
+	return ttl
+}
+
+func (r *Resolver) negativeError(host string, rcode dnsmessage.RCode) error {
+	switch rcode {
+	case dnsmessage.RCodeServerFailure:
+		return &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+	case dnsmessage.RCodeNameError, dnsmessage.RCodeSuccess:
+		return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	default:
+		return &net.DNSError{Err: "dns query refused: " + rcode.String(), Name: host}
+	}
+}
+
+// upstreamsFor 返回域名使用的上游，按域名从长到短匹配 DomainUpstreams
+func (r *Resolver) upstreamsFor(host string) []Upstream {
+	for name := host; name != ""; {
+		if upstreams, ok := r.cfg.DomainUpstreams[name]; ok {
+			return upstreams
+		}
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			break
+		}
+		name = parent
+	}
+	return r.cfg.Upstreams
+}
+
+// query 依次向上游发送查询，SERVFAIL 时尝试下一个上游
+func (r *Resolver) query(ctx context.Context, host string, qtype dnsmessage.Type, upstreams []Upstream) (*answer, error) {
+	id, msg, err := buildQuery(host, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	var last *answer
+	var lastErr error
+	for _, u := range upstreams {
+		resp, err := u.Exchange(ctx, msg)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", u, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		ans, err := parseAnswer(id, resp, qtype)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", u, err)
+			continue
+		}
+		if ans.rcode == dnsmessage.RCodeServerFailure {
+			last = ans
+			continue
+		}
+		return ans, nil
+	}
+	if last != nil {
+		return last, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no dns upstream configured")
+	}
+	return nil, lastErr
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
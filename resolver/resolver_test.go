@@ -0,0 +1,450 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// record 构造响应时使用的一条资源记录
+type record struct {
+	typ  dnsmessage.Type
+	ttl  uint32
+	data string
+}
+
+// buildResponse 按查询报文构造响应
+func buildResponse(t *testing.T, query []byte, rcode dnsmessage.RCode, answers []record, soaTTL, soaMin uint32) []byte {
+	t.Helper()
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := p.Question()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, RCode: rcode})
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	for _, rec := range answers {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Type: rec.typ, Class: dnsmessage.ClassINET, TTL: rec.ttl}
+		switch rec.typ {
+		case dnsmessage.TypeA:
+			var a [4]byte
+			copy(a[:], net.ParseIP(rec.data).To4())
+			b.AResource(rh, dnsmessage.AResource{A: a})
+		case dnsmessage.TypeAAAA:
+			var a [16]byte
+			copy(a[:], net.ParseIP(rec.data))
+			b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: a})
+		case dnsmessage.TypeCNAME:
+			b.CNAMEResource(rh, dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(rec.data)})
+		}
+	}
+	if soaTTL > 0 {
+		b.StartAuthorities()
+		zone := dnsmessage.MustNewName("example.com.")
+		b.SOAResource(dnsmessage.ResourceHeader{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: soaTTL},
+			dnsmessage.SOAResource{NS: zone, MBox: zone, MinTTL: soaMin})
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestParseAnswer(t *testing.T) {
+	tests := []struct {
+		name    string
+		qtype   dnsmessage.Type
+		rcode   dnsmessage.RCode
+		answers []record
+		soaTTL  uint32
+		soaMin  uint32
+		ips     []string
+		ttl     time.Duration
+	}{
+		{
+			name:    "a records",
+			qtype:   dnsmessage.TypeA,
+			answers: []record{{dnsmessage.TypeA, 300, "1.2.3.4"}, {dnsmessage.TypeA, 120, "5.6.7.8"}},
+			ips:     []string{"1.2.3.4", "5.6.7.8"},
+			ttl:     120 * time.Second,
+		},
+		{
+			name:    "cname chain limits ttl",
+			qtype:   dnsmessage.TypeA,
+			answers: []record{{dnsmessage.TypeCNAME, 30, "cdn.example.net."}, {dnsmessage.TypeA, 600, "1.2.3.4"}},
+			ips:     []string{"1.2.3.4"},
+			ttl:     30 * time.Second,
+		},
+		{
+			name:    "aaaa ignores a",
+			qtype:   dnsmessage.TypeAAAA,
+			answers: []record{{dnsmessage.TypeA, 60, "1.2.3.4"}, {dnsmessage.TypeAAAA, 60, "2001:db8::1"}},
+			ips:     []string{"2001:db8::1"},
+			ttl:     60 * time.Second,
+		},
+		{
+			name:   "nxdomain uses soa minimum",
+			qtype:  dnsmessage.TypeA,
+			rcode:  dnsmessage.RCodeNameError,
+			soaTTL: 3600,
+			soaMin: 45,
+			ttl:    45 * time.Second,
+		},
+		{
+			name:   "nodata uses soa ttl",
+			qtype:  dnsmessage.TypeAAAA,
+			soaTTL: 20,
+			soaMin: 300,
+			ttl:    20 * time.Second,
+		},
+		{
+			name:  "servfail without records",
+			qtype: dnsmessage.TypeA,
+			rcode: dnsmessage.RCodeServerFailure,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, query, err := buildQuery("www.example.com", tt.qtype)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := buildResponse(t, query, tt.rcode, tt.answers, tt.soaTTL, tt.soaMin)
+			ans, err := parseAnswer(id, resp, tt.qtype)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ans.rcode != tt.rcode || ans.ttl != tt.ttl || len(ans.ips) != len(tt.ips) {
+				t.Fatalf("answer = %+v, want rcode %v ttl %s ips %v", ans, tt.rcode, tt.ttl, tt.ips)
+			}
+			for i, ip := range tt.ips {
+				if !ans.ips[i].Equal(net.ParseIP(ip)) {
+					t.Fatalf("ips[%d] = %s, want %s", i, ans.ips[i], ip)
+				}
+			}
+		})
+	}
+}
+
+func TestParseAnswerRejects(t *testing.T) {
+	id, query, err := buildQuery("www.example.com", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := buildResponse(t, query, dnsmessage.RCodeSuccess, []record{{dnsmessage.TypeA, 60, "1.2.3.4"}}, 0, 0)
+	tests := map[string]struct {
+		id  uint16
+		msg []byte
+	}{
+		"mismatched id": {id + 1, resp},
+		"query echoed":  {id, query},
+		"truncated":     {id, resp[:len(resp)-3]},
+		"garbage":       {id, []byte{1, 2, 3}},
+	}
+	for name, tt := range tests {
+		if _, err := parseAnswer(tt.id, tt.msg, dnsmessage.TypeA); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// fakeUpstream 按查询类型返回预设的应答
+type fakeUpstream struct {
+	t       *testing.T
+	rcode   dnsmessage.RCode
+	a       []record
+	aaaa    []record
+	soaTTL  uint32
+	err     error
+	queries atomic.Int32
+}
+
+func (u *fakeUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	u.queries.Add(1)
+	if u.err != nil {
+		return nil, u.err
+	}
+	var p dnsmessage.Parser
+	p.Start(query)
+	q, _ := p.Question()
+	answers := u.a
+	if q.Type == dnsmessage.TypeAAAA {
+		answers = u.aaaa
+	}
+	return buildResponse(u.t, query, u.rcode, answers, u.soaTTL, u.soaTTL), nil
+}
+
+func (u *fakeUpstream) String() string { return "fake" }
+
+func TestResolverLookupIP(t *testing.T) {
+	good := &fakeUpstream{t: t, a: []record{{dnsmessage.TypeA, 300, "1.2.3.4"}}, aaaa: []record{{dnsmessage.TypeAAAA, 60, "2001:db8::1"}}}
+	r := New(Config{
+		Upstreams: []Upstream{good},
+		Hosts:     map[string][]net.IP{"static.example": {net.ParseIP("10.0.0.1")}},
+		MinTTL:    10 * time.Second,
+		MaxTTL:    time.Minute,
+		CacheSize: 10,
+	})
+	ctx := context.Background()
+
+	ips, err := r.LookupIP(ctx, "WWW.Example.com.")
+	if err != nil || len(ips) != 2 {
+		t.Fatalf("LookupIP() = %v, %v", ips, err)
+	}
+	if _, err := r.LookupIP(ctx, "www.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if n := good.queries.Load(); n != 2 {
+		t.Fatalf("upstream got %d queries, want 2 (A and AAAA, then cached)", n)
+	}
+	entry, _ := r.cached("www.example.com")
+	if ttl := time.Until(entry.expires); ttl > time.Minute || ttl < 50*time.Second {
+		t.Fatalf("cached for %s, want the smaller record TTL of 60s", ttl)
+	}
+
+	if ips, err := r.LookupIP(ctx, "static.example"); err != nil || !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("static host = %v, %v", ips, err)
+	}
+	if ips, err := r.LookupIP(ctx, "192.0.2.1"); err != nil || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("ip literal = %v, %v", ips, err)
+	}
+}
+
+func TestResolverNegativeAndFailover(t *testing.T) {
+	servfail := &fakeUpstream{t: t, rcode: dnsmessage.RCodeServerFailure}
+	nx := &fakeUpstream{t: t, rcode: dnsmessage.RCodeNameError, soaTTL: 5}
+	r := New(Config{
+		Upstreams:   []Upstream{servfail, nx},
+		MinTTL:      10 * time.Second,
+		MaxTTL:      time.Minute,
+		NegativeTTL: 30 * time.Second,
+		CacheSize:   10,
+	})
+	_, err := r.LookupIP(context.Background(), "missing.example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("LookupIP() error = %v, want not found", err)
+	}
+	entry, ok := r.cached("missing.example.com")
+	if !ok || time.Until(entry.expires) > 5*time.Second {
+		t.Fatal("negative answer should be cached for the SOA minimum")
+	}
+
+	// 网络错误不缓存
+	down := &fakeUpstream{t: t, err: errors.New("connection refused")}
+	r = New(Config{Upstreams: []Upstream{down}, NegativeTTL: time.Minute, CacheSize: 10})
+	if _, err := r.LookupIP(context.Background(), "www.example.com"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if r.Len() != 0 {
+		t.Fatal("network errors should not be cached")
+	}
+}
+
+func TestResolverDomainUpstreams(t *testing.T) {
+	def := &fakeUpstream{t: t, a: []record{{dnsmessage.TypeA, 60, "1.1.1.1"}}}
+	special := &fakeUpstream{t: t, a: []record{{dnsmessage.TypeA, 60, "2.2.2.2"}}}
+	r := New(Config{
+		Upstreams:       []Upstream{def},
+		DomainUpstreams: map[string][]Upstream{"tmdb.org": {special}},
+		MaxTTL:          time.Minute,
+		CacheSize:       10,
+	})
+	for host, want := range map[string]string{"api.tmdb.org": "2.2.2.2", "tmdb.org": "2.2.2.2", "nottmdb.org": "1.1.1.1"} {
+		ips, err := r.LookupIP(context.Background(), host)
+		if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP(want)) {
+			t.Errorf("LookupIP(%s) = %v, %v, want %s", host, ips, err, want)
+		}
+	}
+}
+
+func TestResolverSystemFallback(t *testing.T) {
+	r := New(Config{MinTTL: time.Second, MaxTTL: time.Hour, NegativeTTL: time.Minute, CacheSize: 10})
+	var calls atomic.Int32
+	r.lookupSystem = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		calls.Add(1)
+		switch host {
+		case "db":
+			// 如 compose 中的服务名，由 /etc/hosts 或 search 域解析
+			return []net.IPAddr{{IP: net.ParseIP("172.18.0.2")}}, nil
+		case "missing":
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		default:
+			return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+		}
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		ips, err := r.LookupIP(ctx, "db")
+		if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("172.18.0.2")) {
+			t.Fatalf("LookupIP(db) = %v, %v", ips, err)
+		}
+	}
+	if _, err := r.LookupIP(ctx, "missing"); err == nil {
+		t.Fatal("expected not found")
+	}
+	r.LookupIP(ctx, "missing")
+	if _, err := r.LookupIP(ctx, "slow"); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	r.LookupIP(ctx, "slow")
+	// db 与 missing 各查询一次后缓存，超时不缓存
+	if n := calls.Load(); n != 4 {
+		t.Fatalf("system resolver called %d times, want 4", n)
+	}
+	entry, _ := r.cached("db")
+	// 系统解析器不提供 TTL，只按 MinTTL 缓存
+	if ttl := time.Until(entry.expires); ttl > time.Second || ttl < 900*time.Millisecond {
+		t.Fatalf("system result cached for %s, want MinTTL", ttl)
+	}
+
+	// 默认的系统解析器能解析 /etc/hosts 中的 localhost
+	r = New(Config{MaxTTL: time.Minute, CacheSize: 10})
+	ips, err := r.LookupIP(ctx, "localhost")
+	if err != nil || len(ips) == 0 || !ips[0].IsLoopback() {
+		t.Fatalf("LookupIP(localhost) = %v, %v", ips, err)
+	}
+}
+
+func TestResolverSystemUpstreams(t *testing.T) {
+	nameserver := &fakeUpstream{t: t, a: []record{{dnsmessage.TypeA, 2, "203.0.113.7"}}}
+	r := New(Config{
+		SystemUpstreams: []Upstream{nameserver},
+		MaxTTL:          time.Hour,
+		NegativeTTL:     time.Minute,
+		CacheSize:       10,
+	})
+	var system atomic.Int32
+	r.lookupSystem = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		system.Add(1)
+		return []net.IPAddr{{IP: net.ParseIP("172.18.0.2")}}, nil
+	}
+	ctx := context.Background()
+
+	// 默认配置下按记录的短 TTL 缓存
+	ips, err := r.LookupIP(ctx, "cdn.example.com")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("203.0.113.7")) {
+		t.Fatalf("LookupIP() = %v, %v", ips, err)
+	}
+	entry, _ := r.cached("cdn.example.com")
+	if ttl := time.Until(entry.expires); ttl > 2*time.Second || ttl < time.Second {
+		t.Fatalf("cached for %s, want the 2s record TTL", ttl)
+	}
+
+	// 单标签与 .local 域名交给系统解析器
+	for _, host := range []string{"db", "printer.local"} {
+		if ips, err := r.LookupIP(ctx, host); err != nil || !ips[0].Equal(net.ParseIP("172.18.0.2")) {
+			t.Fatalf("LookupIP(%s) = %v, %v", host, ips, err)
+		}
+	}
+	if n := system.Load(); n != 2 {
+		t.Fatalf("system resolver called %d times, want 2", n)
+	}
+
+	// nameserver 不可用时改用系统解析器；NXDOMAIN 不再回退
+	nameserver.err = errors.New("connection refused")
+	if ips, err := r.LookupIP(ctx, "down.example.com"); err != nil || !ips[0].Equal(net.ParseIP("172.18.0.2")) {
+		t.Fatalf("fallback = %v, %v", ips, err)
+	}
+	nameserver.err = nil
+	nameserver.rcode = dnsmessage.RCodeNameError
+	nameserver.a = nil
+	if _, err := r.LookupIP(ctx, "missing.example.com"); err == nil {
+		t.Fatal("NXDOMAIN from the nameserver should not fall back")
+	}
+	if n := system.Load(); n != 3 {
+		t.Fatalf("system resolver called %d times, want 3", n)
+	}
+}
+
+func TestReadSystemFiles(t *testing.T) {
+	dir := t.TempDir()
+	resolvConf := dir + "/resolv.conf"
+	os.WriteFile(resolvConf, []byte("# comment\nsearch lan\nnameserver 127.0.0.53\nnameserver fe80::1%eth0\nnameserver bogus\noptions ndots:1\n"), 0o644)
+	upstreams, err := ReadResolvConf(resolvConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, u := range upstreams {
+		got = append(got, u.String())
+	}
+	if want := "udp://127.0.0.53:53 udp://[fe80::1%eth0]:53"; strings.Join(got, " ") != want {
+		t.Fatalf("ReadResolvConf() = %v, want %s", got, want)
+	}
+
+	hostsFile := dir + "/hosts"
+	os.WriteFile(hostsFile, []byte("127.0.0.1 localhost\n::1 localhost ip6-localhost # loopback\n10.0.0.5 NAS.lan nas\n# 10.0.0.6 old\nbad line\n"), 0o644)
+	hosts, err := ReadHostsFile(hostsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts["localhost"]) != 2 || !hosts["nas.lan"][0].Equal(net.ParseIP("10.0.0.5")) || len(hosts["nas"]) != 1 || hosts["old"] != nil {
+		t.Fatalf("ReadHostsFile() = %v", hosts)
+	}
+	if _, err := ReadResolvConf(dir + "/missing"); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "1.1.1.1", want: "udp://1.1.1.1:53"},
+		{in: "udp://[2606:4700::1111]:5353", want: "udp://[2606:4700::1111]:5353"},
+		{in: "tcp://8.8.8.8", want: "tcp://8.8.8.8:53"},
+		{in: "tls://8.8.8.8#dns.google", want: "tls://8.8.8.8:853"},
+		{in: "https://8.8.8.8/dns-query#dns.google", want: "https://8.8.8.8/dns-query"},
+		{in: "https://[2606:4700::1111]:8443/dns-query", want: "https://[2606:4700::1111]:8443/dns-query"},
+		// 域名需要先经由系统 DNS 解析，不允许
+		{in: "dns.local", wantErr: true},
+		{in: "tls://dns.google", wantErr: true},
+		{in: "https://dns.google/dns-query", wantErr: true},
+		{in: "quic://1.1.1.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		u, err := ParseUpstream(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseUpstream(%q) = %v, want an error", tt.in, u)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseUpstream(%q): %v", tt.in, err)
+			continue
+		}
+		if got := u.String(); got != tt.want {
+			t.Errorf("ParseUpstream(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+
+	u, _ := ParseUpstream("https://8.8.8.8/dns-query#dns.google")
+	if h := u.(*httpsUpstream); h.host != "dns.google" || h.client.Transport.(*http.Transport).TLSClientConfig.ServerName != "dns.google" {
+		t.Fatalf("doh server name not applied: %+v", h)
+	}
+	u, _ = ParseUpstream("tls://8.8.8.8")
+	if name := u.(*tlsUpstream).config.ServerName; name != "8.8.8.8" {
+		t.Fatalf("dot server name = %q, want the IP address", name)
+	}
+}
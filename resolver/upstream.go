@@ -0,0 +1,148 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// exchangeTimeout 单个上游没有设置截止时间时的查询超时
+const exchangeTimeout = 3 * time.Second
+
+// Upstream DNS 上游，发送查询报文并返回响应报文
+type Upstream interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+// plainUpstream 传统 DNS 服务器，默认使用 UDP，响应被截断时改用 TCP
+type plainUpstream struct {
+	addr    string
+	tcpOnly bool
+}
+
+// NewUDPUpstream 创建 UDP 上游 (截断时自动改用 TCP)，addr 必须是 IP 地址，未指定端口时使用 53
+func NewUDPUpstream(addr string) (Upstream, error) {
+	addr, err := ipAddr(addr, "53")
+	if err != nil {
+		return nil, err
+	}
+	return &plainUpstream{addr: addr}, nil
+}
+
+// NewTCPUpstream 创建仅使用 TCP 的上游
+func NewTCPUpstream(addr string) (Upstream, error) {
+	addr, err := ipAddr(addr, "53")
+	if err != nil {
+		return nil, err
+	}
+	return &plainUpstream{addr: addr, tcpOnly: true}, nil
+}
+
+func (u *plainUpstream) String() string {
+	if u.tcpOnly {
+		return "tcp://" + u.addr
+	}
+	return "udp://" + u.addr
+}
+
+func (u *plainUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	ctx, cancel := withExchangeTimeout(ctx)
+	defer cancel()
+
+	if !u.tcpOnly {
+		resp, err := u.exchangeUDP(ctx, query)
+		if err != nil || !truncated(resp) {
+			return resp, err
+		}
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeStream(ctx, conn, query)
+}
+
+func (u *plainUpstream) exchangeUDP(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// 丢弃 ID 不匹配的迟到响应
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// exchangeStream 在面向流的连接上 (TCP/TLS) 发送带 2 字节长度前缀的报文
+func exchangeStream(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// truncated 判断响应头中的 TC 标志
+func truncated(msg []byte) bool {
+	return len(msg) >= 3 && msg[2]&0x02 != 0
+}
+
+func withExchangeTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, exchangeTimeout)
+}
+
+// ipAddr 补全默认端口，并要求主机部分是 IP 地址
+// 上游地址如果是域名就需要先经由系统 DNS 解析，既重新引入了明文或被污染的解析，
+// 在系统解析器指向本进程时还会形成循环
+func ipAddr(addr, port string) (string, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, p = strings.Trim(addr, "[]"), port
+	}
+	// IPv6 链路本地地址可能带 %zone
+	ip, _, _ := strings.Cut(host, "%")
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("dns upstream %q must be an IP address (use tls://IP#name or https://IP/path#name to set the certificate name)", addr)
+	}
+	return net.JoinHostPort(host, p), nil
+}
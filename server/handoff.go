@@ -0,0 +1,227 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// listenFDsStart systemd 传递的第一个文件描述符
+const listenFDsStart = 3
+
+// Inherited systemd socket activation 或上一个进程 (Handoff) 传递的监听
+// 按实际监听的地址对应到配置，与传递的顺序无关
+type Inherited struct {
+	listeners []net.Listener
+}
+
+// InheritedListeners 接收传递的监听，没有传递监听时返回空集合
+// 设置了 LISTEN_PID 时只在与当前进程一致时使用，与 sd_listen_fds 的约定相同
+func InheritedListeners() (*Inherited, error) {
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return &Inherited{}, nil
+	}
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return &Inherited{}, nil
+	}
+	// 避免再传给子进程
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	in := &Inherited{listeners: make([]net.Listener, 0, nfds)}
+	for fd := listenFDsStart; fd < listenFDsStart+nfds; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "listener-"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			in.CloseUnused()
+			// 其余描述符也不再使用
+			for rest := fd + 1; rest < listenFDsStart+nfds; rest++ {
+				syscall.Close(rest)
+			}
+			return nil, fmt.Errorf("inherited fd %d: %w", fd, err)
+		}
+		in.listeners = append(in.listeners, ln)
+	}
+	return in, nil
+}
+
+// Take 取出与 network/addr 对应的监听
+// 没有传递任何监听时返回 nil，由调用方自行创建；传递了监听但没有对应的地址时返回错误，
+// 避免把请求交给错误的处理器 (如把公开监听当作管理接口)
+func (in *Inherited) Take(network, addr string) (net.Listener, error) {
+	if len(in.listeners) == 0 {
+		return nil, nil
+	}
+	var have []string
+	for i, ln := range in.listeners {
+		if ln == nil {
+			continue
+		}
+		if listenerMatches(ln, network, addr) {
+			in.listeners[i] = nil
+			return ln, nil
+		}
+		have = append(have, ln.Addr().Network()+"://"+ln.Addr().String())
+	}
+	return nil, fmt.Errorf("no inherited listener matches %s://%s (unused: %s)", network, addr, strings.Join(have, ", "))
+}
+
+// CloseUnused 关闭没有对应配置的监听，返回其地址
+func (in *Inherited) CloseUnused() []net.Addr {
+	var addrs []net.Addr
+	for i, ln := range in.listeners {
+		if ln == nil {
+			continue
+		}
+		addrs = append(addrs, ln.Addr())
+		// 不删除套接字文件，它可能仍由 systemd 持有
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		ln.Close()
+		in.listeners[i] = nil
+	}
+	return addrs
+}
+
+// listenerMatches 判断监听的实际地址是否与配置一致
+// 配置中的主机为空或未指定地址时，匹配 IPv4 与 IPv6 的未指定地址
+func listenerMatches(ln net.Listener, network, addr string) bool {
+	switch a := ln.Addr().(type) {
+	case *net.UnixAddr:
+		return network == "unix" && a.Name == addr
+	case *net.TCPAddr:
+		if network != "tcp" {
+			return false
+		}
+		want, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil || want.Port != a.Port {
+			return false
+		}
+		if want.IP == nil || want.IP.IsUnspecified() {
+			return a.IP.IsUnspecified()
+		}
+		return want.IP.Equal(a.IP)
+	}
+	return false
+}
+
+// handoffReadyEnv 交接时新进程通知就绪使用的管道描述符
+const handoffReadyEnv = "HANDOFF_READY_FD"
+
+// Handoff 以相同的参数与环境变量启动新进程，并传递监听 (LISTEN_FDS)
+// 新进程调用 NotifyReady 后才返回，此时两个进程会同时接受连接，当前进程应随即进入排空流程；
+// 新进程在 readyTimeout 内未就绪或提前退出时结束新进程并返回错误，当前进程继续服务
+func Handoff(listeners []net.Listener, readyTimeout time.Duration) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*os.File, 0, len(listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, ln := range listeners {
+		filer, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("listener %s cannot be handed off", ln.Addr())
+		}
+		f, err := filer.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no listener to hand off")
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer ready.Close()
+	defer readyW.Close()
+
+	var env []string
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		switch key {
+		case "LISTEN_FDS", "LISTEN_PID", "LISTEN_FDNAMES", handoffReadyEnv:
+		default:
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		handoffReadyEnv+"="+strconv.Itoa(listenFDsStart+len(files)))
+
+	attr := &os.ProcAttr{
+		Env:   env,
+		Files: append(append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...), readyW),
+	}
+	proc, err := os.StartProcess(exe, os.Args, attr)
+	if err != nil {
+		return nil, err
+	}
+	// 只保留新进程持有的写端，新进程退出时读端随即返回 EOF
+	readyW.Close()
+	if err := waitReady(proc, ready, readyTimeout); err != nil {
+		return nil, err
+	}
+
+	// 交给新进程后，关闭监听时不能删除套接字文件
+	for _, ln := range listeners {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return proc, nil
+}
+
+// waitReady 等待新进程通过管道通知就绪，失败时结束并回收新进程
+func waitReady(proc *os.Process, ready *os.File, timeout time.Duration) error {
+	if err := ready.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		proc.Kill()
+		proc.Wait()
+		return err
+	}
+	_, err := ready.Read(make([]byte, 1))
+	if err == nil {
+		return nil
+	}
+	proc.Kill()
+	state, _ := proc.Wait()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("new process %d not ready within %s", proc.Pid, timeout)
+	}
+	return fmt.Errorf("new process %d exited before it was ready: %v", proc.Pid, state)
+}
+
+// NotifyReady 由 Handoff 启动的新进程在开始服务后调用，通知旧进程开始排空
+// 不是由 Handoff 启动时什么也不做
+func NotifyReady() error {
+	v := os.Getenv(handoffReadyEnv)
+	if v == "" {
+		return nil
+	}
+	os.Unsetenv(handoffReadyEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil || fd < listenFDsStart {
+		return fmt.Errorf("invalid %s %q", handoffReadyEnv, v)
+	}
+	f := os.NewFile(uintptr(fd), "handoff-ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
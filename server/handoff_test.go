@@ -0,0 +1,166 @@
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// handoffHelperEnv 设置时测试二进制作为 Handoff 启动的新进程运行
+const handoffHelperEnv = "DGPROXY_HANDOFF_HELPER"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(handoffHelperEnv) {
+	case "":
+		os.Exit(m.Run())
+	case "ready":
+		// 取出传递的监听，就绪后为一个连接返回自己的 pid
+		in, err := InheritedListeners()
+		if err != nil {
+			os.Exit(2)
+		}
+		ln, err := in.Take("tcp", os.Getenv("DGPROXY_HANDOFF_ADDR"))
+		if err != nil || ln == nil {
+			os.Exit(2)
+		}
+		if err := NotifyReady(); err != nil {
+			os.Exit(2)
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			os.Exit(2)
+		}
+		io.WriteString(conn, strconv.Itoa(os.Getpid()))
+		conn.Close()
+		os.Exit(0)
+	case "exit":
+		// 模拟配置错误导致启动失败
+		os.Exit(1)
+	case "hang":
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+}
+
+func TestInheritedTake(t *testing.T) {
+	listen := func(network, addr string) net.Listener {
+		ln, err := net.Listen(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		return ln
+	}
+	public := listen("tcp", "127.0.0.1:0")
+	admin := listen("tcp", "127.0.0.1:0")
+	wildcard := listen("tcp", ":0")
+	sock := t.TempDir() + "/dg.sock"
+	unix := listen("unix", sock)
+	stray := listen("tcp", "127.0.0.1:0")
+	port := func(ln net.Listener) string { return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port) }
+
+	// 传递顺序与配置顺序不同
+	in := &Inherited{listeners: []net.Listener{unix, stray, admin, wildcard, public}}
+	tests := []struct {
+		network, addr string
+		want          net.Listener
+		wantErr       bool
+	}{
+		{"tcp", "127.0.0.1:" + port(public), public, false},
+		{"tcp", "localhost:" + port(admin), admin, false},
+		{"tcp", "0.0.0.0:" + port(wildcard), wildcard, false},
+		{"unix", sock, unix, false},
+		// 已取出的监听不会再次匹配
+		{"tcp", "127.0.0.1:" + port(public), nil, true},
+		{"tcp", "127.0.0.2:" + port(stray), nil, true},
+		{"unix", sock + ".other", nil, true},
+	}
+	for _, tt := range tests {
+		ln, err := in.Take(tt.network, tt.addr)
+		if (err != nil) != tt.wantErr || ln != tt.want {
+			t.Fatalf("Take(%s, %s) = %v, %v", tt.network, tt.addr, ln, err)
+		}
+	}
+
+	unused := in.CloseUnused()
+	if len(unused) != 1 || unused[0].String() != stray.Addr().String() {
+		t.Fatalf("CloseUnused() = %v, want [%s]", unused, stray.Addr())
+	}
+	if _, err := stray.Accept(); err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Fatalf("unused listener should be closed, Accept() = %v", err)
+	}
+	if in.CloseUnused() != nil {
+		t.Fatal("CloseUnused() should be idempotent")
+	}
+
+	// 没有传递监听时由调用方自行创建
+	if ln, err := (&Inherited{}).Take("tcp", ":8080"); ln != nil || err != nil {
+		t.Fatalf("Take() without inherited listeners = %v, %v", ln, err)
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	tests := []struct {
+		helper  string
+		wantErr string
+	}{
+		{helper: "ready"},
+		{helper: "exit", wantErr: "exited before it was ready"},
+		{helper: "hang", wantErr: "not ready within"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.helper, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			t.Setenv(handoffHelperEnv, tt.helper)
+			t.Setenv("DGPROXY_HANDOFF_ADDR", ln.Addr().String())
+
+			start := time.Now()
+			proc, err := Handoff([]net.Listener{ln}, 500*time.Millisecond)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Handoff() error = %v, want %q", err, tt.wantErr)
+				}
+				if time.Since(start) > 5*time.Second {
+					t.Fatal("Handoff() should give up after the ready timeout")
+				}
+				// 放弃交接后当前进程的监听仍可使用
+				go func() {
+					if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+						c.Close()
+					}
+				}()
+				conn, err := ln.Accept()
+				if err != nil {
+					t.Fatalf("listener unusable after a failed handoff: %v", err)
+				}
+				conn.Close()
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer proc.Wait()
+
+			// 当前进程停止接受连接后，新连接由新进程处理
+			ln.Close()
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			pid, err := io.ReadAll(conn)
+			if err != nil || string(pid) != strconv.Itoa(proc.Pid) {
+				t.Fatalf("served by %q (%v), want pid %d", pid, err, proc.Pid)
+			}
+		})
+	}
+}
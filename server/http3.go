@@ -0,0 +1,63 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// NewHTTP3Server 创建 HTTP/3 (QUIC) 服务，与 TCP 服务共享同一处理链与证书
+// QUIC 连接在客户端切换网络 (Wi-Fi 与蜂窝网络) 后可以继续使用
+// altSvcPort 为客户端连接 UDP 端口 (0 时使用监听端口)，用于端口转发等场景
+// writeTimeout 与 TCP 服务的 WriteTimeout 相同，从收到请求起计算
+func NewHTTP3Server(addr string, handler http.Handler, tlsConfig *tls.Config, altSvcPort int, idleTimeout, writeTimeout time.Duration) *http3.Server {
+	return &http3.Server{
+		Addr:           addr,
+		Port:           altSvcPort,
+		Handler:        writeDeadline(writeTimeout, handler),
+		TLSConfig:      http3.ConfigureTLSConfig(tlsConfig),
+		IdleTimeout:    idleTimeout,
+		MaxHeaderBytes: 1 << 20,
+	}
+}
+
+// writeDeadline 为每个请求设置写超时
+// http3.Server 没有 WriteTimeout，超时后写入 QUIC 流失败，处理器随之结束；
+// 媒体透传的 streamWriter 会在数据流动时延后该超时
+func writeDeadline(timeout time.Duration, next http.Handler) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AltSvc 在 HTTP/1.1 与 HTTP/2 响应中通过 Alt-Svc 头通告 HTTP/3
+func AltSvc(h3 *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			// HTTP/3 监听尚未就绪时不通告
+			_ = h3.SetQUICHeaders(w.Header())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ListenAndServeHTTP3 启动 HTTP/3 服务
+// 监听交接时旧进程在开始排空后才释放 UDP 端口，端口被占用时在 wait 内重试
+func ListenAndServeHTTP3(h3 *http3.Server, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		err := h3.ListenAndServe()
+		if !errors.Is(err, syscall.EADDRINUSE) || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// selfSignedCert 生成 localhost 的自签名证书
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestHTTP3WriteTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	chunk := make([]byte, 256*1024)
+	// 处理器在超时后继续写出时的错误
+	writeErr := make(chan error, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fast", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		http.NewResponseController(w).Flush()
+		time.Sleep(2 * timeout)
+		var err error
+		for i := 0; i < 8 && err == nil; i++ {
+			_, err = w.Write(chunk)
+		}
+		writeErr <- err
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		// 与 streamWriter 相同，数据持续流动时延后写超时
+		rc := http.NewResponseController(w)
+		for i := 0; i < 5; i++ {
+			rc.SetWriteDeadline(time.Now().Add(timeout))
+			if _, err := io.WriteString(w, "x"); err != nil {
+				return
+			}
+			rc.Flush()
+			time.Sleep(timeout / 2)
+		}
+	})
+
+	cert, pool := selfSignedCert(t)
+	h3 := NewHTTP3Server("", mux, &tls.Config{Certificates: []tls.Certificate{cert}}, 0, time.Minute, timeout)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go h3.Serve(conn)
+	defer h3.Close()
+
+	tr := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "localhost"}}
+	defer tr.Close()
+	client := &http.Client{Transport: tr, Timeout: 10 * time.Second}
+	base := "https://" + conn.LocalAddr().String()
+
+	get := func(path string) (string, error) {
+		resp, err := client.Get(base + path)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.ProtoMajor != 3 {
+			return "", fmt.Errorf("protocol %s, want HTTP/3", resp.Proto)
+		}
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	if body, err := get("/fast"); err != nil || body != "ok" {
+		t.Fatalf("/fast = %q, %v", body, err)
+	}
+	if body, err := get("/stream"); err != nil || body != "xxxxx" {
+		t.Fatalf("/stream = %q, %v; a response that keeps extending the deadline should complete", body, err)
+	}
+
+	go get("/slow")
+	select {
+	case err := <-writeErr:
+		if err == nil {
+			t.Fatal("writes after the write timeout should fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow handler did not finish")
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 监听使用的处理器集合
+const (
+	// HandlerPublic 代理、TMDB、订阅转换等全部公开接口
+	HandlerPublic = "public"
+	// HandlerAdmin 健康检查与运行指标，只应监听在内网地址
+	HandlerAdmin = "admin"
+)
+
+// ListenerSpec 一个监听配置
+//
+//	tcp://:8080                        HTTP/1.1 (启用 TLS 时同时支持 HTTP/2)
+//	tcp://:8443?tls=true               使用 TLS_CERTS 中的证书
+//	h2c://127.0.0.1:8081               明文 HTTP/2 (prior knowledge)，同时支持 HTTP/1.1
+//	unix:///run/dgproxy.sock?mode=0660 Unix 域套接字，可加 h2c=true
+//	tcp://127.0.0.1:9090?handler=admin 内部管理接口
+type ListenerSpec struct {
+	Network string
+	Address string
+	TLS     bool
+	H2C     bool
+	Handler string
+	// Mode Unix 域套接字的文件权限，0 表示不修改
+	Mode os.FileMode
+}
+
+func (s ListenerSpec) String() string {
+	var opts []string
+	if s.TLS {
+		opts = append(opts, "tls")
+	}
+	if s.H2C {
+		opts = append(opts, "h2c")
+	}
+	opts = append(opts, s.Handler)
+	return fmt.Sprintf("%s://%s (%s)", s.Network, s.Address, strings.Join(opts, ", "))
+}
+
+// ParseListeners 解析逗号分隔的监听配置
+func ParseListeners(s string) ([]ListenerSpec, error) {
+	var specs []ListenerSpec
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		spec, err := parseListener(item)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+func parseListener(s string) (ListenerSpec, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ListenerSpec{}, fmt.Errorf("invalid listener %q: %w", s, err)
+	}
+	spec := ListenerSpec{Handler: HandlerPublic}
+	switch strings.ToLower(u.Scheme) {
+	case "tcp":
+		spec.Network, spec.Address = "tcp", u.Host
+	case "h2c":
+		spec.Network, spec.Address, spec.H2C = "tcp", u.Host, true
+	case "unix":
+		// unix://run/x.sock 会把 run 解析为主机，只接受 unix:///path 形式
+		if u.Host != "" {
+			return ListenerSpec{}, fmt.Errorf("invalid listener %q: unix socket path must follow unix:///", s)
+		}
+		spec.Network, spec.Address = "unix", u.Path
+	default:
+		return ListenerSpec{}, fmt.Errorf("invalid listener %q: unsupported scheme %q", s, u.Scheme)
+	}
+	if spec.Address == "" {
+		return ListenerSpec{}, fmt.Errorf("invalid listener %q: missing address", s)
+	}
+
+	query := u.Query()
+	if v := query.Get("tls"); v != "" {
+		if spec.TLS, err = strconv.ParseBool(v); err != nil {
+			return ListenerSpec{}, fmt.Errorf("invalid listener %q: bad tls option", s)
+		}
+	}
+	if v := query.Get("h2c"); v != "" {
+		if spec.H2C, err = strconv.ParseBool(v); err != nil {
+			return ListenerSpec{}, fmt.Errorf("invalid listener %q: bad h2c option", s)
+		}
+	}
+	if spec.TLS && spec.H2C {
+		return ListenerSpec{}, fmt.Errorf("invalid listener %q: h2c cannot be used with tls", s)
+	}
+	if v := query.Get("handler"); v != "" {
+		switch v {
+		case HandlerPublic, HandlerAdmin:
+			spec.Handler = v
+		default:
+			return ListenerSpec{}, fmt.Errorf("invalid listener %q: unknown handler %q", s, v)
+		}
+	}
+	if v := query.Get("mode"); v != "" {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || spec.Network != "unix" {
+			return ListenerSpec{}, fmt.Errorf("invalid listener %q: bad mode option", s)
+		}
+		spec.Mode = os.FileMode(mode)
+	}
+	return spec, nil
+}
+
+// Listen 创建监听
+// Unix 域套接字文件已存在且无人监听时 (上次异常退出的残留) 先删除
+func (s ListenerSpec) Listen() (net.Listener, error) {
+	if s.Network == "unix" {
+		if _, err := os.Stat(s.Address); err == nil {
+			if conn, err := net.Dial("unix", s.Address); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("listen unix %s: socket is in use", s.Address)
+			}
+			if err := os.Remove(s.Address); err != nil {
+				return nil, err
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen(s.Network, s.Address)
+	if err != nil {
+		return nil, err
+	}
+	if s.Network == "unix" && s.Mode != 0 {
+		if err := os.Chmod(s.Address, s.Mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// Protocols 返回监听支持的协议
+func (s ListenerSpec) Protocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	if s.TLS {
+		p.SetHTTP2(true)
+	}
+	if s.H2C {
+		p.SetUnencryptedHTTP2(true)
+	}
+	return p
+}
+
+// LocalPeer Unix 域套接字的对端没有 IP 地址，按本机回环地址处理，
+// 使限流按客户端区分以及 TRUST_PROXY 的默认信任规则 (回环地址) 生效
+func LocalPeer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, err := net.SplitHostPort(r.RemoteAddr); err != nil {
+			r.RemoteAddr = "127.0.0.1:0"
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseListeners(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []ListenerSpec
+		wantErr string
+	}{
+		{in: "", want: nil},
+		{in: " , ", want: nil},
+		{
+			in:   "tcp://:8080",
+			want: []ListenerSpec{{Network: "tcp", Address: ":8080", Handler: HandlerPublic}},
+		},
+		{
+			in: "tcp://:8443?tls=true, h2c://127.0.0.1:8081,tcp://[::1]:9090?handler=admin",
+			want: []ListenerSpec{
+				{Network: "tcp", Address: ":8443", TLS: true, Handler: HandlerPublic},
+				{Network: "tcp", Address: "127.0.0.1:8081", H2C: true, Handler: HandlerPublic},
+				{Network: "tcp", Address: "[::1]:9090", Handler: HandlerAdmin},
+			},
+		},
+		{
+			in:   "UNIX:///run/dgproxy.sock?mode=0660&h2c=1",
+			want: []ListenerSpec{{Network: "unix", Address: "/run/dgproxy.sock", H2C: true, Handler: HandlerPublic, Mode: 0o660}},
+		},
+		{in: "udp://:53", wantErr: "unsupported scheme"},
+		{in: ":8080", wantErr: "missing protocol scheme"},
+		{in: "localhost:8080", wantErr: "unsupported scheme"},
+		{in: "tcp://", wantErr: "missing address"},
+		{in: "unix://", wantErr: "missing address"},
+		{in: "unix://run/dgproxy.sock", wantErr: "unix:///"},
+		{in: "tcp://:8080?tls=yes please", wantErr: "bad tls option"},
+		{in: "tcp://:8080?h2c=maybe", wantErr: "bad h2c option"},
+		{in: "tcp://:8080?tls=true&h2c=true", wantErr: "h2c cannot be used with tls"},
+		{in: "tcp://:8080?handler=metrics", wantErr: "unknown handler"},
+		{in: "tcp://:8080?mode=0660", wantErr: "bad mode option"},
+		{in: "unix:///run/x.sock?mode=rw", wantErr: "bad mode option"},
+		{in: "tcp://:8080,udp://:53", wantErr: "unsupported scheme"},
+	}
+	for _, tt := range tests {
+		got, err := ParseListeners(tt.in)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseListeners(%q) error = %v, want %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseListeners(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseListeners(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestListenUnixStaleSocket(t *testing.T) {
+	path := t.TempDir() + "/dg.sock"
+	spec := ListenerSpec{Network: "unix", Address: path, Mode: 0o600}
+	ln, err := spec.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := spec.Listen(); err == nil {
+		t.Fatal("Listen() on a socket in use should fail")
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("socket mode = %v, %v", fi.Mode().Perm(), err)
+	}
+
+	// 模拟异常退出后残留的套接字文件
+	ln.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = spec.Listen()
+	if err != nil {
+		t.Fatalf("Listen() over a stale socket: %v", err)
+	}
+	ln.Close()
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		httpsPort string
+		method    string
+		host      string
+		target    string
+		want      string
+		wantCode  int
+	}{
+		{name: "default port", httpsPort: "443", host: "example.com", target: "/a?b=1", want: "https://example.com/a?b=1"},
+		{name: "empty port", host: "example.com:8080", target: "/", want: "https://example.com/"},
+		{name: "custom port", httpsPort: "8443", host: "example.com:8080", target: "/x", want: "https://example.com:8443/x"},
+		{name: "ipv4", httpsPort: "8443", host: "192.0.2.1", target: "/", want: "https://192.0.2.1:8443/"},
+		{name: "ipv6 with port", httpsPort: "443", host: "[2001:db8::1]:80", target: "/", want: "https://[2001:db8::1]/"},
+		{name: "ipv6 without port", httpsPort: "443", host: "[2001:db8::1]", target: "/", want: "https://[2001:db8::1]/"},
+		{name: "ipv6 custom port", httpsPort: "8443", host: "[2001:db8::1]", target: "/", want: "https://[2001:db8::1]:8443/"},
+		{name: "post keeps method", httpsPort: "443", method: http.MethodPost, host: "example.com", target: "/api/x", want: "https://example.com/api/x"},
+		{name: "escaped path", httpsPort: "443", host: "example.com", target: "/a%20b/?url=https%3A%2F%2Fx", want: "https://example.com/a%20b/?url=https%3A%2F%2Fx"},
+		{name: "missing host", httpsPort: "443", host: "", target: "/", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, tt.target, nil)
+			req.Host = tt.host
+			rec := httptest.NewRecorder()
+			RedirectHandler(tt.httpsPort).ServeHTTP(rec, req)
+
+			if tt.wantCode != 0 {
+				if rec.Code != tt.wantCode {
+					t.Fatalf("status = %d, want %d", rec.Code, tt.wantCode)
+				}
+				return
+			}
+			if rec.Code != http.StatusPermanentRedirect {
+				t.Fatalf("status = %d, want 308", rec.Code)
+			}
+			if got := rec.Header().Get("Location"); got != tt.want {
+				t.Fatalf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
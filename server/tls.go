@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certPair 一组证书与私钥文件
+type certPair struct {
+	certFile string
+	keyFile  string
+}
+
+// CertStore 从文件加载的多张证书，按 SNI 选择，文件变化后自动重新加载
+// 重新加载只影响之后的 TLS 握手，已建立的连接不受影响
+type CertStore struct {
+	pairs []certPair
+
+	mu       sync.RWMutex
+	certs    []*tls.Certificate
+	modTimes []time.Time
+}
+
+// parseCertPairs 解析证书配置，如 "a.crt:a.key,b.crt:b.key"
+func parseCertPairs(s string) ([]certPair, error) {
+	var pairs []certPair
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		certFile, keyFile, ok := strings.Cut(item, ":")
+		if !ok || certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("invalid certificate pair %q, expected cert:key", item)
+		}
+		pairs = append(pairs, certPair{strings.TrimSpace(certFile), strings.TrimSpace(keyFile)})
+	}
+	if len(pairs) == 0 {
+		return nil, errors.New("no certificate configured")
+	}
+	return pairs, nil
+}
+
+// NewCertStore 加载证书，任何一组加载失败都返回错误
+func NewCertStore(spec string) (*CertStore, error) {
+	pairs, err := parseCertPairs(spec)
+	if err != nil {
+		return nil, err
+	}
+	s := &CertStore{pairs: pairs}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload 重新加载全部证书，失败时保留当前证书
+func (s *CertStore) reload() error {
+	certs := make([]*tls.Certificate, len(s.pairs))
+	modTimes := make([]time.Time, len(s.pairs))
+	for i, p := range s.pairs {
+		modTime, err := latestModTime(p)
+		if err != nil {
+			return err
+		}
+		cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+		if err != nil {
+			return fmt.Errorf("load certificate %s: %w", p.certFile, err)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return fmt.Errorf("parse certificate %s: %w", p.certFile, err)
+			}
+		}
+		certs[i], modTimes[i] = &cert, modTime
+	}
+	s.mu.Lock()
+	s.certs, s.modTimes = certs, modTimes
+	s.mu.Unlock()
+	return nil
+}
+
+// changed 判断证书文件是否有变化
+func (s *CertStore) changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i, p := range s.pairs {
+		modTime, err := latestModTime(p)
+		if err != nil {
+			// 证书更新过程中文件可能暂时不存在，下次再检查
+			return false
+		}
+		if !modTime.Equal(s.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch 每隔 interval 检查证书文件，变化时重新加载，直到 ctx 结束
+func (s *CertStore) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !s.changed() {
+				continue
+			}
+			if err := s.reload(); err != nil {
+				log.Printf("[WARN] reload tls certificates failed, keep using the current ones: %v", err)
+				continue
+			}
+			log.Printf("[INFO] tls certificates reloaded")
+		}
+	}
+}
+
+// GetCertificate 按 SNI 与客户端支持的算法选择证书，没有匹配时使用第一张
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, cert := range s.certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return s.certs[0], nil
+}
+
+// TLSConfig 返回使用该证书库的 TLS 配置
+func (s *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.GetCertificate,
+	}
+}
+
+func latestModTime(p certPair) (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{p.certFile, p.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
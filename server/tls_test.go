@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeCertPair 在 dir 下生成 host 的自签名证书与私钥文件，返回 "cert:key" 配置
+func writeCertPair(t *testing.T, dir, host string, serial int64) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, host+".crt"), filepath.Join(dir, host+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile + ":" + keyFile
+}
+
+// touch 把文件的修改时间设为 d 之后，避免文件系统时间精度导致变化检测不到
+func touch(t *testing.T, d time.Duration, names ...string) {
+	t.Helper()
+	mtime := time.Now().Add(d)
+	for _, name := range names {
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// servedCert 以 serverName 为 SNI 完成一次握手，返回服务端出示的证书
+func servedCert(t *testing.T, s *CertStore, serverName string) *x509.Certificate {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	go tls.Server(serverConn, s.TLSConfig()).Handshake()
+
+	client := tls.Client(clientConn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return client.ConnectionState().PeerCertificates[0]
+}
+
+func TestParseCertPairs(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []certPair
+		wantErr bool
+	}{
+		{spec: "a.crt:a.key", want: []certPair{{"a.crt", "a.key"}}},
+		{spec: " a.crt : a.key , b.crt:b.key,", want: []certPair{{"a.crt", "a.key"}, {"b.crt", "b.key"}}},
+		{spec: "", wantErr: true},
+		{spec: "a.crt", wantErr: true},
+		{spec: "a.crt:", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCertPairs(tt.spec)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCertPairs(%q) = %v, %v", tt.spec, got, err)
+		}
+	}
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	dir := t.TempDir()
+	spec := writeCertPair(t, dir, "a.example", 1) + "," + writeCertPair(t, dir, "b.example", 2)
+	s, err := NewCertStore(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"a.example", "a.example"},
+		{"b.example", "b.example"},
+		// 没有匹配的证书时使用第一张
+		{"c.example", "a.example"},
+		{"", "a.example"},
+	}
+	for _, tt := range tests {
+		if got := servedCert(t, s, tt.serverName).DNSNames[0]; got != tt.want {
+			t.Errorf("SNI %q served %s, want %s", tt.serverName, got, tt.want)
+		}
+	}
+
+	if _, err := NewCertStore(spec + "," + filepath.Join(dir, "missing.crt") + ":" + filepath.Join(dir, "missing.key")); err == nil {
+		t.Error("NewCertStore() with a missing file should fail")
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	spec := writeCertPair(t, dir, "a.example", 1)
+	s, err := NewCertStore(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.changed() {
+		t.Fatal("changed() before any update")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Watch(ctx, 10*time.Millisecond)
+
+	// 续期后的证书在下一次检查时生效
+	writeCertPair(t, dir, "a.example", 2)
+	certFile, keyFile := filepath.Join(dir, "a.example.crt"), filepath.Join(dir, "a.example.key")
+	touch(t, time.Second, certFile, keyFile)
+	deadline := time.Now().Add(2 * time.Second)
+	for servedCert(t, s, "a.example").SerialNumber.Int64() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("renewed certificate was not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	// 只写了一半的证书加载失败，继续使用当前证书
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, data[:len(data)/2], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, 2*time.Second, certFile)
+	if !s.changed() {
+		t.Fatal("changed() = false after the file was rewritten")
+	}
+	if err := s.reload(); err == nil {
+		t.Fatal("reload() of a half-written certificate should fail")
+	}
+	if got := servedCert(t, s, "a.example").SerialNumber.Int64(); got != 2 {
+		t.Fatalf("served serial %d after a failed reload, want 2", got)
+	}
+
+	// 证书文件暂时不存在时不触发重新加载
+	if err := os.Remove(certFile); err != nil {
+		t.Fatal(err)
+	}
+	if s.changed() {
+		t.Fatal("changed() = true while the certificate file is missing")
+	}
+}
@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// 地址族偏好
+const (
+	// IPPreferenceAuto IPv6 与 IPv4 交替尝试，IPv6 优先
+	IPPreferenceAuto = "auto"
+	// IPPreferenceIPv4First IPv4 与 IPv6 交替尝试，IPv4 优先
+	IPPreferenceIPv4First = "prefer-ipv4"
+	// IPPreferenceIPv4Only 只连接 IPv4 地址
+	IPPreferenceIPv4Only = "ipv4"
+	// IPPreferenceIPv6Only 只连接 IPv6 地址
+	IPPreferenceIPv6Only = "ipv6"
+)
+
+// Dialer SafeDialContext 使用的拨号器，main 会按配置替换
+var Dialer = NewEyeballsDialer(IPPreferenceAuto, 250*time.Millisecond, 10*time.Second, 5*time.Minute)
+
+// EyeballsDialer 按 RFC 8305 (Happy Eyeballs) 交替排列 IPv6/IPv4 地址，
+// 每隔 fallbackDelay 并发发起下一个连接，取最先成功的连接
+// 最近连接失败的地址会被排到最后
+type EyeballsDialer struct {
+	preference     string
+	fallbackDelay  time.Duration
+	attemptTimeout time.Duration
+	failureTTL     time.Duration
+	// dial 发起单个连接，测试时可替换
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu     sync.Mutex
+	failed map[string]time.Time
+}
+
+// NewEyeballsDialer 创建拨号器
+func NewEyeballsDialer(preference string, fallbackDelay, attemptTimeout, failureTTL time.Duration) *EyeballsDialer {
+	switch preference {
+	case IPPreferenceIPv4First, IPPreferenceIPv4Only, IPPreferenceIPv6Only:
+	default:
+		preference = IPPreferenceAuto
+	}
+	return &EyeballsDialer{
+		preference:     preference,
+		fallbackDelay:  fallbackDelay,
+		attemptTimeout: attemptTimeout,
+		failureTTL:     failureTTL,
+		dial:           (&net.Dialer{KeepAlive: 30 * time.Second}).DialContext,
+		failed:         make(map[string]time.Time),
+	}
+}
+
+// DialIPs 连接已解析 (并通过 SSRF 检查) 的地址
+func (d *EyeballsDialer) DialIPs(ctx context.Context, network string, ips []net.IP, port string) (net.Conn, error) {
+	addrs := d.order(network, ips)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no usable address for %s (preference %s)", network, d.preference)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		idx  int
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		idx, ip := next, addrs[next]
+		next++
+		pending++
+		go func() {
+			attemptCtx, attemptCancel := context.WithTimeout(ctx, d.attemptTimeout)
+			defer attemptCancel()
+			conn, err := d.dial(attemptCtx, network, net.JoinHostPort(ip.String(), port))
+			results <- result{conn, idx, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(d.fallbackDelay)
+	defer timer.Stop()
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				d.forget(addrs[res.idx])
+				// 仍在进行的连接只是比这个慢，不记为失败；关闭其余稍后才建立成功的连接
+				go func(remaining int) {
+					for ; remaining > 0; remaining-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			// 只记录真正出错的地址，整体取消导致的失败不算
+			if ctx.Err() == nil {
+				d.remember(addrs[res.idx])
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			// 上一个连接失败时立即尝试下一个地址
+			if next < len(addrs) {
+				start()
+				timer.Reset(d.fallbackDelay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(d.fallbackDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// order 按偏好过滤并交替排列地址，最近失败的地址排在最后
+func (d *EyeballsDialer) order(network string, ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	if d.preference == IPPreferenceIPv4Only || network == "tcp4" {
+		v6 = nil
+	}
+	if d.preference == IPPreferenceIPv6Only || network == "tcp6" {
+		v4 = nil
+	}
+
+	first, second := v6, v4
+	if d.preference == IPPreferenceIPv4First {
+		first, second = v4, v6
+	}
+	ordered := make([]net.IP, 0, len(v4)+len(v6))
+	for i := 0; i < max(len(first), len(second)); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	healthy := ordered[:0:0]
+	var failed []net.IP
+	for _, ip := range ordered {
+		if at, ok := d.failed[ip.String()]; ok && now.Sub(at) < d.failureTTL {
+			failed = append(failed, ip)
+		} else {
+			healthy = append(healthy, ip)
+		}
+	}
+	return append(healthy, failed...)
+}
+
+// remember 记录连接失败的地址，顺便清理过期记录
+func (d *EyeballsDialer) remember(ip net.IP) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	d.failed[ip.String()] = now
+	if len(d.failed) > 1024 {
+		for k, at := range d.failed {
+			if now.Sub(at) >= d.failureTTL {
+				delete(d.failed, k)
+			}
+		}
+	}
+}
+
+// forget 连接成功后清除失败记录
+func (d *EyeballsDialer) forget(ip net.IP) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.failed, ip.String())
+}
@@ -0,0 +1,276 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func parseIPs(addrs ...string) []net.IP {
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = net.ParseIP(a)
+	}
+	return ips
+}
+
+func ipStrings(ips []net.IP) []string {
+	out := make([]string, len(ips))
+	for i, ip := range ips {
+		out[i] = ip.String()
+	}
+	return out
+}
+
+func TestEyeballsOrder(t *testing.T) {
+	ips := parseIPs("1.1.1.1", "1.1.1.2", "2001:db8::1", "2001:db8::2", "2001:db8::3")
+	tests := []struct {
+		name       string
+		preference string
+		network    string
+		failed     []string
+		want       []string
+	}{
+		{"auto interleaves ipv6 first", IPPreferenceAuto, "tcp", nil,
+			[]string{"2001:db8::1", "1.1.1.1", "2001:db8::2", "1.1.1.2", "2001:db8::3"}},
+		{"prefer ipv4", IPPreferenceIPv4First, "tcp", nil,
+			[]string{"1.1.1.1", "2001:db8::1", "1.1.1.2", "2001:db8::2", "2001:db8::3"}},
+		{"ipv4 only", IPPreferenceIPv4Only, "tcp", nil, []string{"1.1.1.1", "1.1.1.2"}},
+		{"ipv6 only", IPPreferenceIPv6Only, "tcp", nil, []string{"2001:db8::1", "2001:db8::2", "2001:db8::3"}},
+		{"tcp4 network", IPPreferenceAuto, "tcp4", nil, []string{"1.1.1.1", "1.1.1.2"}},
+		{"tcp6 network", IPPreferenceIPv4First, "tcp6", nil, []string{"2001:db8::1", "2001:db8::2", "2001:db8::3"}},
+		{"unknown preference falls back to auto", "bogus", "tcp", nil,
+			[]string{"2001:db8::1", "1.1.1.1", "2001:db8::2", "1.1.1.2", "2001:db8::3"}},
+		// 最近失败的地址保持原有相对顺序排到最后
+		{"failed addresses last", IPPreferenceAuto, "tcp", []string{"2001:db8::1", "1.1.1.2"},
+			[]string{"1.1.1.1", "2001:db8::2", "2001:db8::3", "2001:db8::1", "1.1.1.2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewEyeballsDialer(tt.preference, time.Millisecond, time.Second, time.Minute)
+			for _, ip := range tt.failed {
+				d.remember(net.ParseIP(ip))
+			}
+			if got := ipStrings(d.order(tt.network, ips)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("order() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// 失败记录过期后恢复原有顺序
+	d := NewEyeballsDialer(IPPreferenceAuto, time.Millisecond, time.Second, time.Minute)
+	d.failed["2001:db8::1"] = time.Now().Add(-2 * time.Minute)
+	if got := ipStrings(d.order("tcp", ips))[0]; got != "2001:db8::1" {
+		t.Fatalf("expired failure still penalized, first address = %s", got)
+	}
+}
+
+// fakeConn 记录是否被关闭
+type fakeConn struct {
+	net.Conn
+	addr   string
+	closed atomic.Bool
+}
+
+func (c *fakeConn) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+// fakeAttempt 描述对某个地址的一次模拟连接
+type fakeAttempt struct {
+	delay time.Duration
+	// block 为 true 时一直等到连接被取消
+	block bool
+	err   error
+}
+
+// fakeDialer 按地址返回预设结果，并记录发起连接的顺序
+type fakeDialer struct {
+	attempts map[string]fakeAttempt
+
+	mu    sync.Mutex
+	order []string
+	conns []*fakeConn
+	wg    sync.WaitGroup
+}
+
+func (f *fakeDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	f.wg.Add(1)
+	defer f.wg.Done()
+	host, _, _ := net.SplitHostPort(addr)
+	f.mu.Lock()
+	f.order = append(f.order, host)
+	f.mu.Unlock()
+
+	a := f.attempts[host]
+	if a.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	select {
+	case <-time.After(a.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if a.err != nil {
+		return nil, a.err
+	}
+	conn := &fakeConn{addr: host}
+	f.mu.Lock()
+	f.conns = append(f.conns, conn)
+	f.mu.Unlock()
+	return conn, nil
+}
+
+func TestEyeballsDialIPs(t *testing.T) {
+	refused := errors.New("connection refused")
+	tests := []struct {
+		name          string
+		preference    string
+		fallbackDelay time.Duration
+		attempts      map[string]fakeAttempt
+		wantConn      string
+		wantErr       error
+		wantOrder     []string
+		wantPenalized []string
+	}{
+		{
+			name:          "first address wins",
+			fallbackDelay: time.Hour,
+			attempts:      map[string]fakeAttempt{},
+			wantConn:      "2001:db8::1",
+			wantOrder:     []string{"2001:db8::1"},
+		},
+		{
+			// 失败后不等 fallbackDelay 立即尝试下一个地址
+			name:          "failure starts next attempt immediately",
+			fallbackDelay: time.Hour,
+			attempts:      map[string]fakeAttempt{"2001:db8::1": {err: refused}},
+			wantConn:      "1.1.1.1",
+			wantOrder:     []string{"2001:db8::1", "1.1.1.1"},
+			wantPenalized: []string{"2001:db8::1"},
+		},
+		{
+			// 第一个连接迟迟没有结果，fallbackDelay 后并发尝试下一个地址；
+			// 被取消的慢连接不记为失败
+			name:          "fallback delay race",
+			fallbackDelay: 20 * time.Millisecond,
+			attempts:      map[string]fakeAttempt{"2001:db8::1": {block: true}},
+			wantConn:      "1.1.1.1",
+			wantOrder:     []string{"2001:db8::1", "1.1.1.1"},
+		},
+		{
+			name:          "prefer ipv4",
+			preference:    IPPreferenceIPv4First,
+			fallbackDelay: time.Hour,
+			attempts:      map[string]fakeAttempt{},
+			wantConn:      "1.1.1.1",
+			wantOrder:     []string{"1.1.1.1"},
+		},
+		{
+			name:          "all fail",
+			fallbackDelay: time.Millisecond,
+			attempts: map[string]fakeAttempt{
+				"2001:db8::1": {err: refused},
+				"1.1.1.1":     {delay: 10 * time.Millisecond, err: errors.New("timeout")},
+			},
+			wantErr:       refused,
+			wantOrder:     []string{"2001:db8::1", "1.1.1.1"},
+			wantPenalized: []string{"2001:db8::1", "1.1.1.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewEyeballsDialer(tt.preference, tt.fallbackDelay, time.Second, time.Minute)
+			f := &fakeDialer{attempts: tt.attempts}
+			d.dial = f.dial
+
+			conn, err := d.DialIPs(context.Background(), "tcp", parseIPs("1.1.1.1", "2001:db8::1"), "443")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("DialIPs() error = %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if got := conn.(*fakeConn).addr; got != tt.wantConn {
+				t.Fatalf("connected to %s, want %s", got, tt.wantConn)
+			}
+			// 等待被取消的连接返回，确认它们没有被记为失败
+			f.wg.Wait()
+
+			f.mu.Lock()
+			order := f.order
+			f.mu.Unlock()
+			if !reflect.DeepEqual(order, tt.wantOrder) {
+				t.Fatalf("attempt order = %v, want %v", order, tt.wantOrder)
+			}
+			d.mu.Lock()
+			var penalized []string
+			for _, ip := range ipStrings(parseIPs("2001:db8::1", "1.1.1.1")) {
+				if _, ok := d.failed[ip]; ok {
+					penalized = append(penalized, ip)
+				}
+			}
+			d.mu.Unlock()
+			if !reflect.DeepEqual(penalized, tt.wantPenalized) {
+				t.Fatalf("penalized = %v, want %v", penalized, tt.wantPenalized)
+			}
+		})
+	}
+}
+
+func TestEyeballsClosesLateConnections(t *testing.T) {
+	d := NewEyeballsDialer(IPPreferenceAuto, 5*time.Millisecond, time.Second, time.Minute)
+	// 两个地址都会成功，但 IPv6 较慢；它比 IPv4 晚建立的连接必须被关闭
+	f := &fakeDialer{attempts: map[string]fakeAttempt{
+		"2001:db8::1": {delay: 30 * time.Millisecond},
+		"1.1.1.1":     {},
+	}}
+	// 忽略取消，模拟已经完成握手、来不及中止的连接
+	d.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return f.dial(context.WithoutCancel(ctx), network, addr)
+	}
+
+	conn, err := d.DialIPs(context.Background(), "tcp", parseIPs("2001:db8::1", "1.1.1.1"), "443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.(*fakeConn).addr != "1.1.1.1" {
+		t.Fatalf("connected to %s, want 1.1.1.1", conn.(*fakeConn).addr)
+	}
+	f.wg.Wait()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		f.mu.Lock()
+		var late *fakeConn
+		for _, c := range f.conns {
+			if c.addr == "2001:db8::1" {
+				late = c
+			}
+		}
+		f.mu.Unlock()
+		if late != nil && late.closed.Load() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("late connection was not closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if conn.(*fakeConn).closed.Load() {
+		t.Fatal("winning connection was closed")
+	}
+	d.mu.Lock()
+	_, penalized := d.failed["2001:db8::1"]
+	d.mu.Unlock()
+	if penalized {
+		t.Fatal("slower successful address was penalized")
+	}
+}
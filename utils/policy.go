@@ -0,0 +1,276 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// specialRange IANA 特殊用途地址段中不可全局路由的部分
+type specialRange struct {
+	prefix netip.Prefix
+	name   string
+}
+
+// specialRanges 参考 IANA IPv4/IPv6 Special-Purpose Address Registry
+var specialRanges = func() []specialRange {
+	ranges := []struct{ cidr, name string }{
+		{"0.0.0.0/8", "this network"},
+		{"10.0.0.0/8", "private-use"},
+		{"100.64.0.0/10", "shared address space (CGNAT)"},
+		{"127.0.0.0/8", "loopback"},
+		{"169.254.0.0/16", "link-local"},
+		{"172.16.0.0/12", "private-use"},
+		{"192.0.0.0/24", "IETF protocol assignments"},
+		{"192.0.2.0/24", "documentation (TEST-NET-1)"},
+		{"192.88.99.0/24", "6to4 relay anycast"},
+		{"192.168.0.0/16", "private-use"},
+		{"198.18.0.0/15", "benchmarking"},
+		{"198.51.100.0/24", "documentation (TEST-NET-2)"},
+		{"203.0.113.0/24", "documentation (TEST-NET-3)"},
+		{"224.0.0.0/4", "multicast"},
+		{"240.0.0.0/4", "reserved"},
+		{"255.255.255.255/32", "limited broadcast"},
+
+		{"::/128", "unspecified"},
+		{"::1/128", "loopback"},
+		{"::/96", "IPv4-compatible"},
+		{"64:ff9b:1::/48", "local-use IPv4/IPv6 translation"},
+		{"100::/64", "discard-only"},
+		{"2001::/23", "IETF protocol assignments"},
+		{"2001:db8::/32", "documentation"},
+		{"3fff::/20", "documentation"},
+		{"5f00::/16", "segment routing SIDs"},
+		{"fc00::/7", "unique-local"},
+		{"fe80::/10", "link-local"},
+		{"fec0::/10", "site-local"},
+		{"ff00::/8", "multicast"},
+	}
+	out := make([]specialRange, len(ranges))
+	for i, r := range ranges {
+		out[i] = specialRange{netip.MustParsePrefix(r.cidr), r.name}
+	}
+	return out
+}()
+
+// globalExceptions 特殊用途地址段中注册表标记为全局可达的部分，优先于 specialRanges
+var globalExceptions = func() []netip.Prefix {
+	cidrs := []string{
+		"192.0.0.9/32",    // Port Control Protocol anycast
+		"192.0.0.10/32",   // TURN anycast
+		"2001:1::1/128",   // Port Control Protocol anycast
+		"2001:1::2/128",   // TURN anycast
+		"2001:1::3/128",   // DNS-SD service registration protocol anycast
+		"2001:3::/32",     // AMT
+		"2001:4:112::/48", // AS112-v6
+		"2001:20::/28",    // ORCHIDv2
+		"2001:30::/28",    // drone remote ID (DET)
+	}
+	out := make([]netip.Prefix, len(cidrs))
+	for i, cidr := range cidrs {
+		out[i] = netip.MustParsePrefix(cidr)
+	}
+	return out
+}()
+
+var (
+	nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFour   = netip.MustParsePrefix("2002::/16")
+)
+
+// embeddedIPv4 返回 NAT64 (64:ff9b::/96) 与 6to4 (2002::/16) 地址中嵌入的 IPv4 地址
+func embeddedIPv4(addr netip.Addr) (netip.Addr, bool) {
+	b := addr.As16()
+	switch {
+	case nat64Prefix.Contains(addr):
+		return netip.AddrFrom4([4]byte{b[12], b[13], b[14], b[15]}), true
+	case sixToFour.Contains(addr):
+		return netip.AddrFrom4([4]byte{b[2], b[3], b[4], b[5]}), true
+	}
+	return netip.Addr{}, false
+}
+
+// specialPurpose 返回地址所属的特殊用途地址段说明，全局可路由地址返回空字符串
+func specialPurpose(addr netip.Addr) string {
+	addr = addr.Unmap()
+	if v4, ok := embeddedIPv4(addr); ok {
+		if name := specialPurpose(v4); name != "" {
+			return fmt.Sprintf("%s embedded in %s", name, addr)
+		}
+		return ""
+	}
+	for _, prefix := range globalExceptions {
+		if prefix.Contains(addr) {
+			return ""
+		}
+	}
+	for _, r := range specialRanges {
+		if r.prefix.Contains(addr) {
+			return fmt.Sprintf("%s %s", r.prefix, r.name)
+		}
+	}
+	return ""
+}
+
+// PolicyError 目标地址被 SSRF 策略拒绝
+type PolicyError struct {
+	Target string
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("SSRF policy rejected %s: %s", e.Target, e.Reason)
+}
+
+// SSRFPolicy 目标地址策略：内置特殊用途地址段，加上可配置的主机、网段与端口名单
+//
+//   - 拒绝名单优先于允许名单
+//   - AllowHosts 中的主机豁免内置地址段检查 (仍受 DenyCIDRs 限制)
+//   - AllowCIDRs 中的网段豁免内置地址段检查
+//   - AllowPorts 非空时只允许其中的端口
+type SSRFPolicy struct {
+	allowHosts []string
+	denyHosts  []string
+	allowCIDRs []netip.Prefix
+	denyCIDRs  []netip.Prefix
+	allowPorts map[int]bool
+	denyPorts  map[int]bool
+}
+
+// Policy SafeDialContext 与 ValidateTargetURL 使用的策略，main 会按配置替换
+var Policy = &SSRFPolicy{}
+
+// NewSSRFPolicy 从逗号分隔的名单创建策略
+// 主机名单中 "example.com" 只匹配该主机，"*.example.com" 或 ".example.com" 同时匹配其子域名
+func NewSSRFPolicy(allowHosts, denyHosts, allowCIDRs, denyCIDRs, allowPorts, denyPorts string) (*SSRFPolicy, error) {
+	p := &SSRFPolicy{
+		allowHosts: normalizeHostPatterns(allowHosts),
+		denyHosts:  normalizeHostPatterns(denyHosts),
+	}
+	var err error
+	if p.allowCIDRs, err = parsePrefixes(allowCIDRs); err != nil {
+		return nil, err
+	}
+	if p.denyCIDRs, err = parsePrefixes(denyCIDRs); err != nil {
+		return nil, err
+	}
+	if p.allowPorts, err = parsePorts(allowPorts); err != nil {
+		return nil, err
+	}
+	if p.denyPorts, err = parsePorts(denyPorts); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// CheckHost 检查主机名与端口，port 为空时不检查端口
+func (p *SSRFPolicy) CheckHost(host, port string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if pattern, ok := matchHostPattern(p.denyHosts, host); ok {
+		return &PolicyError{Target: host, Reason: "host matches deny rule " + pattern}
+	}
+	if port == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return &PolicyError{Target: host, Reason: "invalid port " + port}
+	}
+	if p.denyPorts[n] {
+		return &PolicyError{Target: net.JoinHostPort(host, port), Reason: "port is denied"}
+	}
+	if len(p.allowPorts) > 0 && !p.allowPorts[n] {
+		return &PolicyError{Target: net.JoinHostPort(host, port), Reason: "port is not in the allow list"}
+	}
+	return nil
+}
+
+// CheckIP 检查主机解析出的地址
+func (p *SSRFPolicy) CheckIP(host string, ip net.IP) error {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return &PolicyError{Target: host, Reason: "invalid address"}
+	}
+	addr = addr.Unmap()
+	target := addr.String()
+	if host != "" && host != target {
+		target = host + " (" + target + ")"
+	}
+
+	for _, prefix := range p.denyCIDRs {
+		if prefix.Contains(addr) {
+			return &PolicyError{Target: target, Reason: "address matches deny rule " + prefix.String()}
+		}
+	}
+	if _, ok := matchHostPattern(p.allowHosts, strings.ToLower(host)); ok && host != "" {
+		return nil
+	}
+	for _, prefix := range p.allowCIDRs {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+	if name := specialPurpose(addr); name != "" {
+		return &PolicyError{Target: target, Reason: "address is in " + name}
+	}
+	return nil
+}
+
+func matchHostPattern(patterns []string, host string) (string, bool) {
+	for _, pattern := range patterns {
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				return pattern, true
+			}
+		} else if host == pattern {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+func normalizeHostPatterns(s string) []string {
+	var patterns []string
+	for _, item := range SplitList(s) {
+		item = strings.ToLower(strings.TrimSuffix(item, "."))
+		if strings.HasPrefix(item, ".") {
+			item = "*" + item
+		}
+		patterns = append(patterns, item)
+	}
+	return patterns
+}
+
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range SplitList(s) {
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr %q: %w", item, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q: %w", item, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func parsePorts(s string) (map[int]bool, error) {
+	ports := make(map[int]bool)
+	for _, item := range SplitList(s) {
+		n, err := strconv.Atoi(item)
+		if err != nil || n <= 0 || n > 65535 {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+		ports[n] = true
+	}
+	return ports, nil
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestSpecialPurpose(t *testing.T) {
+	tests := []struct {
+		addr    string
+		special bool
+	}{
+		{"8.8.8.8", false},
+		{"10.1.2.3", true},
+		{"100.64.0.1", true},
+		{"192.0.0.8", true},
+		{"192.0.0.9", false},
+		{"::ffff:127.0.0.1", true},
+		{"64:ff9b::a00:1", true},
+		{"64:ff9b::808:808", false},
+		{"2002:c0a8:101::1", true},
+		{"2606:4700::1111", false},
+		// 2001::/23 整体不可全局路由，其中注册为全局可达的部分除外
+		{"2001::1", true},
+		{"2001:2::1", true},
+		{"2001:1::1", false},
+		{"2001:1::2", false},
+		{"2001:1::4", true},
+		{"2001:3::1", false},
+		{"2001:4:112::1", false},
+		{"2001:4:113::1", true},
+		{"2001:20::1", false},
+		{"2001:2f:ffff::1", false},
+		{"2001:30::1", false},
+		{"2001:40::1", true},
+		{"2001:db8::1", true},
+		{"fe80::1", true},
+	}
+	for _, tt := range tests {
+		got := specialPurpose(netip.MustParseAddr(tt.addr))
+		if (got != "") != tt.special {
+			t.Errorf("specialPurpose(%s) = %q, want special %v", tt.addr, got, tt.special)
+		}
+	}
+}
+
+func TestSSRFPolicyCheckHost(t *testing.T) {
+	p, err := NewSSRFPolicy("cdn.example.com,.media.example", "bad.cdn.example.com,*.example.com,cdn.example.net.", "", "", "80,443,8443", "8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host, port string
+		allowed    bool
+	}{
+		{"other.org", "443", true},
+		{"other.org", "", true},
+		// 拒绝名单优先于允许名单
+		{"cdn.example.com", "443", false},
+		{"bad.cdn.example.com", "443", false},
+		{"example.com", "443", false},
+		{"CDN.Example.NET.", "443", false},
+		{"example.net", "443", true},
+		{"a.media.example", "443", true},
+		// 拒绝端口优先于允许端口
+		{"other.org", "8443", false},
+		{"other.org", "8080", false},
+		{"other.org", "0", false},
+		{"other.org", "http", false},
+	}
+	for _, tt := range tests {
+		err := p.CheckHost(tt.host, tt.port)
+		if (err == nil) != tt.allowed {
+			t.Errorf("CheckHost(%s, %s) = %v, want allowed %v", tt.host, tt.port, err, tt.allowed)
+		}
+		var policyErr *PolicyError
+		if err != nil && !errors.As(err, &policyErr) {
+			t.Errorf("CheckHost(%s, %s) error %T is not a *PolicyError", tt.host, tt.port, err)
+		}
+	}
+}
+
+func TestSSRFPolicyCheckIP(t *testing.T) {
+	p, err := NewSSRFPolicy("internal.example,*.lan.example", "", "10.1.0.0/16,fd00::1", "10.1.2.0/24,8.8.4.4,192.168.1.5", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host    string
+		ip      string
+		allowed bool
+	}{
+		{"", "8.8.8.8", true},
+		{"", "127.0.0.1", false},
+		{"", "::ffff:10.0.0.1", false},
+		// 允许网段豁免内置地址段检查
+		{"", "10.1.3.4", true},
+		{"", "fd00::1", true},
+		{"", "fd00::2", false},
+		// 拒绝网段优先于允许网段与公网地址
+		{"", "10.1.2.3", false},
+		{"", "8.8.4.4", false},
+		{"", "::ffff:8.8.4.4", false},
+		// 允许主机豁免内置地址段检查，但仍受拒绝网段限制
+		{"internal.example", "192.168.1.4", true},
+		{"INTERNAL.example", "127.0.0.1", true},
+		{"nas.lan.example", "192.168.1.4", true},
+		{"internal.example", "192.168.1.5", false},
+		{"other.example", "192.168.1.4", false},
+	}
+	for _, tt := range tests {
+		err := p.CheckIP(tt.host, net.ParseIP(tt.ip))
+		if (err == nil) != tt.allowed {
+			t.Errorf("CheckIP(%q, %s) = %v, want allowed %v", tt.host, tt.ip, err, tt.allowed)
+		}
+	}
+
+	if err := p.CheckIP("x", net.IP{1, 2, 3}); err == nil {
+		t.Error("CheckIP() with an invalid address should fail")
+	}
+	// 默认策略只检查内置地址段
+	if err := (&SSRFPolicy{}).CheckIP("", net.ParseIP("169.254.169.254")); err == nil {
+		t.Error("default policy allowed a link-local address")
+	}
+}
+
+func TestNewSSRFPolicyInvalid(t *testing.T) {
+	for _, args := range [][6]string{
+		{"", "", "10.0.0.0/33", "", "", ""},
+		{"", "", "", "not-an-ip", "", ""},
+		{"", "", "", "", "65536", ""},
+		{"", "", "", "", "", "http"},
+	} {
+		if _, err := NewSSRFPolicy(args[0], args[1], args[2], args[3], args[4], args[5]); err == nil {
+			t.Errorf("NewSSRFPolicy(%q) should fail", args)
+		}
+	}
+}
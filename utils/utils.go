@@ -12,6 +12,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/zjyl1994/donggua-proxy/resolver"
 )
 
 var (
@@ -34,6 +36,7 @@ var (
 	}
 
 	// DefaultClient 全局复用的 HTTP 客户端，针对高并发场景优化
+	// 不设置整体超时，响应体的传输时间由调用方按内容类别限制
 	DefaultClient = &http.Client{
 		Transport: &http.Transport{
 			Proxy:                 http.ProxyFromEnvironment,
@@ -47,7 +50,6 @@ var (
 			ResponseHeaderTimeout: 15 * time.Second,
 			ExpectContinueTimeout: 1 * time.Second,
 		},
-		Timeout: 30 * time.Second,
 	}
 
 	// BufferPool 复用 IO 缓冲区，减少 GC 压力
@@ -59,87 +61,56 @@ var (
 		},
 	}
 
-	// DNS 缓存
-	dnsCache = sync.Map{}
+	// Resolver 解析目标域名，按记录 TTL 缓存；main 会按配置替换
+	Resolver = resolver.New(resolver.Config{
+		MinTTL:      10 * time.Second,
+		MaxTTL:      10 * time.Minute,
+		NegativeTTL: 30 * time.Second,
+		CacheSize:   4096,
+	})
 )
 
-type dnsCacheEntry struct {
-	ips    []net.IP
-	expiry time.Time
-}
-
 // lookupIPSafe 解析 IP，带缓存和 SSRF 检查
-func lookupIPSafe(host string) ([]net.IP, error) {
+func lookupIPSafe(ctx context.Context, host string) ([]net.IP, error) {
 	if ip := net.ParseIP(host); ip != nil {
-		if IsPrivateIP(ip) {
-			return nil, fmt.Errorf("SSRF detected: %s is private IP", host)
+		if err := Policy.CheckIP("", ip); err != nil {
+			return nil, err
 		}
 		return []net.IP{ip}, nil
 	}
 
-	// 1. 检查缓存
-	if val, ok := dnsCache.Load(host); ok {
-		entry := val.(dnsCacheEntry)
-		if time.Now().Before(entry.expiry) {
-			return entry.ips, nil
-		}
-		dnsCache.Delete(host)
-	}
-
-	// 2. DNS 解析
-	ips, err := net.LookupIP(host)
+	// 1. DNS 解析 (带缓存)
+	ips, err := Resolver.LookupIP(ctx, host)
 	if err != nil {
 		return nil, err
 	}
 
-	// 3. SSRF 检查
+	// 2. SSRF 检查
 	for _, ip := range ips {
-		if IsPrivateIP(ip) {
-			return nil, fmt.Errorf("SSRF detected: %s resolves to private IP %s", host, ip.String())
+		if err := Policy.CheckIP(host, ip); err != nil {
+			return nil, err
 		}
 	}
-
-	// 4. 写入缓存 (TTL 5分钟)
-	dnsCache.Store(host, dnsCacheEntry{
-		ips:    ips,
-		expiry: time.Now().Add(5 * time.Minute),
-	})
-
 	return ips, nil
 }
 
-// SafeDialContext 安全的 DialContext，包含 DNS 缓存和 SSRF 检查
+// SafeDialContext 安全的 DialContext，包含 DNS 缓存、SSRF 检查与多地址并发拨号
 func SafeDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	ips, err := lookupIPSafe(host)
-	if err != nil {
+	if err := Policy.CheckHost(host, port); err != nil {
 		return nil, err
 	}
-
-	// 尝试连接解析出的 IP
-	var lastErr error
-	for _, ip := range ips {
-		// 构造 TCP 地址
-		targetAddr := net.JoinHostPort(ip.String(), port)
-		conn, err := (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext(ctx, network, targetAddr)
-
-		if err == nil {
-			return conn, nil
-		}
-		lastErr = err
+	ips, err := lookupIPSafe(ctx, host)
+	if err != nil {
+		return nil, err
 	}
 
-	if lastErr != nil {
-		return nil, lastErr
-	}
-	return nil, fmt.Errorf("no IP addresses found for %s", host)
+	// 按 Happy Eyeballs 交替尝试 IPv6/IPv4 地址
+	return Dialer.DialIPs(ctx, network, ips, port)
 }
 
 // GetEnv 获取环境变量
@@ -178,12 +149,36 @@ func GetEnvInt(key string, fallback int) int {
 	return value
 }
 
+// GetEnvDuration 获取环境变量并解析为 time.Duration (如 "500ms"、"2s")，解析失败返回默认值
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	valueStr := strings.TrimSpace(GetEnv(key, ""))
+	if valueStr == "" {
+		return fallback
+	}
+	value, err := time.ParseDuration(valueStr)
+	if err != nil || value < 0 {
+		return fallback
+	}
+	return value
+}
+
+// SplitList 拆分逗号分隔的配置项，忽略空白项
+func SplitList(s string) []string {
+	var items []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			items = append(items, part)
+		}
+	}
+	return items
+}
+
 // SetCORSHeaders 统一设置 CORS
 func SetCORSHeaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS, HEAD")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Range")
-	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS, HEAD")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Range, If-Range, If-None-Match, If-Modified-Since, If-Match, If-Unmodified-Since, Accept-Language")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, Accept-Ranges, ETag, Last-Modified, Retry-After, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset")
 	w.Header().Set("Access-Control-Max-Age", "86400")
 }
 
@@ -289,16 +284,8 @@ func ResolveURL(u string, baseURL *url.URL, basePath string) string {
 	return baseURL.Scheme + "://" + baseURL.Host + basePath + u
 }
 
-// IsPrivateIP 检查 IP 是否为私有地址或回环地址
-func IsPrivateIP(ip net.IP) bool {
-	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
-		return true
-	}
-	return false
-}
-
-// ValidateTargetURL 验证目标 URL 的 Scheme
-// 注意：DNS 解析和私有 IP 检查已移动到 SafeDialContext 中
+// ValidateTargetURL 验证目标 URL 的 Scheme，并按 SSRF 策略检查主机、端口与字面 IP
+// 注意：域名解析后的地址检查在 SafeDialContext 中
 func ValidateTargetURL(targetURL *url.URL) error {
 	if targetURL == nil {
 		return fmt.Errorf("nil url")
@@ -313,6 +300,20 @@ func ValidateTargetURL(targetURL *url.URL) error {
 	if targetURL.User != nil {
 		return fmt.Errorf("userinfo not allowed")
 	}
+
+	host, port := targetURL.Hostname(), targetURL.Port()
+	if port == "" {
+		port = "80"
+		if scheme == "https" {
+			port = "443"
+		}
+	}
+	if err := Policy.CheckHost(host, port); err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return Policy.CheckIP("", ip)
+	}
 	return nil
 }
 